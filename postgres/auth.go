@@ -0,0 +1,238 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	scramSHA256 = "SCRAM-SHA-256"
+)
+
+// Authenticate acts as a PostgreSQL client and responds to the authentication
+// requests sent by a server after a `StartupMessage`. It returns once the
+// server sends `AuthenticationOk`. Cleartext, MD5 and SCRAM-SHA-256 password
+// authentication are supported.
+func Authenticate(r io.Reader, w io.Writer, user, password string) error {
+	var sc *scramClient
+	for {
+		chunk, err := ReadMessage(r)
+		if err != nil {
+			return err
+		}
+		bm, err := ParseBackendChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		var response pgproto3.FrontendMessage
+		switch m := bm.(type) {
+		case *pgproto3.AuthenticationOk:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("%w; %s (SQLSTATE %s)", ErrAuthentication, m.Message, m.Code)
+		case *pgproto3.AuthenticationCleartextPassword:
+			response = &pgproto3.PasswordMessage{Password: password}
+		case *pgproto3.AuthenticationMD5Password:
+			response = &pgproto3.PasswordMessage{Password: MD5Password(user, password, m.Salt)}
+		case *pgproto3.AuthenticationSASL:
+			if !containsString(m.AuthMechanisms, scramSHA256) {
+				return fmt.Errorf("%w; unsupported SASL mechanisms %v", ErrAuthentication, m.AuthMechanisms)
+			}
+			sc, err = newSCRAMClient(password)
+			if err != nil {
+				return err
+			}
+			response = &pgproto3.SASLInitialResponse{
+				AuthMechanism: scramSHA256,
+				Data:          sc.clientFirstMessage(),
+			}
+		case *pgproto3.AuthenticationSASLContinue:
+			if sc == nil {
+				return fmt.Errorf("%w; unexpected AuthenticationSASLContinue", ErrAuthentication)
+			}
+			data, err := sc.clientFinalMessage(m.Data)
+			if err != nil {
+				return err
+			}
+			response = &pgproto3.SASLResponse{Data: data}
+		case *pgproto3.AuthenticationSASLFinal:
+			if sc == nil {
+				return fmt.Errorf("%w; unexpected AuthenticationSASLFinal", ErrAuthentication)
+			}
+			err = sc.verifyServerFinal(m.Data)
+			if err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("%w; unexpected message %T", ErrAuthentication, bm)
+		}
+
+		_, err = w.Write(response.Encode(nil))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// MD5Password computes the response to an `AuthenticationMD5Password`
+// request, i.e. `"md5" + md5(md5(password + user) + salt)`.
+func MD5Password(user, password string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + user))
+	innerHex := hex.EncodeToString(inner[:])
+	outer := md5.Sum(append([]byte(innerHex), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// scramClient holds the state for the client side of a SCRAM-SHA-256
+// exchange.
+//
+// See: https://datatracker.ietf.org/doc/html/rfc5802
+type scramClient struct {
+	Password        string
+	ClientNonce     string
+	ClientFirstBare string
+	AuthMessage     string
+	SaltedPassword  []byte
+}
+
+func newSCRAMClient(password string) (*scramClient, error) {
+	nonce := make([]byte, 18)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	clientNonce := base64.RawStdEncoding.EncodeToString(nonce)
+	sc := &scramClient{
+		Password:    password,
+		ClientNonce: clientNonce,
+		// NOTE: The username is always taken from the startup message, so
+		//       it is left empty here.
+		ClientFirstBare: "n=,r=" + clientNonce,
+	}
+	return sc, nil
+}
+
+func (sc *scramClient) clientFirstMessage() []byte {
+	return []byte("n,," + sc.ClientFirstBare)
+}
+
+func (sc *scramClient) clientFinalMessage(serverFirst []byte) ([]byte, error) {
+	attributes := parseSCRAMAttributes(string(serverFirst))
+	serverNonce := attributes["r"]
+	if !strings.HasPrefix(serverNonce, sc.ClientNonce) {
+		return nil, fmt.Errorf("%w; invalid SCRAM server nonce", ErrAuthentication)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, fmt.Errorf("%w; invalid SCRAM salt; %v", ErrAuthentication, err)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("%w; invalid SCRAM iteration count", ErrAuthentication)
+	}
+
+	sc.SaltedPassword = pbkdf2SHA256([]byte(sc.Password), salt, iterations)
+	clientFinalWithoutProof := "c=biws,r=" + serverNonce
+	sc.AuthMessage = sc.ClientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof
+
+	clientKey := hmacSHA256(sc.SaltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], []byte(sc.AuthMessage))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	final := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(final), nil
+}
+
+func (sc *scramClient) verifyServerFinal(serverFinal []byte) error {
+	attributes := parseSCRAMAttributes(string(serverFinal))
+	if e, ok := attributes["e"]; ok {
+		return fmt.Errorf("%w; SCRAM server error %q", ErrAuthentication, e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return fmt.Errorf("%w; invalid SCRAM server signature; %v", ErrAuthentication, err)
+	}
+
+	serverKey := hmacSHA256(sc.SaltedPassword, []byte("Server Key"))
+	expected := hmacSHA256(serverKey, []byte(sc.AuthMessage))
+	if !hmac.Equal(expected, signature) {
+		return fmt.Errorf("%w; SCRAM server signature mismatch", ErrAuthentication)
+	}
+
+	return nil
+}
+
+func parseSCRAMAttributes(message string) map[string]string {
+	attributes := map[string]string{}
+	for _, part := range strings.Split(message, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			continue
+		}
+		attributes[part[:1]] = part[2:]
+	}
+	return attributes
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 computes PBKDF2 with HMAC-SHA-256 for a 32 byte derived key,
+// i.e. a single block of output.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	block := bytes.NewBuffer(nil)
+	block.Write(salt)
+	block.Write([]byte{0, 0, 0, 1})
+
+	u := hmacSHA256(password, block.Bytes())
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -12,7 +12,35 @@
 
 package postgres
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// ParseBackendChunk parses a complete PostgreSQL backend message (i.e. the
+// 1 byte message type, the 4 byte length and the body). Unlike
+// `pgproto3.Frontend.Receive()` the returned message is not shared and is
+// safe to retain.
+func ParseBackendChunk(chunk []byte) (pgproto3.BackendMessage, error) {
+	if len(chunk) < 5 {
+		err := fmt.Errorf(
+			"%w; message must contain at least 5 bytes, has %d",
+			ErrParsingServerMessage, len(chunk),
+		)
+		return nil, err
+	}
+
+	cr := pgproto3.NewChunkReader(bytes.NewReader(chunk))
+	f := pgproto3.NewFrontend(cr, nil)
+	bm, err := f.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("%w; %v", ErrParsingServerMessage, err)
+	}
+
+	return bm, nil
+}
 
 // DescribeBackendMessage tries to determine the **type** of backend message
 // based on the first few bytes of the TCP chunk.
@@ -25,4 +25,10 @@ var (
 	// ErrParsingServerMessage indicates a failure occurred when parsing a TCP
 	// packet as a PostgreSQL server message.
 	ErrParsingServerMessage = errors.New("failed to parse TCP packet as PostgesSQL server message")
+	// ErrMessageTooLarge indicates a PostgreSQL message has a length header
+	// outside of the supported range.
+	ErrMessageTooLarge = errors.New("invalid PostgreSQL message length")
+	// ErrAuthentication indicates a failure when authenticating with a
+	// PostgreSQL server.
+	ErrAuthentication = errors.New("failed to authenticate with PostgreSQL server")
 )
@@ -0,0 +1,89 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// MaxStartupMessageSize is the largest startup packet that will be read;
+	// it matches `MAX_STARTUP_PACKET_LENGTH` from the PostgreSQL source.
+	MaxStartupMessageSize = 10000
+	// MaxMessageSize is the largest (typed) message that will be read. This
+	// matches the 1GB limit PostgreSQL places on a single field value.
+	MaxMessageSize = 1 << 30
+)
+
+// ReadStartupMessage reads exactly one "untyped" message from `r`. These are
+// the messages sent by a client before the startup phase is complete (e.g.
+// `StartupMessage`, `SSLRequest` or `CancelRequest`) which have no leading
+// message type byte. The returned chunk includes the 4 byte length header so
+// it can be passed directly to `ParseChunk()` or forwarded verbatim.
+func ReadStartupMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header))
+	if size < 8 || size > MaxStartupMessageSize {
+		err = fmt.Errorf(
+			"%w; invalid startup message length %d",
+			ErrMessageTooLarge, size,
+		)
+		return nil, err
+	}
+
+	chunk := make([]byte, size)
+	copy(chunk, header)
+	_, err = io.ReadFull(r, chunk[4:])
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
+
+// ReadMessage reads exactly one "typed" message from `r`, i.e. a 1 byte
+// message type identifier followed by a 4 byte message length and the
+// message body. The returned chunk is the full message so it can be passed
+// directly to `ParseChunk()` / `ParseBackendChunk()` or forwarded verbatim.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(binary.BigEndian.Uint32(header[1:]))
+	if size < 4 || size > MaxMessageSize {
+		err = fmt.Errorf(
+			"%w; invalid length %d for message type %q",
+			ErrMessageTooLarge, size, header[0],
+		)
+		return nil, err
+	}
+
+	chunk := make([]byte, 1+size)
+	copy(chunk, header)
+	_, err = io.ReadFull(r, chunk[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	return chunk, nil
+}
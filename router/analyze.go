@@ -0,0 +1,485 @@
+package router
+
+import (
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+	"github.com/auxten/postgresql-parser/pkg/sql/types"
+)
+
+var (
+	// volatileFunctions are built-in functions that either write (and so
+	// cannot run on a hot standby) or depend on session state that is only
+	// meaningful on the primary.
+	volatileFunctions = map[string]bool{
+		"nextval":                             true,
+		"setval":                              true,
+		"currval":                             true,
+		"lastval":                             true,
+		"txid_current":                        true,
+		"pg_current_xact_id":                  true,
+		"set_config":                          true,
+		"pg_notify":                           true,
+		"pg_advisory_lock":                    true,
+		"pg_advisory_lock_shared":             true,
+		"pg_advisory_xact_lock":               true,
+		"pg_try_advisory_lock":                true,
+		"pg_try_advisory_xact_lock":           true,
+		"pg_advisory_unlock":                  true,
+		"pg_advisory_unlock_all":              true,
+		"pg_cancel_backend":                   true,
+		"pg_terminate_backend":                true,
+		"pg_switch_wal":                       true,
+		"pg_create_restore_point":             true,
+		"pg_create_logical_replication_slot":  true,
+		"pg_create_physical_replication_slot": true,
+		"pg_drop_replication_slot":            true,
+		"lo_create":                           true,
+		"lo_creat":                            true,
+		"lo_import":                           true,
+		"lo_unlink":                           true,
+		"dblink_exec":                         true,
+	}
+	// readOnlyFunctions are built-in functions that are known not to write
+	// and so can be called on a hot standby. Any other function called
+	// without a schema may be user defined and is assumed to write, unless it
+	// is marked read-only (see `FunctionRule`).
+	readOnlyFunctions = map[string]bool{
+		// Aggregate and window functions
+		"count":            true,
+		"sum":              true,
+		"avg":              true,
+		"min":              true,
+		"max":              true,
+		"array_agg":        true,
+		"string_agg":       true,
+		"bool_and":         true,
+		"bool_or":          true,
+		"every":            true,
+		"json_agg":         true,
+		"jsonb_agg":        true,
+		"json_object_agg":  true,
+		"jsonb_object_agg": true,
+		"row_number":       true,
+		"rank":             true,
+		"dense_rank":       true,
+		"percent_rank":     true,
+		"cume_dist":        true,
+		"ntile":            true,
+		"lag":              true,
+		"lead":             true,
+		"first_value":      true,
+		"last_value":       true,
+		"nth_value":        true,
+		// String functions
+		"lower":                 true,
+		"upper":                 true,
+		"initcap":               true,
+		"length":                true,
+		"char_length":           true,
+		"octet_length":          true,
+		"substring":             true,
+		"substr":                true,
+		"trim":                  true,
+		"btrim":                 true,
+		"ltrim":                 true,
+		"rtrim":                 true,
+		"lpad":                  true,
+		"rpad":                  true,
+		"left":                  true,
+		"right":                 true,
+		"replace":               true,
+		"translate":             true,
+		"reverse":               true,
+		"repeat":                true,
+		"concat":                true,
+		"concat_ws":             true,
+		"format":                true,
+		"position":              true,
+		"strpos":                true,
+		"split_part":            true,
+		"starts_with":           true,
+		"regexp_replace":        true,
+		"regexp_match":          true,
+		"regexp_matches":        true,
+		"regexp_split_to_array": true,
+		"md5":                   true,
+		"encode":                true,
+		"decode":                true,
+		"quote_ident":           true,
+		"quote_literal":         true,
+		"quote_nullable":        true,
+		"to_char":               true,
+		// Numeric functions
+		"abs":       true,
+		"ceil":      true,
+		"ceiling":   true,
+		"floor":     true,
+		"round":     true,
+		"trunc":     true,
+		"mod":       true,
+		"power":     true,
+		"sqrt":      true,
+		"greatest":  true,
+		"least":     true,
+		"random":    true,
+		"to_number": true,
+		// Date and time functions
+		"now":                   true,
+		"current_date":          true,
+		"current_time":          true,
+		"current_timestamp":     true,
+		"localtime":             true,
+		"localtimestamp":        true,
+		"clock_timestamp":       true,
+		"statement_timestamp":   true,
+		"transaction_timestamp": true,
+		"date_trunc":            true,
+		"date_part":             true,
+		"extract":               true,
+		"age":                   true,
+		"make_date":             true,
+		"make_interval":         true,
+		"to_date":               true,
+		"to_timestamp":          true,
+		"timezone":              true,
+		// Array, JSON and set returning functions
+		"array_length":            true,
+		"array_lower":             true,
+		"array_upper":             true,
+		"array_position":          true,
+		"array_to_string":         true,
+		"cardinality":             true,
+		"unnest":                  true,
+		"generate_series":         true,
+		"generate_subscripts":     true,
+		"to_json":                 true,
+		"to_jsonb":                true,
+		"row_to_json":             true,
+		"json_build_object":       true,
+		"jsonb_build_object":      true,
+		"json_build_array":        true,
+		"jsonb_build_array":       true,
+		"json_array_length":       true,
+		"jsonb_array_length":      true,
+		"json_extract_path":       true,
+		"jsonb_extract_path":      true,
+		"json_extract_path_text":  true,
+		"jsonb_extract_path_text": true,
+		"json_each":               true,
+		"jsonb_each":              true,
+		"json_array_elements":     true,
+		"jsonb_array_elements":    true,
+		"jsonb_object_keys":       true,
+		"jsonb_typeof":            true,
+		"jsonb_set":               true,
+		"jsonb_strip_nulls":       true,
+		"jsonb_pretty":            true,
+		// Session and catalog information functions
+		"coalesce":                      true,
+		"nullif":                        true,
+		"current_user":                  true,
+		"session_user":                  true,
+		"current_database":              true,
+		"current_schema":                true,
+		"current_schemas":               true,
+		"current_setting":               true,
+		"version":                       true,
+		"pg_backend_pid":                true,
+		"pg_typeof":                     true,
+		"pg_is_in_recovery":             true,
+		"pg_last_xact_replay_timestamp": true,
+		"pg_last_wal_receive_lsn":       true,
+		"pg_last_wal_replay_lsn":        true,
+		"has_table_privilege":           true,
+		"has_schema_privilege":          true,
+		"pg_has_role":                   true,
+		"pg_get_userbyid":               true,
+		"pg_table_is_visible":           true,
+		"format_type":                   true,
+		"pg_get_expr":                   true,
+		"pg_get_indexdef":               true,
+		"pg_get_constraintdef":          true,
+		"pg_get_viewdef":                true,
+		"pg_get_functiondef":            true,
+		"pg_get_function_arguments":     true,
+		"pg_get_function_result":        true,
+		"pg_get_triggerdef":             true,
+		"obj_description":               true,
+		"col_description":               true,
+		"pg_encoding_to_char":           true,
+		"pg_size_pretty":                true,
+		"pg_relation_size":              true,
+		"pg_table_size":                 true,
+		"pg_indexes_size":               true,
+		"pg_total_relation_size":        true,
+		"pg_get_serial_sequence":        true,
+		"to_regclass":                   true,
+	}
+	// relationFunctions are built-in functions whose first argument is the
+	// (possibly schema qualified) name of a relation, e.g.
+	// `nextval('billing.invoice_id_seq')`.
+	relationFunctions = map[string]bool{
+		"nextval":                true,
+		"setval":                 true,
+		"currval":                true,
+		"to_regclass":            true,
+		"pg_get_serial_sequence": true,
+		"pg_relation_size":       true,
+		"pg_table_size":          true,
+		"pg_indexes_size":        true,
+		"pg_total_relation_size": true,
+	}
+)
+
+const (
+	// KindFunction is the kind of a function (or procedure) referenced by a
+	// statement.
+	KindFunction = "function"
+	// KindType is the kind of a user defined type referenced by a statement.
+	KindType = "type"
+	// KindSchema is the kind of a schema created, altered or dropped by a
+	// statement; the relation has no name.
+	KindSchema = "schema"
+)
+
+// Relation is a table (or view, sequence, etc.) referenced by a statement.
+// Schema qualified functions, procedures and types are also routed as
+// relations, with a `Kind` set.
+type Relation struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	// Explicit indicates the schema was written in the statement rather than
+	// resolved from the `search_path`.
+	Explicit bool   `json:"explicit"`
+	Kind     string `json:"kind,omitempty"`
+}
+
+// String returns the relation as a qualified name, e.g. `billing.invoices`
+// or `billing.charge_customer()` for a function.
+func (r Relation) String() string {
+	if r.Kind == KindSchema {
+		return r.Schema
+	}
+	name := r.Name
+	if r.Kind == KindFunction {
+		name += "()"
+	}
+	if r.Schema == "" {
+		return name
+	}
+	return r.Schema + "." + name
+}
+
+// Function is a function referenced by a statement.
+type Function struct {
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+}
+
+// Analysis describes a single parsed statement.
+type Analysis struct {
+	SQL string
+	// Tag is the statement tag, e.g. `SELECT` or `CREATE TABLE`.
+	Tag       string
+	Relations []Relation
+	Functions []Function
+	// DDL indicates the statement changes the schema, e.g. `CREATE TABLE`.
+	DDL bool
+	// CreatedSchemas are the schemas created by the statement (via
+	// `CREATE SCHEMA` or `ALTER SCHEMA ... RENAME TO`).
+	CreatedSchemas []string
+	// ReadOnly indicates the statement can safely run on a read replica: it
+	// is a `SELECT` without a locking clause, without a data modifying
+	// common table expression and without calls to volatile functions.
+	ReadOnly bool
+	// UnknownFunctions are the functions called without a schema that are
+	// not known to be read-only; they are the only reason a statement that
+	// would otherwise be read-only is not (see `Router.ReadOnly()`).
+	UnknownFunctions []Function
+	// CatalogSchemas and CatalogNames are the schema and relation names
+	// used to filter catalog columns (e.g. `n.nspname = 'crm'`); they are
+	// used to route catalog queries.
+	CatalogSchemas []string
+	CatalogNames   []string
+}
+
+// Analyze walks the syntax tree of a parsed statement and collects every
+// referenced relation along with enough information to route it.
+func Analyze(statement parser.Statement) Analysis {
+	a := Analysis{SQL: statement.SQL}
+	if statement.AST == nil {
+		return a
+	}
+	a.Tag = statement.AST.StatementTag()
+
+	ast := statement.AST
+	var userTypes []Relation
+	if ts, ok := ast.(*TypedStatement); ok {
+		ast = ts.Statement
+		userTypes = ts.Types
+	}
+	a.DDL = ast.StatementType() == tree.DDL
+
+	ctes := map[string]bool{}
+	walk(ast, func(node interface{}) bool {
+		if cte, ok := node.(*tree.CTE); ok {
+			ctes[string(cte.Name.Alias)] = true
+		}
+		return true
+	})
+
+	readOnly := isSelect(ast)
+	var unknown []Function
+	seen := map[Relation]bool{}
+	add := func(r Relation) {
+		if !seen[r] {
+			seen[r] = true
+			a.Relations = append(a.Relations, r)
+		}
+	}
+	for _, t := range userTypes {
+		add(t)
+	}
+	walk(ast, func(node interface{}) bool {
+		switch n := node.(type) {
+		case *tree.TableName:
+			r := Relation{
+				Schema:   string(n.SchemaName),
+				Name:     string(n.TableName),
+				Explicit: n.ExplicitSchema,
+			}
+			if !r.Explicit {
+				r.Schema = ""
+				if ctes[r.Name] {
+					return true
+				}
+			}
+			add(r)
+		case *tree.UnresolvedObjectName:
+			add(objectRelation(n))
+		case *tree.CreateSchema:
+			add(Relation{Schema: n.Schema, Explicit: true, Kind: KindSchema})
+			a.CreatedSchemas = append(a.CreatedSchemas, n.Schema)
+		case *SchemaStatement:
+			for _, schema := range n.Schemas {
+				add(Relation{Schema: schema, Explicit: true, Kind: KindSchema})
+			}
+			if n.RenameTo != "" {
+				add(Relation{Schema: n.RenameTo, Explicit: true, Kind: KindSchema})
+				a.CreatedSchemas = append(a.CreatedSchemas, n.RenameTo)
+			}
+		case *tree.FuncExpr:
+			f := functionName(n)
+			a.Functions = append(a.Functions, f)
+			if isVolatile(f) {
+				readOnly = false
+			} else if f.Schema == "" && !readOnlyFunctions[strings.ToLower(f.Name)] {
+				unknown = append(unknown, f)
+			}
+			if f.Schema == "" || f.Schema == "pg_catalog" {
+				if r, ok := relationArgument(f, n.Exprs); ok {
+					add(r)
+				}
+			} else {
+				add(Relation{Schema: f.Schema, Name: f.Name, Explicit: true, Kind: KindFunction})
+			}
+		case *tree.CastExpr:
+			// NOTE: A `regclass` cast such as `'billing.invoices'::regclass`
+			//       references a relation by name.
+			if n.Type != nil && n.Type.Oid() == types.RegClass.Oid() {
+				if r, ok := relationLiteral(n.Expr); ok {
+					add(r)
+				}
+			}
+		case *tree.ComparisonExpr:
+			schema, name := catalogFilter(n)
+			if schema != "" {
+				a.CatalogSchemas = append(a.CatalogSchemas, schema)
+			}
+			if name != "" {
+				a.CatalogNames = append(a.CatalogNames, name)
+			}
+		case *tree.Select:
+			if len(n.Locking) > 0 {
+				readOnly = false
+			}
+		case *tree.Insert, *tree.Update, *tree.Delete:
+			readOnly = false
+		}
+		return true
+	})
+	a.ReadOnly = readOnly && len(unknown) == 0
+	if readOnly {
+		a.UnknownFunctions = unknown
+	}
+
+	return a
+}
+
+func objectRelation(n *tree.UnresolvedObjectName) Relation {
+	r := Relation{Name: n.Parts[0]}
+	if n.NumParts > 1 {
+		r.Schema = n.Parts[1]
+		r.Explicit = true
+	}
+	return r
+}
+
+// relationArgument returns the relation named by the first argument of a
+// function in `relationFunctions`, if the argument is a string literal.
+func relationArgument(f Function, args tree.Exprs) (Relation, bool) {
+	if !relationFunctions[strings.ToLower(f.Name)] || len(args) == 0 {
+		return Relation{}, false
+	}
+	return relationLiteral(args[0])
+}
+
+// relationLiteral parses a string literal containing a relation name, e.g.
+// `'billing.invoices'` or `'"Billing"."Invoices"'`.
+func relationLiteral(expr tree.Expr) (Relation, bool) {
+	s, ok := expr.(*tree.StrVal)
+	if !ok {
+		return Relation{}, false
+	}
+	n, err := parser.ParseTableName(s.RawString())
+	if err != nil {
+		return Relation{}, false
+	}
+	return objectRelation(n), true
+}
+
+func isSelect(ast tree.Statement) bool {
+	switch ast.(type) {
+	case *tree.Select, *tree.ParenSelect:
+		return true
+	}
+	return false
+}
+
+func functionName(f *tree.FuncExpr) Function {
+	switch ref := f.Func.FunctionReference.(type) {
+	case *tree.UnresolvedName:
+		fn := Function{Name: ref.Parts[0]}
+		if ref.NumParts > 1 {
+			fn.Schema = ref.Parts[1]
+		}
+		return fn
+	case *tree.FunctionDefinition:
+		return Function{Name: ref.Name}
+	}
+	return Function{Name: f.Func.String()}
+}
+
+// isVolatile determines if a function call prevents a statement from being
+// sent to a replica. User defined functions in a schema other than
+// `pg_catalog` are assumed to be volatile since their definitions are
+// unknown to the router. (Functions called without a schema are only known
+// to be read-only if they are in `readOnlyFunctions`.)
+func isVolatile(f Function) bool {
+	if f.Schema != "" && f.Schema != "pg_catalog" {
+		return true
+	}
+	return volatileFunctions[strings.ToLower(f.Name)]
+}
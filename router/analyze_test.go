@@ -0,0 +1,125 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+)
+
+// parseOne parses SQL that must contain exactly one statement.
+func parseOne(t *testing.T, sql string) Analysis {
+	t.Helper()
+	statements, err := parser.Parse(sql)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed; %v", sql, err)
+	}
+	if len(statements) != 1 {
+		t.Fatalf("Parse(%q) returned %d statements, expected 1", sql, len(statements))
+	}
+	return Analyze(statements[0])
+}
+
+func TestAnalyzeReadOnly(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL      string
+		ReadOnly bool
+	}{
+		{SQL: "SELECT 1", ReadOnly: true},
+		{SQL: "SELECT * FROM billing.invoices WHERE id = $1", ReadOnly: true},
+		{SQL: "SELECT i.* FROM billing.invoices i JOIN crm.contacts c ON c.id = i.contact_id", ReadOnly: true},
+		{SQL: "SELECT count(*) FROM (SELECT * FROM billing.invoices) AS sub", ReadOnly: true},
+		{SQL: "WITH recent AS (SELECT * FROM billing.invoices) SELECT * FROM recent", ReadOnly: true},
+		{SQL: "SELECT * FROM billing.invoices FOR UPDATE", ReadOnly: false},
+		{SQL: "SELECT * FROM billing.invoices FOR SHARE", ReadOnly: false},
+		{SQL: "WITH gone AS (DELETE FROM billing.invoices RETURNING *) SELECT * FROM gone", ReadOnly: false},
+		{SQL: "SELECT nextval('billing.invoice_ids')", ReadOnly: false},
+		{SQL: "SELECT pg_advisory_lock(42)", ReadOnly: false},
+		{SQL: "SELECT set_config('search_path', 'crm', false)", ReadOnly: false},
+		{SQL: "SELECT billing.charge_customer(1)", ReadOnly: false},
+		{SQL: "SELECT charge_customer(1)", ReadOnly: false},
+		{SQL: "SELECT nextval_wrapper()", ReadOnly: false},
+		{SQL: "SELECT lower(name), now() FROM crm.contacts", ReadOnly: true},
+		{SQL: "SELECT pg_catalog.format_type(1, 2)", ReadOnly: true},
+		{SQL: "INSERT INTO billing.invoices (id) VALUES (1)", ReadOnly: false},
+		{SQL: "UPDATE billing.invoices SET paid = true", ReadOnly: false},
+		{SQL: "DELETE FROM billing.invoices", ReadOnly: false},
+		{SQL: "CREATE TABLE billing.refunds (id INT8)", ReadOnly: false},
+		{SQL: "SET search_path = crm", ReadOnly: false},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			a := parseOne(t, tc.SQL)
+			if a.ReadOnly != tc.ReadOnly {
+				t.Fatalf("ReadOnly = %v, expected %v", a.ReadOnly, tc.ReadOnly)
+			}
+		})
+	}
+}
+
+func TestAnalyzeRelations(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL       string
+		Tag       string
+		DDL       bool
+		Relations []Relation
+	}{
+		{
+			SQL: "SELECT * FROM billing.invoices",
+			Tag: "SELECT",
+			Relations: []Relation{
+				{Schema: "billing", Name: "invoices", Explicit: true},
+			},
+		},
+		{
+			SQL: "SELECT * FROM invoices i JOIN crm.contacts c ON c.id = i.contact_id",
+			Tag: "SELECT",
+			Relations: []Relation{
+				{Name: "invoices"},
+				{Schema: "crm", Name: "contacts", Explicit: true},
+			},
+		},
+		{
+			SQL: "WITH recent AS (SELECT * FROM billing.invoices) SELECT * FROM recent",
+			Tag: "SELECT",
+			Relations: []Relation{
+				{Schema: "billing", Name: "invoices", Explicit: true},
+			},
+		},
+		{
+			SQL: `INSERT INTO "Billing".invoices (id) VALUES (1)`,
+			Tag: "INSERT",
+			Relations: []Relation{
+				{Schema: "Billing", Name: "invoices", Explicit: true},
+			},
+		},
+		{
+			SQL: "DROP TABLE crm.contacts",
+			Tag: "DROP TABLE",
+			DDL: true,
+			Relations: []Relation{
+				{Schema: "crm", Name: "contacts", Explicit: true},
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			a := parseOne(t, tc.SQL)
+			if a.Tag != tc.Tag {
+				t.Fatalf("Tag = %q, expected %q", a.Tag, tc.Tag)
+			}
+			if a.DDL != tc.DDL {
+				t.Fatalf("DDL = %v, expected %v", a.DDL, tc.DDL)
+			}
+			if !reflect.DeepEqual(a.Relations, tc.Relations) {
+				t.Fatalf("Relations = %#v, expected %#v", a.Relations, tc.Relations)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+const (
+	// CatalogDefault sends catalog queries to `CatalogRule.Backend` (or, if
+	// it is not set, the backend that received the previous statement).
+	CatalogDefault = "default"
+	// CatalogSchema sends catalog queries that filter on a single schema
+	// (e.g. `WHERE n.nspname = 'crm'`) or relation name to the backend that
+	// owns it; other catalog queries are handled as with `CatalogDefault`.
+	CatalogSchema = "schema"
+	// CatalogFanOut is like `CatalogSchema`, but catalog queries that do not
+	// filter on a schema are sent to every backend and the rows are merged.
+	CatalogFanOut = "fan_out"
+)
+
+var (
+	// catalogRelations are the tables and views in `pg_catalog`, which
+	// PostgreSQL implicitly searches before the `search_path`.
+	catalogRelations = map[string]bool{
+		"pg_aggregate":                    true,
+		"pg_am":                           true,
+		"pg_amop":                         true,
+		"pg_amproc":                       true,
+		"pg_attrdef":                      true,
+		"pg_attribute":                    true,
+		"pg_auth_members":                 true,
+		"pg_authid":                       true,
+		"pg_available_extension_versions": true,
+		"pg_available_extensions":         true,
+		"pg_backend_memory_contexts":      true,
+		"pg_cast":                         true,
+		"pg_class":                        true,
+		"pg_collation":                    true,
+		"pg_config":                       true,
+		"pg_constraint":                   true,
+		"pg_conversion":                   true,
+		"pg_cursors":                      true,
+		"pg_database":                     true,
+		"pg_db_role_setting":              true,
+		"pg_default_acl":                  true,
+		"pg_depend":                       true,
+		"pg_description":                  true,
+		"pg_enum":                         true,
+		"pg_event_trigger":                true,
+		"pg_extension":                    true,
+		"pg_file_settings":                true,
+		"pg_foreign_data_wrapper":         true,
+		"pg_foreign_server":               true,
+		"pg_foreign_table":                true,
+		"pg_group":                        true,
+		"pg_hba_file_rules":               true,
+		"pg_ident_file_mappings":          true,
+		"pg_index":                        true,
+		"pg_indexes":                      true,
+		"pg_inherits":                     true,
+		"pg_init_privs":                   true,
+		"pg_language":                     true,
+		"pg_largeobject":                  true,
+		"pg_largeobject_metadata":         true,
+		"pg_locks":                        true,
+		"pg_matviews":                     true,
+		"pg_namespace":                    true,
+		"pg_opclass":                      true,
+		"pg_operator":                     true,
+		"pg_opfamily":                     true,
+		"pg_parameter_acl":                true,
+		"pg_partitioned_table":            true,
+		"pg_policies":                     true,
+		"pg_policy":                       true,
+		"pg_prepared_statements":          true,
+		"pg_prepared_xacts":               true,
+		"pg_proc":                         true,
+		"pg_publication":                  true,
+		"pg_publication_namespace":        true,
+		"pg_publication_rel":              true,
+		"pg_publication_tables":           true,
+		"pg_range":                        true,
+		"pg_replication_origin":           true,
+		"pg_replication_origin_status":    true,
+		"pg_replication_slots":            true,
+		"pg_rewrite":                      true,
+		"pg_roles":                        true,
+		"pg_rules":                        true,
+		"pg_seclabel":                     true,
+		"pg_seclabels":                    true,
+		"pg_sequence":                     true,
+		"pg_sequences":                    true,
+		"pg_settings":                     true,
+		"pg_shadow":                       true,
+		"pg_shdepend":                     true,
+		"pg_shdescription":                true,
+		"pg_shmem_allocations":            true,
+		"pg_shseclabel":                   true,
+		"pg_stat_activity":                true,
+		"pg_stat_all_indexes":             true,
+		"pg_stat_all_tables":              true,
+		"pg_stat_archiver":                true,
+		"pg_stat_bgwriter":                true,
+		"pg_stat_database":                true,
+		"pg_stat_database_conflicts":      true,
+		"pg_stat_gssapi":                  true,
+		"pg_stat_io":                      true,
+		"pg_stat_progress_analyze":        true,
+		"pg_stat_progress_basebackup":     true,
+		"pg_stat_progress_cluster":        true,
+		"pg_stat_progress_copy":           true,
+		"pg_stat_progress_create_index":   true,
+		"pg_stat_progress_vacuum":         true,
+		"pg_stat_recovery_prefetch":       true,
+		"pg_stat_replication":             true,
+		"pg_stat_replication_slots":       true,
+		"pg_stat_slru":                    true,
+		"pg_stat_ssl":                     true,
+		"pg_stat_subscription":            true,
+		"pg_stat_subscription_stats":      true,
+		"pg_stat_sys_indexes":             true,
+		"pg_stat_sys_tables":              true,
+		"pg_stat_user_functions":          true,
+		"pg_stat_user_indexes":            true,
+		"pg_stat_user_tables":             true,
+		"pg_stat_wal":                     true,
+		"pg_stat_wal_receiver":            true,
+		"pg_stat_xact_all_tables":         true,
+		"pg_stat_xact_sys_tables":         true,
+		"pg_stat_xact_user_functions":     true,
+		"pg_stat_xact_user_tables":        true,
+		"pg_statio_all_indexes":           true,
+		"pg_statio_all_sequences":         true,
+		"pg_statio_all_tables":            true,
+		"pg_statio_sys_indexes":           true,
+		"pg_statio_sys_sequences":         true,
+		"pg_statio_sys_tables":            true,
+		"pg_statio_user_indexes":          true,
+		"pg_statio_user_sequences":        true,
+		"pg_statio_user_tables":           true,
+		"pg_statistic":                    true,
+		"pg_statistic_ext":                true,
+		"pg_statistic_ext_data":           true,
+		"pg_stats":                        true,
+		"pg_stats_ext":                    true,
+		"pg_stats_ext_exprs":              true,
+		"pg_subscription":                 true,
+		"pg_subscription_rel":             true,
+		"pg_tables":                       true,
+		"pg_tablespace":                   true,
+		"pg_timezone_abbrevs":             true,
+		"pg_timezone_names":               true,
+		"pg_transform":                    true,
+		"pg_trigger":                      true,
+		"pg_ts_config":                    true,
+		"pg_ts_config_map":                true,
+		"pg_ts_dict":                      true,
+		"pg_ts_parser":                    true,
+		"pg_ts_template":                  true,
+		"pg_type":                         true,
+		"pg_user":                         true,
+		"pg_user_mapping":                 true,
+		"pg_user_mappings":                true,
+		"pg_views":                        true,
+	}
+	// catalogSchemaColumns are catalog columns that contain a schema name.
+	catalogSchemaColumns = map[string]bool{
+		"nspname":           true,
+		"schemaname":        true,
+		"schema_name":       true,
+		"table_schema":      true,
+		"sequence_schema":   true,
+		"routine_schema":    true,
+		"specific_schema":   true,
+		"constraint_schema": true,
+		"trigger_schema":    true,
+		"udt_schema":        true,
+		"view_schema":       true,
+	}
+	// catalogNameColumns are catalog columns that contain a relation name.
+	catalogNameColumns = map[string]bool{
+		"relname":       true,
+		"tablename":     true,
+		"table_name":    true,
+		"viewname":      true,
+		"sequencename":  true,
+		"sequence_name": true,
+		"matviewname":   true,
+	}
+	// psqlNamePattern matches the regular expressions `psql` generates for a
+	// name without wildcards, e.g. `^(invoices)$`.
+	psqlNamePattern = regexp.MustCompile(`^\^\(([A-Za-z0-9_$ ]+)\)\$$`)
+)
+
+// CatalogRule determines how queries that only reference system catalogs
+// (`pg_catalog` and `information_schema`) are routed, e.g. the queries
+// behind `psql` meta-commands such as `\dt` or `\d table`.
+type CatalogRule struct {
+	// Mode is one of `default` (the default), `schema` or `fan_out`.
+	Mode string `json:"mode,omitempty"`
+	// Backend is the designated backend for catalog queries that are not
+	// otherwise routed.
+	Backend string `json:"backend,omitempty"`
+}
+
+// Validate checks that a catalog rule is well-formed.
+func (cr CatalogRule) Validate() error {
+	switch cr.Mode {
+	case "", CatalogDefault, CatalogSchema, CatalogFanOut:
+		return nil
+	}
+	return fmt.Errorf("%w, unknown catalog mode %q", ErrInvalidRule, cr.Mode)
+}
+
+// catalogFilter determines if a comparison filters a well-known catalog
+// column on a schema or relation name, either with `=` or with a `psql`
+// style `~` pattern. At most one of `schema` and `name` is set.
+func catalogFilter(c *tree.ComparisonExpr) (schema, name string) {
+	if c.Operator != tree.EQ && c.Operator != tree.RegMatch {
+		return "", ""
+	}
+
+	column, value := c.Left, c.Right
+	if _, ok := stripCollate(column).(*tree.StrVal); ok {
+		column, value = value, column
+	}
+	ref, ok := stripCollate(column).(*tree.UnresolvedName)
+	if !ok {
+		return "", ""
+	}
+	literal, ok := stripCollate(value).(*tree.StrVal)
+	if !ok {
+		return "", ""
+	}
+
+	s := literal.RawString()
+	if c.Operator == tree.RegMatch {
+		match := psqlNamePattern.FindStringSubmatch(s)
+		if match == nil {
+			return "", ""
+		}
+		s = match[1]
+	}
+
+	columnName := strings.ToLower(ref.Parts[0])
+	switch {
+	case catalogSchemaColumns[columnName]:
+		return s, ""
+	case catalogNameColumns[columnName]:
+		return "", s
+	}
+	return "", ""
+}
+
+func stripCollate(expr tree.Expr) tree.Expr {
+	for {
+		switch e := expr.(type) {
+		case *tree.CollateExpr:
+			expr = e.Expr
+		case *tree.ParenExpr:
+			expr = e.Expr
+		default:
+			return expr
+		}
+	}
+}
+
+// routeCatalog determines the backend for statements that only reference
+// system catalogs. Returns the backend (if any) and whether the statements
+// should be sent to every backend.
+func (r *Router) routeCatalog(analyses []Analysis, s Session) (string, bool) {
+	if r.catalog.Mode == CatalogSchema || r.catalog.Mode == CatalogFanOut {
+		backends := map[string]bool{}
+		for _, a := range analyses {
+			for _, schema := range a.CatalogSchemas {
+				if backend := r.SchemaBackend(schema, s); backend != "" {
+					backends[backend] = true
+				}
+			}
+			if len(a.CatalogSchemas) > 0 {
+				continue
+			}
+			// NOTE: Without a schema filter, a relation name is resolved
+			//       with the `search_path` (as `pg_table_is_visible()` does).
+			for _, name := range a.CatalogNames {
+				if _, backend := r.Resolve(Relation{Name: name}, s); backend != "" {
+					backends[backend] = true
+				}
+			}
+		}
+		if len(backends) == 1 {
+			for backend := range backends {
+				return backend, false
+			}
+		}
+		if r.catalog.Mode == CatalogFanOut && len(backends) == 0 && len(analyses) == 1 && analyses[0].ReadOnly {
+			return "", true
+		}
+	}
+	return r.catalog.Backend, false
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// optionsPrefix is the prefix for `ConnectionRule.Match` keys that match
+	// a setting in the `options` startup parameter rather than a startup
+	// parameter itself.
+	optionsPrefix = "options."
+)
+
+// ConnectionRule assigns a backend to a client connection based on the
+// parameters in its `StartupMessage` (e.g. `user`, `database` or
+// `application_name`). The backend receives the startup connection and every
+// relation in a schema that is not matched by a (schema) `Rule`.
+type ConnectionRule struct {
+	// Match maps startup parameter names to glob patterns (see
+	// `path.Match`); every pattern must match for the rule to apply. A key
+	// of the form `options.<setting>` matches a setting passed via
+	// `options`, e.g. `options.proxy.route` matches `-c proxy.route=analytics`.
+	Match   map[string]string `json:"match"`
+	Backend string            `json:"backend"`
+}
+
+// Validate checks that a connection rule is well-formed.
+func (cr ConnectionRule) Validate() error {
+	if len(cr.Match) == 0 {
+		return fmt.Errorf("%w, connection rule requires at least one parameter to match", ErrInvalidRule)
+	}
+	if cr.Backend == "" {
+		return fmt.Errorf("%w, backend is required for connection rule %s", ErrInvalidRule, cr)
+	}
+	for key, pattern := range cr.Match {
+		if key == "" || key == optionsPrefix {
+			return fmt.Errorf("%w, connection rule %s has an empty parameter name", ErrInvalidRule, cr)
+		}
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("%w, connection rule %s has an invalid pattern %q", ErrInvalidRule, cr, pattern)
+		}
+	}
+	return nil
+}
+
+// String describes the rule as `key=pattern` pairs.
+func (cr ConnectionRule) String() string {
+	keys := sortedKeys(cr.Match)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+cr.Match[key])
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// Matches determines if every pattern in the rule matches the startup
+// parameters. A parameter that was not sent is treated as empty.
+func (cr ConnectionRule) Matches(parameters map[string]string) bool {
+	var options map[string]string
+	for key, pattern := range cr.Match {
+		value := parameters[key]
+		if strings.HasPrefix(key, optionsPrefix) {
+			if options == nil {
+				options = ParseOptions(parameters["options"])
+			}
+			value = options[strings.TrimPrefix(key, optionsPrefix)]
+		}
+		ok, err := path.Match(pattern, value)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ConnectionBackend returns the backend for a client connection: the backend
+// of the first connection rule matching the startup parameters or the
+// default backend.
+func (r *Router) ConnectionBackend(parameters map[string]string) string {
+	for _, cr := range r.connections {
+		if cr.Matches(parameters) {
+			return cr.Backend
+		}
+	}
+	return r.defaultBackend
+}
+
+// ParseOptions parses the settings in the `options` startup parameter, i.e.
+// command-line arguments of the form `-c name=value` or `--name=value`.
+// Spaces within a value are escaped with a backslash.
+func ParseOptions(options string) map[string]string {
+	var args []string
+	var current strings.Builder
+	escaped := false
+	for _, c := range options {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ' ' || c == '\t':
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+
+	settings := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		setting := ""
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			setting = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			setting = strings.TrimPrefix(args[i], "-c")
+		case strings.HasPrefix(args[i], "--"):
+			setting = strings.TrimPrefix(args[i], "--")
+		default:
+			continue
+		}
+
+		eq := strings.Index(setting, "=")
+		if eq <= 0 {
+			continue
+		}
+		// NOTE: PostgreSQL treats `-` and `_` as equivalent in setting names
+		//       passed on the command line.
+		name := strings.ReplaceAll(setting[:eq], "-", "_")
+		settings[name] = setting[eq+1:]
+	}
+	return settings
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
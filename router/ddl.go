@@ -0,0 +1,125 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/lex"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+const (
+	// UnknownSchemaDefault sends `CREATE SCHEMA` for a schema that does not
+	// match any rule to the backend that owns such schemas (the session's
+	// backend or the default backend).
+	UnknownSchemaDefault = "default"
+	// UnknownSchemaReject rejects `CREATE SCHEMA` for a schema that does not
+	// match any rule.
+	UnknownSchemaReject = "reject"
+)
+
+var (
+	// dropSchemaSyntax matches `DROP SCHEMA`, which the parser does not
+	// support.
+	dropSchemaSyntax = regexp.MustCompile(
+		`(?is)^\s*DROP\s+SCHEMA\s+(?:IF\s+EXISTS\s+)?(` + identifierSyntax + `(?:\s*,\s*` + identifierSyntax + `)*)\s*(?:CASCADE|RESTRICT)?\s*$`,
+	)
+	// alterSchemaSyntax matches `ALTER SCHEMA`, which the parser does not
+	// support.
+	alterSchemaSyntax = regexp.MustCompile(
+		`(?is)^\s*ALTER\s+SCHEMA\s+(` + identifierSyntax + `)\s+(?:RENAME\s+TO\s+(` + identifierSyntax + `)|OWNER\s+TO\s+` + identifierSyntax + `)\s*$`,
+	)
+	identifierPattern = regexp.MustCompile(identifierSyntax)
+)
+
+// DDLRule determines how DDL that creates schemas is routed.
+type DDLRule struct {
+	// UnknownSchemas is one of `default` (the default) or `reject`.
+	UnknownSchemas string `json:"unknown_schemas,omitempty"`
+}
+
+// Validate checks that a DDL rule is well-formed.
+func (dr DDLRule) Validate() error {
+	switch dr.UnknownSchemas {
+	case "", UnknownSchemaDefault, UnknownSchemaReject:
+		return nil
+	}
+	return fmt.Errorf("%w, unknown DDL mode %q for unknown schemas", ErrInvalidRule, dr.UnknownSchemas)
+}
+
+// SchemaStatement is an `ALTER SCHEMA` or `DROP SCHEMA` statement; the
+// parser does not support either.
+type SchemaStatement struct {
+	// Tag is `ALTER SCHEMA` or `DROP SCHEMA`.
+	Tag     string
+	Schemas []string
+	// RenameTo is the new name for `ALTER SCHEMA ... RENAME TO`.
+	RenameTo string
+}
+
+// Format implements `tree.NodeFormatter`.
+func (ss *SchemaStatement) Format(ctx *tree.FmtCtx) {
+	ctx.WriteString(ss.Tag)
+	for i, schema := range ss.Schemas {
+		if i > 0 {
+			ctx.WriteString(",")
+		}
+		ctx.WriteString(" ")
+		lex.EncodeRestrictedSQLIdent(&ctx.Buffer, schema, lex.EncNoFlags)
+	}
+	if ss.RenameTo != "" {
+		ctx.WriteString(" RENAME TO ")
+		lex.EncodeRestrictedSQLIdent(&ctx.Buffer, ss.RenameTo, lex.EncNoFlags)
+	}
+}
+
+// String implements `tree.Statement`.
+func (ss *SchemaStatement) String() string {
+	return tree.AsString(ss)
+}
+
+// StatementType implements `tree.Statement`.
+func (*SchemaStatement) StatementType() tree.StatementType {
+	return tree.DDL
+}
+
+// StatementTag implements `tree.Statement`.
+func (ss *SchemaStatement) StatementTag() string {
+	return ss.Tag
+}
+
+// parseSchemaStatement parses an `ALTER SCHEMA` or `DROP SCHEMA` statement.
+func parseSchemaStatement(sql string) (*SchemaStatement, bool) {
+	if match := dropSchemaSyntax.FindStringSubmatch(sql); match != nil {
+		ss := &SchemaStatement{Tag: "DROP SCHEMA"}
+		for _, name := range identifierPattern.FindAllString(match[1], -1) {
+			ss.Schemas = append(ss.Schemas, identifier(name))
+		}
+		return ss, true
+	}
+	if match := alterSchemaSyntax.FindStringSubmatch(sql); match != nil {
+		ss := &SchemaStatement{Tag: "ALTER SCHEMA", Schemas: []string{identifier(match[1])}}
+		if match[2] != "" {
+			ss.RenameTo = identifier(match[2])
+		}
+		return ss, true
+	}
+	return nil, false
+}
+
+// checkCreatedSchemas applies the DDL rule to the schemas created (or
+// renamed to) by a statement.
+func (r *Router) checkCreatedSchemas(a Analysis) error {
+	if r.ddl.UnknownSchemas != UnknownSchemaReject {
+		return nil
+	}
+	for _, schema := range a.CreatedSchemas {
+		if isSystemSchema(schema) {
+			continue
+		}
+		if _, ok := r.match(schema); !ok {
+			return fmt.Errorf("%w; schema %q does not match any route", ErrUnknownSchema, schema)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package router inspects parsed PostgreSQL statements and determines which
+// backend (i.e. which PostgreSQL server) they should be sent to.
+package router
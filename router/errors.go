@@ -0,0 +1,32 @@
+package router
+
+import (
+	"errors"
+)
+
+var (
+	// ErrInvalidRule is the error returned when a routing rule fails
+	// validation.
+	ErrInvalidRule = errors.New("invalid routing rule")
+	// ErrCrossBackend is the error returned when the relations referenced by
+	// a statement are owned by more than one backend.
+	ErrCrossBackend = errors.New("statement references relations owned by multiple backends")
+	// ErrInvalidHint is the error returned when a routing hint in a SQL
+	// comment cannot be parsed.
+	ErrInvalidHint = errors.New("invalid routing hint")
+	// ErrRewrite is the error returned when a statement that references a
+	// renamed schema cannot be rewritten safely.
+	ErrRewrite = errors.New("statement cannot be rewritten")
+	// ErrUnknownSchema is the error returned when DDL creates a schema that
+	// does not match any rule and such schemas are rejected.
+	ErrUnknownSchema = errors.New("schema is not routed to a backend")
+	// ErrNotMigrating is the error returned when cutting over a schema that
+	// is not being migrated.
+	ErrNotMigrating = errors.New("schema is not being migrated")
+	// ErrUnknownBackend is the error returned when a schema is routed (e.g.
+	// via a lookup table) to a backend that is not configured.
+	ErrUnknownBackend = errors.New("schema is routed to an unknown backend")
+	// ErrFirewallDenied is the error returned when a firewall rule denies a
+	// statement.
+	ErrFirewallDenied = errors.New("statement denied by firewall")
+)
@@ -0,0 +1,300 @@
+package router
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+)
+
+const (
+	// FirewallDeny rejects the statements a firewall rule applies to.
+	FirewallDeny = "deny"
+	// FirewallAllow accepts the statements a firewall rule applies to, so
+	// later rules are not consulted.
+	FirewallAllow = "allow"
+	// StatementTypeDDL matches any statement that changes the schema in
+	// `FirewallRule.StatementTypes`.
+	StatementTypeDDL = "DDL"
+)
+
+var (
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+)
+
+// FirewallRule allows or denies statements before they are sent to a
+// backend. A rule applies to a statement when every condition that is set
+// holds; the first rule that applies decides and statements that no rule
+// applies to are allowed.
+type FirewallRule struct {
+	// Name identifies the rule in errors; defaults to its position, e.g.
+	// `#2`.
+	Name string `json:"name,omitempty"`
+	// Action is `deny` (the default) or `allow`.
+	Action string `json:"action,omitempty"`
+	// Users restricts the rule to these users (glob patterns, see
+	// `path.Match`).
+	Users []string `json:"users,omitempty"`
+	// Schemas restricts the rule to statements that reference a relation in
+	// one of these schemas, after resolving unqualified names with the
+	// session `search_path`.
+	Schemas []string `json:"schemas,omitempty"`
+	// StatementTypes restricts the rule to statements with one of these
+	// tags, e.g. `TRUNCATE` or `DROP TABLE`. A single word also matches the
+	// tags it starts (`DROP` matches `DROP TABLE` and `DROP SCHEMA`) and
+	// `DDL` matches any statement that changes the schema.
+	StatementTypes []string `json:"statement_types,omitempty"`
+	// Functions restricts the rule to statements that call one of these
+	// functions (glob patterns, e.g. `pg_read_*`). A pattern without a
+	// schema matches the function in any schema; unqualified calls are
+	// treated as calls in `pg_catalog`.
+	Functions []string `json:"functions,omitempty"`
+	// Windows restricts the rule to these periods (e.g. a migration
+	// window).
+	Windows []TimeWindow `json:"windows,omitempty"`
+}
+
+// TimeWindow is a daily period such as `09:00` to `17:00`; a period that
+// ends before it starts (`22:00` to `02:00`) ends on the next day.
+type TimeWindow struct {
+	// Days restricts the window to the days it starts on (`mon`, `tue`,
+	// ...); defaults to every day.
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	// Timezone is an IANA time zone, e.g. `America/Chicago`; defaults to
+	// UTC.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Validate checks that a firewall rule is well-formed.
+func (fr FirewallRule) Validate() error {
+	switch fr.Action {
+	case "", FirewallDeny, FirewallAllow:
+	default:
+		return fmt.Errorf("%w, firewall rule %s has unknown action %q", ErrInvalidRule, fr, fr.Action)
+	}
+	if len(fr.Users) == 0 && len(fr.Schemas) == 0 && len(fr.StatementTypes) == 0 && len(fr.Functions) == 0 && len(fr.Windows) == 0 {
+		return fmt.Errorf("%w, firewall rule %s has no conditions", ErrInvalidRule, fr)
+	}
+	for _, pattern := range append(append([]string(nil), fr.Users...), fr.Functions...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("%w, firewall rule %s has an invalid pattern %q", ErrInvalidRule, fr, pattern)
+		}
+	}
+	for _, tw := range fr.Windows {
+		_, _, _, err := tw.parse()
+		if err != nil {
+			return fmt.Errorf("%w, firewall rule %s has an invalid window; %v", ErrInvalidRule, fr, err)
+		}
+	}
+	return nil
+}
+
+// String describes the rule by name, e.g. `"no-truncate"`.
+func (fr FirewallRule) String() string {
+	if fr.Name == "" {
+		return "(unnamed)"
+	}
+	return strconv.Quote(fr.Name)
+}
+
+// parse returns the start and end (in minutes after midnight) and the time
+// zone of the window.
+func (tw TimeWindow) parse() (int, int, *time.Location, error) {
+	start, err := time.Parse("15:04", tw.Start)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("start %q is not HH:MM", tw.Start)
+	}
+	end, err := time.Parse("15:04", tw.End)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("end %q is not HH:MM", tw.End)
+	}
+	location := time.UTC
+	if tw.Timezone != "" {
+		location, err = time.LoadLocation(tw.Timezone)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	for _, day := range tw.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return 0, 0, nil, fmt.Errorf("unknown day %q", day)
+		}
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), location, nil
+}
+
+// Contains determines if a time is within the window.
+func (tw TimeWindow) Contains(now time.Time) bool {
+	start, end, location, err := tw.parse()
+	if err != nil {
+		return false
+	}
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	switch {
+	case start <= end:
+		if minute < start || minute >= end {
+			return false
+		}
+	case minute >= start:
+	case minute < end:
+		// NOTE: The window started the previous day.
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if len(tw.Days) == 0 {
+		return true
+	}
+	for _, d := range tw.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckFirewall applies the firewall rules (see `Options.Firewall`) to each
+// statement; the first statement that is denied is an error.
+func (r *Router) CheckFirewall(statements parser.Statements, s Session, now time.Time) error {
+	for _, statement := range statements {
+		a := Analyze(statement)
+		for _, fr := range r.firewall {
+			if !r.firewallApplies(fr, a, s, now) {
+				continue
+			}
+			if fr.Action == FirewallAllow {
+				break
+			}
+			return fmt.Errorf("%w; %s from user %q (rule %s)", ErrFirewallDenied, a.Tag, s.User, fr)
+		}
+	}
+	return nil
+}
+
+// CheckFirewallUnparsed applies the firewall rules to SQL that could not be
+// parsed. Its schemas, statement type and function calls are unknown, so the
+// firewall fails closed: the SQL is denied by the first deny rule whose user
+// and window conditions hold, unless an earlier allow rule without statement
+// conditions applies.
+func (r *Router) CheckFirewallUnparsed(s Session, now time.Time) error {
+	for _, fr := range r.firewall {
+		if !fr.sessionApplies(s, now) {
+			continue
+		}
+		if fr.Action == FirewallAllow {
+			if len(fr.Schemas) == 0 && len(fr.StatementTypes) == 0 && len(fr.Functions) == 0 {
+				return nil
+			}
+			continue
+		}
+		return fmt.Errorf("%w; SQL that could not be parsed from user %q (rule %s)", ErrFirewallDenied, s.User, fr)
+	}
+	return nil
+}
+
+func (r *Router) firewallApplies(fr FirewallRule, a Analysis, s Session, now time.Time) bool {
+	if !fr.sessionApplies(s, now) {
+		return false
+	}
+	if len(fr.StatementTypes) > 0 && !statementTypeMatches(fr.StatementTypes, a) {
+		return false
+	}
+	if len(fr.Functions) > 0 && !functionMatches(fr.Functions, a.Functions) {
+		return false
+	}
+	if len(fr.Schemas) > 0 && !r.schemaMatches(fr.Schemas, a.Relations, s) {
+		return false
+	}
+	return true
+}
+
+// sessionApplies checks the conditions of a rule that do not depend on the
+// statement (the user and the time).
+func (fr FirewallRule) sessionApplies(s Session, now time.Time) bool {
+	if len(fr.Users) > 0 && !matchesAny(fr.Users, s.User) {
+		return false
+	}
+	if len(fr.Windows) > 0 {
+		within := false
+		for _, tw := range fr.Windows {
+			within = within || tw.Contains(now)
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func statementTypeMatches(statementTypes []string, a Analysis) bool {
+	tag := strings.ToUpper(a.Tag)
+	for _, statementType := range statementTypes {
+		statementType = strings.ToUpper(strings.TrimSpace(statementType))
+		if statementType == tag || (statementType == StatementTypeDDL && a.DDL) {
+			return true
+		}
+		if !strings.Contains(statementType, " ") && strings.HasPrefix(tag, statementType+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func functionMatches(patterns []string, functions []Function) bool {
+	for _, f := range functions {
+		schema := strings.ToLower(f.Schema)
+		if schema == "" {
+			schema = "pg_catalog"
+		}
+		name := strings.ToLower(f.Name)
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			candidate := name
+			if strings.Contains(pattern, ".") {
+				candidate = schema + "." + name
+			}
+			if ok, _ := path.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Router) schemaMatches(schemas []string, relations []Relation, s Session) bool {
+	for _, relation := range relations {
+		resolved, _ := r.Resolve(relation, s)
+		for _, schema := range schemas {
+			if resolved.Schema == schema {
+				return true
+			}
+		}
+	}
+	return false
+}
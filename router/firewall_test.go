@@ -0,0 +1,179 @@
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckFirewall(t *testing.T) {
+	t.Parallel()
+	rules := []Rule{
+		{Schema: "billing", Backend: "billing"},
+		{Schema: "crm", Backend: "crm"},
+	}
+	firewall := []FirewallRule{
+		{Name: "no-destructive", Users: []string{"app*"}, StatementTypes: []string{"DROP", "TRUNCATE"}},
+		{
+			Name:           "migrations",
+			Action:         FirewallAllow,
+			Users:          []string{"migrator"},
+			StatementTypes: []string{StatementTypeDDL},
+			Windows:        []TimeWindow{{Days: []string{"sat"}, Start: "22:00", End: "02:00"}},
+		},
+		{Name: "no-ddl", StatementTypes: []string{StatementTypeDDL}},
+		{Name: "no-file-access", Functions: []string{"pg_read_*", "pg_catalog.pg_ls_dir"}},
+		{Name: "crm-read-only", Users: []string{"app"}, Schemas: []string{"crm"}, StatementTypes: []string{"INSERT", "UPDATE", "DELETE"}},
+	}
+	r, err := New(rules, Options{DefaultBackend: "billing", Firewall: firewall})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE: 2021-06-05 is a Saturday.
+	saturday := time.Date(2021, 6, 5, 23, 0, 0, 0, time.UTC)
+	sundayEarly := time.Date(2021, 6, 6, 1, 0, 0, 0, time.UTC)
+	sundayLate := time.Date(2021, 6, 6, 23, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Name   string
+		SQL    string
+		User   string
+		Now    time.Time
+		Denied bool
+	}{
+		{Name: "select", SQL: "SELECT * FROM crm.contacts", User: "app"},
+		{Name: "drop by app", SQL: "DROP TABLE billing.invoices", User: "app", Denied: true},
+		{Name: "truncate by app", SQL: "TRUNCATE billing.invoices", User: "app_worker", Denied: true},
+		{Name: "ddl in window", SQL: "CREATE TABLE billing.refunds (id INT8)", User: "migrator", Now: saturday},
+		{Name: "ddl in window next day", SQL: "ALTER TABLE billing.invoices ADD COLUMN paid BOOL", User: "migrator", Now: sundayEarly},
+		{Name: "ddl outside window", SQL: "CREATE TABLE billing.refunds (id INT8)", User: "migrator", Now: sundayLate, Denied: true},
+		{Name: "ddl by other user", SQL: "CREATE TABLE billing.refunds (id INT8)", User: "ops", Now: saturday, Denied: true},
+		{Name: "unqualified function", SQL: "SELECT pg_read_file('/etc/passwd')", User: "ops", Denied: true},
+		{Name: "qualified function", SQL: "SELECT pg_catalog.pg_ls_dir('.')", User: "ops", Denied: true},
+		{Name: "other function", SQL: "SELECT pg_ls_waldir()", User: "ops"},
+		{Name: "crm write", SQL: "UPDATE crm.contacts SET name = 'x'", User: "app", Denied: true},
+		{Name: "crm write by search_path", SQL: "DELETE FROM contacts", User: "app", Denied: true},
+		{Name: "billing write", SQL: "UPDATE billing.invoices SET paid = true", User: "app"},
+		{Name: "crm write by other user", SQL: "UPDATE crm.contacts SET name = 'x'", User: "ops"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			statements, err := Parse(tc.SQL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := tc.Now
+			if now.IsZero() {
+				now = sundayLate
+			}
+			s := Session{User: tc.User, SearchPath: []string{"crm"}}
+			err = r.CheckFirewall(statements, s, now)
+			if tc.Denied != errors.Is(err, ErrFirewallDenied) {
+				t.Fatalf("CheckFirewall() = %v, expected denied = %v", err, tc.Denied)
+			}
+		})
+	}
+}
+
+func TestCheckFirewallUnparsed(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Firewall []FirewallRule
+		User     string
+		Denied   bool
+	}{
+		{Name: "no rules"},
+		{
+			Name:     "deny rule",
+			Firewall: []FirewallRule{{StatementTypes: []string{StatementTypeDDL}}},
+			Denied:   true,
+		},
+		{
+			Name:     "deny rule for other users",
+			Firewall: []FirewallRule{{Users: []string{"app"}, Functions: []string{"pg_read_*"}}},
+			User:     "ops",
+		},
+		{
+			Name: "allow rule for the user",
+			Firewall: []FirewallRule{
+				{Action: FirewallAllow, Users: []string{"ops"}},
+				{StatementTypes: []string{StatementTypeDDL}},
+			},
+			User: "ops",
+		},
+		{
+			Name: "allow rule with statement conditions",
+			Firewall: []FirewallRule{
+				{Action: FirewallAllow, Users: []string{"ops"}, StatementTypes: []string{"SELECT"}},
+				{StatementTypes: []string{StatementTypeDDL}},
+			},
+			User:   "ops",
+			Denied: true,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			r, err := New(nil, Options{DefaultBackend: "billing", Firewall: tc.Firewall})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.CheckFirewallUnparsed(Session{User: tc.User}, time.Now())
+			if tc.Denied != errors.Is(err, ErrFirewallDenied) {
+				t.Fatalf("CheckFirewallUnparsed() = %v, expected denied = %v", err, tc.Denied)
+			}
+		})
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name     string
+		Window   TimeWindow
+		Now      time.Time
+		Contains bool
+	}{
+		{
+			Name:     "within",
+			Window:   TimeWindow{Start: "09:00", End: "17:00"},
+			Now:      time.Date(2021, 6, 7, 9, 0, 0, 0, time.UTC),
+			Contains: true,
+		},
+		{
+			Name:   "end is exclusive",
+			Window: TimeWindow{Start: "09:00", End: "17:00"},
+			Now:    time.Date(2021, 6, 7, 17, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:     "time zone",
+			Window:   TimeWindow{Start: "09:00", End: "17:00", Timezone: "America/Chicago"},
+			Now:      time.Date(2021, 6, 7, 20, 0, 0, 0, time.UTC),
+			Contains: true,
+		},
+		{
+			Name:     "overnight, started the previous day",
+			Window:   TimeWindow{Days: []string{"sat"}, Start: "22:00", End: "02:00"},
+			Now:      time.Date(2021, 6, 6, 1, 0, 0, 0, time.UTC),
+			Contains: true,
+		},
+		{
+			Name:   "overnight, other day",
+			Window: TimeWindow{Days: []string{"sat"}, Start: "22:00", End: "02:00"},
+			Now:    time.Date(2021, 6, 6, 23, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			if got := tc.Window.Contains(tc.Now); got != tc.Contains {
+				t.Fatalf("Contains() = %v, expected %v", got, tc.Contains)
+			}
+		})
+	}
+}
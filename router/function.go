@@ -0,0 +1,62 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FunctionRule describes a function (or procedure) that is called without a
+// schema. In JSON it can be given either as the name of a backend or as an
+// object with a backend and whether the function is read-only.
+type FunctionRule struct {
+	// Backend is the backend that defines the function; statements that
+	// call it are routed there. It may be empty for a read-only function
+	// defined on every backend.
+	Backend string `json:"backend,omitempty"`
+	// ReadOnly indicates the function does not write, so statements that
+	// call it can still be sent to a replica.
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (fr *FunctionRule) UnmarshalJSON(data []byte) error {
+	var backend string
+	if json.Unmarshal(data, &backend) == nil {
+		*fr = FunctionRule{Backend: backend}
+		return nil
+	}
+
+	type functionRule FunctionRule
+	parsed := functionRule{}
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return err
+	}
+	*fr = FunctionRule(parsed)
+	return nil
+}
+
+// Validate checks that the rule for a function has a backend, is read-only
+// or both.
+func (fr FunctionRule) Validate(name string) error {
+	if name == "" || (fr.Backend == "" && !fr.ReadOnly) {
+		return fmt.Errorf("%w, function %q must have a name and a backend (or be read-only)", ErrInvalidRule, name)
+	}
+	return nil
+}
+
+// ReadOnly determines if an analyzed statement can safely run on a read
+// replica. This is `Analysis.ReadOnly`, except that calls to functions marked
+// read-only in `Options.Functions` are allowed.
+func (r *Router) ReadOnly(a Analysis) bool {
+	if a.ReadOnly || len(a.UnknownFunctions) == 0 {
+		return a.ReadOnly
+	}
+	for _, f := range a.UnknownFunctions {
+		if !r.functions[strings.ToLower(f.Name)].ReadOnly {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+)
+
+func TestFunctionRuleUnmarshalJSON(t *testing.T) {
+	t.Parallel()
+	data := `{"charge": "billing", "balance": {"backend": "billing", "read_only": true}, "similarity": {"read_only": true}}`
+	functions := map[string]FunctionRule{}
+	err := json.Unmarshal([]byte(data), &functions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]FunctionRule{
+		"charge":     {Backend: "billing"},
+		"balance":    {Backend: "billing", ReadOnly: true},
+		"similarity": {ReadOnly: true},
+	}
+	if !reflect.DeepEqual(functions, expected) {
+		t.Fatalf("functions = %#v, expected %#v", functions, expected)
+	}
+}
+
+func TestRouterReadOnly(t *testing.T) {
+	t.Parallel()
+	o := Options{
+		DefaultBackend: "billing",
+		Functions: map[string]FunctionRule{
+			"charge_customer":  {Backend: "billing"},
+			"customer_balance": {Backend: "billing", ReadOnly: true},
+			"similarity":       {ReadOnly: true},
+		},
+	}
+	r, err := New([]Rule{{Schema: "billing", Backend: "billing"}}, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		SQL      string
+		ReadOnly bool
+	}{
+		{SQL: "SELECT charge_customer(1)", ReadOnly: false},
+		{SQL: "SELECT unknown_function(1)", ReadOnly: false},
+		{SQL: "SELECT customer_balance(1)", ReadOnly: true},
+		{SQL: "SELECT similarity(name, 'x') FROM billing.customers", ReadOnly: true},
+		{SQL: "SELECT customer_balance(1), charge_customer(1)", ReadOnly: false},
+		{SQL: "SELECT customer_balance(id) FROM billing.customers FOR UPDATE", ReadOnly: false},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			statements, err := parser.Parse(tc.SQL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := r.Route(statements, Session{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.ReadOnly != tc.ReadOnly {
+				t.Fatalf("ReadOnly = %v, expected %v", d.ReadOnly, tc.ReadOnly)
+			}
+		})
+	}
+}
+
+func TestFunctionRuleValidate(t *testing.T) {
+	t.Parallel()
+	_, err := New(nil, Options{DefaultBackend: "billing", Functions: map[string]FunctionRule{"f": {}}})
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("New() = %v, expected a function without a backend (that is not read-only) to be invalid", err)
+	}
+}
@@ -0,0 +1,144 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// hintPrefix introduces a routing hint in a SQL comment, e.g.
+	// `/* route: fan_out */`.
+	hintPrefix = "route:"
+
+	// HintFanOut requests that a read-only statement is sent to every
+	// backend and the results merged.
+	HintFanOut = "fan_out"
+	// HintBackendColumn requests that rows from a fan-out include the name
+	// of the backend that returned them (as the first column).
+	HintBackendColumn = "backend_column"
+	// HintBackend sends the statements to a named backend, e.g.
+	// `/* route: backend=billing */`.
+	HintBackend = "backend"
+	// HintSchema sends the statements to the backend that owns a schema,
+	// e.g. `/* route: schema=tenant_42 */`.
+	HintSchema = "schema"
+)
+
+// Hints are routing directives embedded in SQL comments. A hint comment
+// starts with `route:` followed by directives separated by commas or spaces,
+// either flags (`fan_out`) or `key=value` pairs. Only comments before the
+// first token of the SQL are hints.
+type Hints struct {
+	FanOut        bool
+	BackendColumn bool
+	Backend       string
+	Schema        string
+}
+
+// Empty determines if no hints were given.
+func (h Hints) Empty() bool {
+	return h == Hints{}
+}
+
+// String describes the hints as directives, e.g. `backend=billing`.
+func (h Hints) String() string {
+	var directives []string
+	if h.Backend != "" {
+		directives = append(directives, HintBackend+"="+h.Backend)
+	}
+	if h.Schema != "" {
+		directives = append(directives, HintSchema+"="+h.Schema)
+	}
+	if h.FanOut {
+		directives = append(directives, HintFanOut)
+	}
+	if h.BackendColumn {
+		directives = append(directives, HintBackendColumn)
+	}
+	return strings.Join(directives, ", ")
+}
+
+// ParseHints finds the routing hints in the leading comments of a SQL string.
+// A `route:` comment anywhere else (e.g. after a statement or in a later
+// statement) is ignored.
+func ParseHints(sql string) (Hints, error) {
+	h := Hints{}
+	for _, comment := range LeadingComments(sql) {
+		comment = strings.TrimSpace(comment)
+		if !strings.HasPrefix(strings.ToLower(comment), hintPrefix) {
+			continue
+		}
+
+		directives := strings.FieldsFunc(comment[len(hintPrefix):], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		for _, directive := range directives {
+			key, value := directive, ""
+			if eq := strings.Index(directive, "="); eq != -1 {
+				key, value = directive[:eq], directive[eq+1:]
+			}
+			key = strings.ToLower(key)
+
+			switch key {
+			case HintFanOut, HintBackendColumn:
+				if value != "" {
+					return h, fmt.Errorf("%w; directive %q does not take a value", ErrInvalidHint, key)
+				}
+				h.FanOut = h.FanOut || key == HintFanOut
+				h.BackendColumn = h.BackendColumn || key == HintBackendColumn
+			case HintBackend, HintSchema:
+				if value == "" {
+					return h, fmt.Errorf("%w; directive %q requires a value", ErrInvalidHint, key)
+				}
+				if key == HintBackend {
+					h.Backend = value
+				} else {
+					h.Schema = value
+				}
+			default:
+				return h, fmt.Errorf("%w; unknown directive %q", ErrInvalidHint, key)
+			}
+		}
+	}
+
+	if h.Backend != "" && h.Schema != "" {
+		return h, fmt.Errorf("%w; only one of %q or %q may be given", ErrInvalidHint, HintBackend, HintSchema)
+	}
+	if h.FanOut && (h.Backend != "" || h.Schema != "") {
+		return h, fmt.Errorf("%w; %q cannot be combined with %q or %q", ErrInvalidHint, HintFanOut, HintBackend, HintSchema)
+	}
+	return h, nil
+}
+
+// Comments returns the contents of the comments (`-- ...` and `/* ... */`) in
+// a SQL string. String literals, quoted identifiers and dollar quoted strings
+// are skipped.
+func Comments(sql string) []string {
+	var comments []string
+	scanSQL(sql, func(t token) {
+		if t.Kind == tokenComment {
+			comments = append(comments, t.Comment(sql))
+		}
+	})
+	return comments
+}
+
+// LeadingComments returns the contents of the comments before the first token
+// of a SQL string (see `Comments()`).
+func LeadingComments(sql string) []string {
+	var comments []string
+	leading := true
+	last := 0
+	scanSQL(sql, func(t token) {
+		// NOTE: Numbers and operators are not reported as tokens, so a
+		//       comment only leads if there is nothing but whitespace before
+		//       it.
+		if leading && t.Kind == tokenComment && strings.TrimSpace(sql[last:t.Start]) == "" {
+			comments = append(comments, t.Comment(sql))
+			last = t.End
+			return
+		}
+		leading = false
+	})
+	return comments
+}
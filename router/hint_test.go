@@ -0,0 +1,46 @@
+package router
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseHints(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL     string
+		Hints   Hints
+		Invalid bool
+	}{
+		{SQL: "/* route: backend=billing */ SELECT 1", Hints: Hints{Backend: "billing"}},
+		{SQL: "-- route: schema=tenant_42\nCALL refresh_rollups()", Hints: Hints{Schema: "tenant_42"}},
+		{SQL: "  /* app */ /* ROUTE: fan_out backend_column */\nSELECT 1", Hints: Hints{FanOut: true, BackendColumn: true}},
+		{SQL: "SELECT 1 /* route: backend=billing */"},
+		{SQL: "SELECT 1; /* route: backend=billing */ SELECT 2"},
+		{SQL: "1 /* route: backend=billing */"},
+		{SQL: "SELECT '/* route: backend=billing */'"},
+		{SQL: "SELECT 1 /* route: nonsense */"},
+		{SQL: "/* route: nonsense */ SELECT 1", Invalid: true},
+		{SQL: "/* route: backend */ SELECT 1", Invalid: true},
+		{SQL: "/* route: fan_out, schema=crm */ SELECT 1", Invalid: true},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			h, err := ParseHints(tc.SQL)
+			if tc.Invalid {
+				if !errors.Is(err, ErrInvalidHint) {
+					t.Fatalf("ParseHints() error = %v, expected %v", err, ErrInvalidHint)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != tc.Hints {
+				t.Fatalf("ParseHints() = %#v, expected %#v", h, tc.Hints)
+			}
+		})
+	}
+}
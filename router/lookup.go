@@ -0,0 +1,99 @@
+package router
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Lookup maps a key (e.g. a tenant ID captured from a schema name) to the
+// backend that owns it.
+type Lookup interface {
+	Backend(key string) (string, bool)
+}
+
+// Table is an in-memory `Lookup` whose contents can be replaced while it is
+// in use (e.g. when it is periodically reloaded).
+type Table struct {
+	mutex   sync.RWMutex
+	entries map[string]string
+}
+
+// NewTable creates a lookup table.
+func NewTable(entries map[string]string) *Table {
+	return &Table{entries: entries}
+}
+
+// Backend implements `Lookup`.
+func (t *Table) Backend(key string) (string, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	backend, ok := t.entries[key]
+	return backend, ok
+}
+
+// Replace swaps the contents of the table.
+func (t *Table) Replace(entries map[string]string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.entries = entries
+}
+
+// Backends returns the distinct backends in the table, sorted.
+func (t *Table) Backends() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	seen := map[string]bool{}
+	var backends []string
+	for _, backend := range t.entries {
+		if !seen[backend] {
+			seen[backend] = true
+			backends = append(backends, backend)
+		}
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+// Len returns the number of keys in the table.
+func (t *Table) Len() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.entries)
+}
+
+// ReadCSV reads lookup table entries from CSV with two columns: the key and
+// the backend. Lines starting with `#` are ignored, as is an optional header
+// row `key,backend`.
+func ReadCSV(r io.Reader) (map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+
+	entries := map[string]string{}
+	first := true
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key, backend := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if first && key == "key" && backend == "backend" {
+			first = false
+			continue
+		}
+		first = false
+		if key == "" || backend == "" {
+			return nil, fmt.Errorf("lookup entry %q has an empty key or backend", strings.Join(record, ","))
+		}
+		entries[key] = backend
+	}
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"sync/atomic"
+)
+
+var (
+	// cutOverSyntax matches the (proxy) commands that flip the reads of a
+	// migrating schema, `CUTOVER schema` and `REVERT CUTOVER schema`.
+	cutOverSyntax = regexp.MustCompile(`(?is)^\s*(REVERT\s+)?CUTOVER\s+(` + identifierSyntax + `)\s*;?\s*$`)
+)
+
+// Migration is a schema being moved between backends (see
+// `Rule.MigrateTo`). Writes are applied to both backends; reads are served
+// by `From` until the migration is cut over and by `To` afterwards.
+type Migration struct {
+	Schema string
+	From   string
+	To     string
+	// cutOver is 1 once reads have been flipped to `To`; it is changed while
+	// statements are being routed.
+	cutOver int32
+}
+
+// CutOver indicates reads have been flipped to the new backend.
+func (m *Migration) CutOver() bool {
+	return atomic.LoadInt32(&m.cutOver) == 1
+}
+
+// Owner is the backend that currently serves the schema; the other backend
+// receives a copy of every write.
+func (m *Migration) Owner() string {
+	if m.CutOver() {
+		return m.To
+	}
+	return m.From
+}
+
+// Secondary is the backend that receives a copy of every write.
+func (m *Migration) Secondary() string {
+	if m.CutOver() {
+		return m.From
+	}
+	return m.To
+}
+
+// Migrations returns the schemas being migrated, sorted by schema.
+func (r *Router) Migrations() []*Migration {
+	migrations := make([]*Migration, 0, len(r.migrations))
+	for _, m := range r.migrations {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Schema < migrations[j].Schema
+	})
+	return migrations
+}
+
+// CutOver flips the reads of a migrating schema to its new backend (or, if
+// `cutOver` is false, back to its old backend).
+func (r *Router) CutOver(schema string, cutOver bool) error {
+	m, ok := r.migrations[schema]
+	if !ok {
+		return fmt.Errorf("%w; %q", ErrNotMigrating, schema)
+	}
+	value := int32(0)
+	if cutOver {
+		value = 1
+	}
+	atomic.StoreInt32(&m.cutOver, value)
+	return nil
+}
+
+// dualWrite determines the backend that receives a copy of writes to
+// relations owned by `backend`, i.e. the secondary backend of a migration.
+// If the relations are in migrations with different secondary backends, the
+// writes are not copied.
+func (r *Router) dualWrite(relations []Relation, backend string) string {
+	secondary := ""
+	for _, relation := range relations {
+		m, ok := r.migrations[relation.Schema]
+		if !ok || m.Owner() != backend {
+			continue
+		}
+		if secondary != "" && m.Secondary() != secondary {
+			return ""
+		}
+		secondary = m.Secondary()
+	}
+	return secondary
+}
+
+// ParseCutOver parses a `CUTOVER schema` or `REVERT CUTOVER schema` command.
+// The second result is false for `REVERT CUTOVER` and the third indicates
+// the SQL is a cut over command.
+func ParseCutOver(sql string) (string, bool, bool) {
+	match := cutOverSyntax.FindStringSubmatch(sql)
+	if match == nil {
+		return "", false, false
+	}
+	return identifier(match[2]), match[1] == "", true
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+// Normalize formats a parsed statement in a canonical form (e.g. keywords in
+// upper case, consistent spacing and parentheses). If `hideConstants` is
+// set, every literal is replaced with a placeholder (`_`) and lists of
+// literals are collapsed, e.g. `IN (_, _, __more1__)`.
+func Normalize(statement parser.Statement, hideConstants bool) string {
+	if statement.AST == nil {
+		return strings.TrimSpace(statement.SQL)
+	}
+	flags := tree.FmtSimple
+	if hideConstants {
+		flags = tree.FmtHideConstants
+	}
+	return tree.AsStringWithFlags(statement.AST, flags)
+}
+
+// Fingerprint returns a stable identifier for normalized SQL with constants
+// hidden (see `Normalize()` and `HideLiterals()`), so statements that only
+// differ in their literals or formatting have the same fingerprint. It is
+// the 64-bit FNV-1a hash of the SQL, in hexadecimal.
+func Fingerprint(normalized string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(normalized))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// HideLiterals replaces the string and numeric literals in SQL that could
+// not be parsed with a placeholder (`_`). Comments, identifiers and
+// parameters (e.g. `$1`) are kept.
+func HideLiterals(sql string) string {
+	var b strings.Builder
+	last := 0
+	scanSQL(sql, func(t token) {
+		b.WriteString(hideNumbers(sql[last:t.Start]))
+		if t.Kind == tokenString {
+			b.WriteString("_")
+		} else {
+			b.WriteString(t.Text(sql))
+		}
+		last = t.End
+	})
+	b.WriteString(hideNumbers(sql[last:]))
+	return b.String()
+}
+
+// hideNumbers replaces the numbers in a span of SQL without identifiers,
+// strings or comments (e.g. `= 42 AND`), other than parameters such as `$1`.
+func hideNumbers(span string) string {
+	var b strings.Builder
+	for i := 0; i < len(span); i++ {
+		c := span[i]
+		number := (c >= '0' && c <= '9') || (c == '.' && i+1 < len(span) && span[i+1] >= '0' && span[i+1] <= '9')
+		if !number {
+			b.WriteByte(c)
+			if c == '$' {
+				for i+1 < len(span) && span[i+1] >= '0' && span[i+1] <= '9' {
+					i++
+					b.WriteByte(span[i])
+				}
+			}
+			continue
+		}
+		for i+1 < len(span) && (span[i+1] == '_' || span[i+1] == '.' || isAlphanumeric(span[i+1])) {
+			i++
+		}
+		b.WriteString("_")
+	}
+	return b.String()
+}
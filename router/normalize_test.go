@@ -0,0 +1,65 @@
+package router
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestHideLiterals(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL    string
+		Hidden string
+	}{
+		{SQL: "LOCK TABLE crm.contacts", Hidden: "LOCK TABLE crm.contacts"},
+		{SQL: "SELECT * FROM t WHERE a = 'x' AND b = 42", Hidden: "SELECT * FROM t WHERE a = _ AND b = _"},
+		{SQL: "SELECT * FROM t WHERE a = $1 AND b = 1.5", Hidden: "SELECT * FROM t WHERE a = $1 AND b = _"},
+		{SQL: "SELECT E'it\\'s', $$body$$", Hidden: "SELECT _, _"},
+		{SQL: `SELECT "col1" FROM t2 -- 'comment' 3`, Hidden: `SELECT "col1" FROM t2 -- 'comment' 3`},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			if hidden := HideLiterals(tc.SQL); hidden != tc.Hidden {
+				t.Fatalf("HideLiterals() = %q, expected %q", hidden, tc.Hidden)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+	fingerprint := func(sql string) string {
+		statements, err := Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Fingerprint(Normalize(statements[0], true))
+	}
+
+	a := fingerprint("SELECT * FROM billing.invoices WHERE id = 1")
+	if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(a) {
+		t.Fatalf("Fingerprint() = %q, expected 16 hexadecimal digits", a)
+	}
+	same := []string{
+		"select *   from billing.invoices where id = 2",
+		"SELECT * FROM billing.invoices WHERE id = 'x'",
+		"SELECT *\nFROM billing.invoices\nWHERE id = 3",
+	}
+	for _, sql := range same {
+		if b := fingerprint(sql); b != a {
+			t.Errorf("Fingerprint(%q) = %q, expected %q", sql, b, a)
+		}
+	}
+	different := []string{
+		"SELECT * FROM billing.invoices WHERE id = $1",
+		"SELECT * FROM crm.invoices WHERE id = 1",
+		"SELECT id FROM billing.invoices WHERE id = 1",
+	}
+	for _, sql := range different {
+		if b := fingerprint(sql); b == a {
+			t.Errorf("Fingerprint(%q) = %q, expected a different fingerprint", sql, b)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package router
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/lex"
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+const (
+	identifierSyntax = `(?:"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`
+	qualifiedSyntax  = `(` + identifierSyntax + `)\s*\.\s*(` + identifierSyntax + `)`
+)
+
+var (
+	// operatorSyntax matches the `OPERATOR(pg_catalog.~)` syntax used by
+	// `psql` for schema qualified operators, which the parser does not
+	// support.
+	operatorSyntax = regexp.MustCompile(`(?i)\bOPERATOR\s*\(\s*(?:pg_catalog\s*\.\s*)?([~!@#%^&|` + "`" + `?*+\-/<>=]+)\s*\)`)
+	// collateSyntax matches a schema qualified collation such as
+	// `COLLATE pg_catalog.default`, which the parser does not support.
+	collateSyntax = regexp.MustCompile(`(?i)\bCOLLATE\s+pg_catalog\s*\.\s*("?[A-Za-z0-9_]+"?)`)
+	// callSyntax matches a `CALL` statement, which the parser does not
+	// support.
+	callSyntax = regexp.MustCompile(`(?is)^\s*CALL\s+(.+?)\s*$`)
+	// typeSyntax matches the places a schema qualified (i.e. user defined)
+	// type can appear: casts (`::billing.money`, `CAST(x AS billing.money)`),
+	// `ALTER ... TYPE billing.money` and column definitions
+	// (`(amount billing.money, ...`). The parser rejects types it does not
+	// know.
+	typeSyntax = regexp.MustCompile(
+		`(?i)(::\s*|\bAS\s+|\bTYPE\s+|[(,]\s*(` + identifierSyntax + `)\s+)` + qualifiedSyntax,
+	)
+)
+
+// Call is a `CALL` statement; the parser does not support procedures.
+type Call struct {
+	Procedure *tree.FuncExpr
+}
+
+// Format implements `tree.NodeFormatter`.
+func (c *Call) Format(ctx *tree.FmtCtx) {
+	ctx.WriteString("CALL ")
+	ctx.FormatNode(c.Procedure)
+}
+
+// String implements `tree.Statement`.
+func (c *Call) String() string {
+	return tree.AsString(c)
+}
+
+// StatementType implements `tree.Statement`.
+func (*Call) StatementType() tree.StatementType {
+	return tree.Rows
+}
+
+// StatementTag implements `tree.Statement`.
+func (*Call) StatementTag() string {
+	return "CALL"
+}
+
+// TypedStatement is a statement that references user defined types. The
+// parser does not know these types, so they are replaced (by `text`) before
+// parsing and recorded here.
+type TypedStatement struct {
+	tree.Statement
+	Types []Relation
+}
+
+// Parse parses SQL into statements. If the SQL cannot be parsed as is, each
+// statement is repaired and parsed again:
+//
+//   - syntax that only affects how operators and collations are resolved (e.g.
+//     `OPERATOR(pg_catalog.~)` as generated by `psql`) is simplified
+//   - `CALL` statements are parsed as a `Call`
+//   - `ALTER SCHEMA` and `DROP SCHEMA` are parsed as a `SchemaStatement`
+//   - schema qualified types are replaced and recorded in a `TypedStatement`
+//
+// The statements are only used to make routing decisions, the original SQL is
+// what gets sent to the backend.
+func Parse(sql string) (parser.Statements, error) {
+	statements, err := parser.Parse(sql)
+	if err == nil {
+		return statements, nil
+	}
+
+	var repaired parser.Statements
+	for _, part := range SplitStatements(sql) {
+		statement, ok := repair(part)
+		if !ok {
+			return nil, err
+		}
+		repaired = append(repaired, statement)
+	}
+	return repaired, nil
+}
+
+// repair parses a single statement that the parser rejected, after
+// simplifying or replacing the unsupported syntax.
+func repair(sql string) (parser.Statement, bool) {
+	statement, err := parser.ParseOne(sql)
+	if err == nil {
+		return statement, true
+	}
+	if ss, ok := parseSchemaStatement(sql); ok {
+		return parser.Statement{AST: ss, SQL: strings.TrimSpace(sql)}, true
+	}
+
+	simplified := operatorSyntax.ReplaceAllString(sql, " $1 ")
+	simplified = collateSyntax.ReplaceAllStringFunc(simplified, func(match string) string {
+		name := collateSyntax.FindStringSubmatch(match)[1]
+		return `COLLATE "` + strings.Trim(name, `"`) + `"`
+	})
+
+	var types []Relation
+	simplified = typeSyntax.ReplaceAllStringFunc(simplified, func(match string) string {
+		groups := typeSyntax.FindStringSubmatch(match)
+		// NOTE: A reserved keyword such as `(SELECT billing.total(...)` is
+		//       not a column definition.
+		if lex.KeywordsCategories[strings.ToLower(groups[2])] == "R" {
+			return match
+		}
+		types = append(types, Relation{
+			Schema:   identifier(groups[3]),
+			Name:     identifier(groups[4]),
+			Explicit: true,
+			Kind:     KindType,
+		})
+		return groups[1] + "text"
+	})
+
+	call := false
+	if match := callSyntax.FindStringSubmatch(simplified); match != nil {
+		call = true
+		simplified = "SELECT " + match[1]
+	}
+
+	statement, err = parser.ParseOne(simplified)
+	if err != nil {
+		return parser.Statement{}, false
+	}
+	statement.SQL = strings.TrimSpace(sql)
+
+	if call {
+		procedure, ok := selectedFunction(statement.AST)
+		if !ok {
+			return parser.Statement{}, false
+		}
+		statement.AST = &Call{Procedure: procedure}
+	}
+	if len(types) > 0 {
+		statement.AST = &TypedStatement{Statement: statement.AST, Types: types}
+	}
+	return statement, true
+}
+
+// selectedFunction returns the function call in `SELECT f(...)`.
+func selectedFunction(ast tree.Statement) (*tree.FuncExpr, bool) {
+	s, ok := ast.(*tree.Select)
+	if !ok {
+		return nil, false
+	}
+	sc, ok := s.Select.(*tree.SelectClause)
+	if !ok || len(sc.Exprs) != 1 || len(sc.From.Tables) > 0 {
+		return nil, false
+	}
+	f, ok := sc.Exprs[0].Expr.(*tree.FuncExpr)
+	return f, ok
+}
+
+// identifier normalizes an identifier as PostgreSQL does: unquoted names are
+// folded to lower case.
+func identifier(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,240 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/lex"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+// Rewrite renames schemas (see `Rule.Rename`) in SQL sent by a client. The
+// SQL is returned unchanged if it does not reference a renamed schema.
+//
+// The rewritten SQL is not produced by formatting the renamed syntax tree:
+// the parser formats statements in its own dialect (e.g. `int` becomes
+// `INT8` and `text` becomes `STRING`), which is not valid PostgreSQL.
+// Instead the schema names are renamed in the syntax tree and in the
+// identifiers of the original SQL, and the rewritten SQL is only used if
+// parsing it produces the same syntax tree.
+func (r *Router) Rewrite(sql string) (string, error) {
+	if len(r.renames) == 0 || !r.mentionsRenamed(sql) {
+		return sql, nil
+	}
+
+	expected, err := Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("%w; %v", ErrRewrite, err)
+	}
+	renamed := 0
+	for _, statement := range expected {
+		renamed += r.renameSchemas(statement.AST)
+	}
+	if renamed == 0 {
+		return sql, nil
+	}
+
+	rewritten := r.renameIdentifiers(sql)
+	actual, err := Parse(rewritten)
+	if err != nil {
+		return "", fmt.Errorf("%w; %v", ErrRewrite, err)
+	}
+	if len(actual) != len(expected) {
+		return "", fmt.Errorf("%w; renaming changed the number of statements", ErrRewrite)
+	}
+	for i := range expected {
+		want := tree.AsString(expected[i].AST)
+		got := tree.AsString(actual[i].AST)
+		if want != got {
+			err = fmt.Errorf("%w; a renamed schema is also used as another name in %q", ErrRewrite, expected[i].SQL)
+			return "", err
+		}
+	}
+	return rewritten, nil
+}
+
+// mentionsRenamed determines if any identifier (or string, as in
+// `SET search_path = 'legacy'`) in the SQL is a renamed schema.
+func (r *Router) mentionsRenamed(sql string) bool {
+	found := false
+	scanSQL(sql, func(t token) {
+		name := ""
+		switch t.Kind {
+		case tokenIdentifier, tokenQuotedIdentifier:
+			name = identifier(t.Text(sql))
+		case tokenString:
+			name = stringValue(t.Text(sql))
+		}
+		if _, ok := r.renames[name]; ok {
+			found = true
+		}
+	})
+	return found
+}
+
+// renameSchemas renames schemas in a syntax tree and returns the number of
+// names that were changed. Relation names inside string literals (e.g.
+// `nextval('legacy.seq')`) are not renamed.
+func (r *Router) renameSchemas(ast tree.Statement) int {
+	renamed := 0
+	rename := func(name *string) {
+		if to, ok := r.renames[*name]; ok {
+			*name = to
+			renamed++
+		}
+	}
+
+	functions := map[*tree.UnresolvedName]bool{}
+	walk(ast, func(node interface{}) bool {
+		switch n := node.(type) {
+		case *tree.TableName:
+			if n.ExplicitSchema {
+				schema := string(n.SchemaName)
+				rename(&schema)
+				n.SchemaName = tree.Name(schema)
+			}
+		case *tree.UnresolvedObjectName:
+			if n.NumParts > 1 {
+				rename(&n.Parts[1])
+			}
+		case *tree.FuncExpr:
+			if ref, ok := n.Func.FunctionReference.(*tree.UnresolvedName); ok {
+				functions[ref] = true
+				if ref.NumParts > 1 {
+					rename(&ref.Parts[1])
+				}
+			}
+		case *tree.UnresolvedName:
+			// NOTE: A column reference such as `legacy.invoices.id` has the
+			//       schema as its third part.
+			if !functions[n] && n.NumParts > 2 {
+				rename(&n.Parts[2])
+			}
+		case *tree.CreateSchema:
+			rename(&n.Schema)
+		case *SchemaStatement:
+			for i := range n.Schemas {
+				rename(&n.Schemas[i])
+			}
+		case *TypedStatement:
+			for i := range n.Types {
+				rename(&n.Types[i].Schema)
+			}
+		case *tree.SetVar:
+			if strings.ToLower(n.Name) != "search_path" {
+				return true
+			}
+			for i, value := range n.Values {
+				switch v := value.(type) {
+				case *tree.UnresolvedName:
+					rename(&v.Parts[0])
+				case *tree.StrVal:
+					schema := v.RawString()
+					rename(&schema)
+					n.Values[i] = tree.NewStrVal(schema)
+				}
+			}
+			return false
+		}
+		return true
+	})
+	return renamed
+}
+
+// renameIdentifiers renames schemas in the identifiers of SQL: every
+// identifier followed by `.` and, in statements that name schemas without
+// qualifying anything (`CREATE SCHEMA`, `ALTER SCHEMA`, `DROP SCHEMA` and
+// `SET search_path`), every identifier (and, for `SET`, every string).
+func (r *Router) renameIdentifiers(sql string) string {
+	var tokens []token
+	scanSQL(sql, func(t token) {
+		tokens = append(tokens, t)
+	})
+
+	var b strings.Builder
+	last := 0
+	schemaStatement := false
+	setSearchPath := false
+	for i, t := range tokens {
+		if i == 0 || tokens[i-1].Kind == tokenSemicolon {
+			schemaStatement, setSearchPath = statementNamesSchemas(sql, tokens[i:])
+		}
+
+		to := ""
+		switch t.Kind {
+		case tokenIdentifier, tokenQuotedIdentifier:
+			renamed, ok := r.renames[identifier(t.Text(sql))]
+			if ok && (schemaStatement || setSearchPath || followedByDot(sql, t.End)) {
+				to = quoteIdentifier(renamed)
+			}
+		case tokenString:
+			if !setSearchPath {
+				continue
+			}
+			if renamed, ok := r.renames[stringValue(t.Text(sql))]; ok {
+				to = lex.EscapeSQLString(renamed)
+			}
+		}
+		if to == "" {
+			continue
+		}
+		b.WriteString(sql[last:t.Start])
+		b.WriteString(to)
+		last = t.End
+	}
+	b.WriteString(sql[last:])
+	return b.String()
+}
+
+// statementNamesSchemas inspects the leading keywords of a statement to
+// determine if it is `CREATE SCHEMA`, `ALTER SCHEMA` or `DROP SCHEMA` (the
+// first result) or sets the `search_path` (the second result).
+func statementNamesSchemas(sql string, tokens []token) (bool, bool) {
+	var keywords []string
+	for _, t := range tokens {
+		if t.Kind == tokenSemicolon || len(keywords) == 3 {
+			break
+		}
+		if t.Kind == tokenIdentifier {
+			keywords = append(keywords, strings.ToLower(t.Text(sql)))
+		}
+	}
+	if len(keywords) < 2 {
+		return false, false
+	}
+
+	switch keywords[0] {
+	case "create", "alter", "drop":
+		return keywords[1] == "schema", false
+	case "set":
+		for _, keyword := range keywords[1:] {
+			if keyword == "search_path" {
+				return false, true
+			}
+		}
+	}
+	return false, false
+}
+
+// stringValue returns the value of a standard string literal such as
+// `'legacy'`; other strings (e.g. dollar quoted) return an empty value.
+func stringValue(text string) string {
+	if len(text) < 2 || text[0] != '\'' || text[len(text)-1] != '\'' {
+		return ""
+	}
+	return strings.ReplaceAll(text[1:len(text)-1], "''", "'")
+}
+
+func followedByDot(sql string, i int) bool {
+	rest := strings.TrimLeft(sql[i:], " \t\r\n")
+	return strings.HasPrefix(rest, ".")
+}
+
+// quoteIdentifier quotes an identifier if required, e.g. if it contains
+// upper case letters.
+func quoteIdentifier(name string) string {
+	var b bytes.Buffer
+	lex.EncodeRestrictedSQLIdent(&b, name, lex.EncNoFlags)
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	t.Parallel()
+	rules := []Rule{
+		{Schema: "legacy_billing", Backend: "billing", Rename: "billing"},
+		{Schema: "crm", Backend: "crm"},
+	}
+	r, err := New(rules, Options{DefaultBackend: "billing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		SQL       string
+		Rewritten string
+		Err       error
+	}{
+		{
+			SQL:       "SELECT 1",
+			Rewritten: "SELECT 1",
+		},
+		{
+			SQL:       "SELECT * FROM crm.contacts",
+			Rewritten: "SELECT * FROM crm.contacts",
+		},
+		{
+			SQL:       "SELECT * FROM legacy_billing.invoices WHERE id = $1",
+			Rewritten: "SELECT * FROM billing.invoices WHERE id = $1",
+		},
+		{
+			SQL:       `SELECT * FROM "legacy_billing".invoices`,
+			Rewritten: `SELECT * FROM billing.invoices`,
+		},
+		{
+			SQL:       "SELECT legacy_billing.charge(1)",
+			Rewritten: "SELECT billing.charge(1)",
+		},
+		{
+			SQL:       "SELECT 'legacy_billing.invoices' FROM crm.contacts",
+			Rewritten: "SELECT 'legacy_billing.invoices' FROM crm.contacts",
+		},
+		{
+			SQL:       "SELECT legacy_billing.id FROM crm.contacts AS legacy_billing",
+			Rewritten: "SELECT legacy_billing.id FROM crm.contacts AS legacy_billing",
+		},
+		{
+			SQL: "SELECT legacy_billing.id FROM legacy_billing.invoices AS legacy_billing",
+			Err: ErrRewrite,
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			rewritten, err := r.Rewrite(tc.SQL)
+			if tc.Err != nil {
+				if !errors.Is(err, tc.Err) {
+					t.Fatalf("Rewrite() error = %v, expected %v", err, tc.Err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rewrite() failed; %v", err)
+			}
+			if rewritten != tc.Rewritten {
+				t.Fatalf("Rewrite() = %q, expected %q", rewritten, tc.Rewritten)
+			}
+		})
+	}
+}
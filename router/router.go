@@ -0,0 +1,573 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+)
+
+var (
+	// defaultSearchPath is the PostgreSQL default for `search_path`.
+	defaultSearchPath = []string{"$user", "public"}
+	// systemSchemas exist on every PostgreSQL server so they are never owned
+	// by a single backend.
+	systemSchemas = map[string]bool{
+		"pg_catalog":         true,
+		"information_schema": true,
+	}
+)
+
+// Session is the connection level context needed to resolve names that are
+// not schema qualified.
+type Session struct {
+	User       string
+	Database   string
+	SearchPath []string
+	// Backend owns relations in schemas that do not match any rule. If
+	// empty, the router's default backend is used.
+	Backend string
+}
+
+// Decision is the outcome of routing one or more statements.
+type Decision struct {
+	// Backend is the name of the backend that owns every relation referenced
+	// by the statements. This will be empty if the statements did not
+	// reference any routable relation (e.g. `SELECT 1` or `SET ...`).
+	Backend string
+	// ReadOnly indicates every statement can safely run on a read replica.
+	ReadOnly bool
+	// Catalog indicates the statements only reference relations in system
+	// schemas (see `CatalogRule`).
+	Catalog bool
+	// FanOut indicates the statements should be sent to every backend and
+	// the results merged.
+	FanOut bool
+	// Mirror is the shadow backend that should receive a copy of the
+	// statements (see `Rule.Mirror`), if any.
+	Mirror string
+	// DualWrite is the backend that should also apply the statements because
+	// they write to a schema being migrated (see `Rule.MigrateTo`), if any.
+	DualWrite string
+	// Relations are the referenced relations with schemas resolved against
+	// the session `search_path`.
+	Relations  []Relation
+	Statements []Analysis
+}
+
+// Options configure a router.
+type Options struct {
+	// DefaultBackend owns relations in schemas that do not match any rule.
+	DefaultBackend string
+	// Backends are the names of the known backends. If set, a schema that
+	// resolves to any other backend (e.g. via a template or a lookup table)
+	// is an error when routing.
+	Backends []string
+	// Lookups are the lookup tables referenced by rules, by name.
+	Lookups map[string]Lookup
+	// Catalog determines how queries that only reference system catalogs
+	// are routed.
+	Catalog CatalogRule
+	// Connections assign a backend to a client connection based on its
+	// startup parameters; the first matching rule applies.
+	Connections []ConnectionRule
+	// Functions map functions (and procedures) that are called without a
+	// schema to the backend that defines them and whether they are
+	// read-only.
+	Functions map[string]FunctionRule
+	// DDL determines how DDL that creates schemas is routed.
+	DDL DDLRule
+	// Firewall rules allow or deny statements (see `CheckFirewall()`); the
+	// first rule that applies decides.
+	Firewall []FirewallRule
+}
+
+// Router determines which backend owns the relations referenced by a set of
+// statements.
+type Router struct {
+	schemas        map[string]string
+	renames        map[string]string
+	mirrors        map[string]string
+	migrations     map[string]*Migration
+	patterns       []patternRule
+	lookups        map[string]Lookup
+	connections    []ConnectionRule
+	functions      map[string]FunctionRule
+	catalog        CatalogRule
+	ddl            DDLRule
+	firewall       []FirewallRule
+	known          map[string]bool
+	defaultBackend string
+}
+
+// New creates a router from a list of rules. Rules for a single schema take
+// precedence; otherwise pattern rules are tried in order. Relations in
+// schemas that do not match any rule are routed to `o.DefaultBackend`.
+func New(rules []Rule, o Options) (*Router, error) {
+	r := &Router{
+		schemas:        map[string]string{},
+		renames:        map[string]string{},
+		mirrors:        map[string]string{},
+		migrations:     map[string]*Migration{},
+		lookups:        o.Lookups,
+		connections:    o.Connections,
+		functions:      map[string]FunctionRule{},
+		catalog:        o.Catalog,
+		ddl:            o.DDL,
+		defaultBackend: o.DefaultBackend,
+	}
+	if len(o.Backends) > 0 {
+		r.known = map[string]bool{}
+		for _, backend := range o.Backends {
+			r.known[backend] = true
+		}
+	}
+
+	for _, rule := range rules {
+		err := rule.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if rule.Lookup != "" && r.lookups[rule.Lookup] == nil {
+			return nil, fmt.Errorf("%w, rule %q uses unknown lookup %q", ErrInvalidRule, rule.Name(), rule.Lookup)
+		}
+		if rule.Schema == "" {
+			re, err := rule.compile()
+			if err != nil {
+				return nil, err
+			}
+			r.patterns = append(r.patterns, patternRule{Rule: rule, Regexp: re})
+			continue
+		}
+		if existing, ok := r.schemas[rule.Schema]; ok && existing != rule.Backend {
+			err = fmt.Errorf(
+				"%w, schema %q is mapped to both %q and %q",
+				ErrInvalidRule, rule.Schema, existing, rule.Backend,
+			)
+			return nil, err
+		}
+		r.schemas[rule.Schema] = rule.Backend
+		if rule.Rename != "" {
+			r.renames[rule.Schema] = rule.Rename
+		}
+		if rule.Mirror != "" {
+			r.mirrors[rule.Schema] = rule.Mirror
+		}
+		if rule.MigrateTo != "" {
+			r.migrations[rule.Schema] = &Migration{Schema: rule.Schema, From: rule.Backend, To: rule.MigrateTo}
+		}
+	}
+
+	for name, fr := range o.Functions {
+		err := fr.Validate(name)
+		if err != nil {
+			return nil, err
+		}
+		r.functions[strings.ToLower(name)] = fr
+	}
+
+	err := o.Catalog.Validate()
+	if err != nil {
+		return nil, err
+	}
+	err = o.DDL.Validate()
+	if err != nil {
+		return nil, err
+	}
+	for _, cr := range o.Connections {
+		err := cr.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, fr := range o.Firewall {
+		err := fr.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if fr.Name == "" {
+			fr.Name = "#" + strconv.Itoa(i+1)
+		}
+		r.firewall = append(r.firewall, fr)
+	}
+
+	return r, nil
+}
+
+// Route analyzes the statements and determines the single backend that owns
+// every referenced relation.
+func (r *Router) Route(statements parser.Statements, s Session) (Decision, error) {
+	d := Decision{ReadOnly: len(statements) > 0}
+	owners := map[string][]Relation{}
+	seen := map[Relation]bool{}
+	ddl := false
+	for _, statement := range statements {
+		a := Analyze(statement)
+		a.ReadOnly = r.ReadOnly(a)
+		d.Statements = append(d.Statements, a)
+		d.ReadOnly = d.ReadOnly && a.ReadOnly
+		ddl = ddl || a.DDL
+		err := r.checkCreatedSchemas(a)
+		if err != nil {
+			return d, err
+		}
+
+		relations := a.Relations
+		for _, f := range a.Functions {
+			if f.Schema == "" && r.functions[strings.ToLower(f.Name)].Backend != "" {
+				relations = append(relations, Relation{Name: f.Name, Kind: KindFunction})
+			}
+		}
+		err = r.own(&d, owners, seen, relations, s)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	if len(owners) > 1 {
+		return d, &CrossBackendError{Owners: owners, DDL: ddl}
+	}
+	r.decideOwner(&d, owners)
+	d.Catalog = len(owners) == 0 && len(d.Relations) > 0
+	if d.Catalog {
+		d.Backend, d.FanOut = r.routeCatalog(d.Statements, s)
+	}
+
+	return d, nil
+}
+
+// RouteScanned routes SQL that could not be parsed by the qualified names
+// found in it (see `ScanRelations()`). Only names in a schema matched by a
+// rule are considered, since `alias.column` looks just like `schema.table`;
+// the SQL is assumed to write.
+func (r *Router) RouteScanned(sql string, s Session) (Decision, error) {
+	d := Decision{}
+	var relations []Relation
+	for _, relation := range ScanRelations(sql) {
+		if _, ok := r.match(relation.Schema); ok {
+			relations = append(relations, relation)
+		}
+	}
+	owners := map[string][]Relation{}
+	err := r.own(&d, owners, map[Relation]bool{}, relations, s)
+	if err != nil {
+		return d, err
+	}
+
+	if len(owners) > 1 {
+		return d, &CrossBackendError{Owners: owners}
+	}
+	r.decideOwner(&d, owners)
+	return d, nil
+}
+
+// own resolves relations (skipping those already seen), adding them to the
+// decision and to the relations owned by each backend.
+func (r *Router) own(d *Decision, owners map[string][]Relation, seen map[Relation]bool, relations []Relation, s Session) error {
+	for _, relation := range relations {
+		resolved, backend := r.Resolve(relation, s)
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		d.Relations = append(d.Relations, resolved)
+		if backend == "" {
+			continue
+		}
+		if r.known != nil && !r.known[backend] {
+			return fmt.Errorf("%w; schema %q resolved to backend %q", ErrUnknownBackend, resolved.Schema, backend)
+		}
+		owners[backend] = append(owners[backend], resolved)
+	}
+	return nil
+}
+
+// decideOwner sends the decision to the (single) backend that owns its
+// relations, if any.
+func (r *Router) decideOwner(d *Decision, owners map[string][]Relation) {
+	for backend := range owners {
+		d.Backend = backend
+		d.Mirror = r.mirror(owners[backend], backend)
+		if !d.ReadOnly {
+			d.DualWrite = r.dualWrite(owners[backend], backend)
+		}
+	}
+}
+
+// RouteHinted routes statements like `Route`, but a `backend` or `schema`
+// hint takes precedence over the relations in the statements (including when
+// they are owned by multiple backends). A hint naming an unknown backend is
+// an error.
+func (r *Router) RouteHinted(statements parser.Statements, s Session, h Hints) (Decision, error) {
+	d, err := r.Route(statements, s)
+	if h.Backend == "" && h.Schema == "" {
+		return d, err
+	}
+	if err != nil && !errors.Is(err, ErrCrossBackend) {
+		return d, err
+	}
+
+	backend := h.Backend
+	if h.Schema != "" {
+		backend = r.SchemaBackend(h.Schema, s)
+		if backend == "" {
+			return d, fmt.Errorf("%w; schema %q is a system schema", ErrInvalidHint, h.Schema)
+		}
+	}
+	if r.known != nil && !r.known[backend] {
+		return d, fmt.Errorf("%w; unknown backend %q", ErrInvalidHint, backend)
+	}
+
+	if backend != d.Backend {
+		d.Mirror = ""
+		d.DualWrite = ""
+	}
+	d.Backend = backend
+	d.Catalog = false
+	d.FanOut = false
+	return d, nil
+}
+
+// Resolve determines the schema for a relation (using the session
+// `search_path` if it is not qualified) and the backend that owns it. The
+// backend will be empty for relations in a system schema. An unqualified
+// function in `Options.Functions` is owned by the mapped backend.
+func (r *Router) Resolve(relation Relation, s Session) (Relation, string) {
+	if relation.Kind == KindFunction && relation.Schema == "" {
+		if fr := r.functions[strings.ToLower(relation.Name)]; fr.Backend != "" {
+			return relation, fr.Backend
+		}
+	}
+	if relation.Schema == "" {
+		relation.Schema = r.resolveSchema(relation.Name, s)
+	}
+	return relation, r.SchemaBackend(relation.Schema, s)
+}
+
+// SchemaBackend returns the backend that owns a schema. The backend will be
+// empty for system schemas.
+func (r *Router) SchemaBackend(schema string, s Session) string {
+	if isSystemSchema(schema) {
+		return ""
+	}
+	if backend, ok := r.match(schema); ok {
+		return backend
+	}
+	if s.Backend != "" {
+		return s.Backend
+	}
+	return r.defaultBackend
+}
+
+// mirror determines the shadow backend for relations owned by `backend`.
+// Relations without a mirror are ignored; if the relations are mirrored to
+// different backends, the statements are not mirrored.
+func (r *Router) mirror(relations []Relation, backend string) string {
+	mirror := ""
+	for _, relation := range relations {
+		m := r.MirrorBackend(relation.Schema)
+		if m == "" || m == backend {
+			continue
+		}
+		if mirror != "" && m != mirror {
+			return ""
+		}
+		mirror = m
+	}
+	return mirror
+}
+
+// MirrorBackend returns the shadow backend for a schema (see `Rule.Mirror`),
+// if any.
+func (r *Router) MirrorBackend(schema string) string {
+	if _, ok := r.schemas[schema]; ok {
+		return r.mirrors[schema]
+	}
+	for _, pr := range r.patterns {
+		if _, ok := pr.Backend(schema, r.lookups); ok {
+			return pr.Rule.Mirror
+		}
+	}
+	return ""
+}
+
+// FanOutBackends returns the backends (of `backends`) that a fan-out query
+// is sent to. A backend that only receives copies of schemas owned elsewhere
+// (a `mirror`, or the backend that does not serve the reads of a migrating
+// schema) is left out, since its rows would duplicate those of the owner.
+func (r *Router) FanOutBackends(backends []string) []string {
+	owners := r.owners()
+	copies := map[string]bool{}
+	for _, mirror := range r.mirrors {
+		copies[mirror] = true
+	}
+	for _, pr := range r.patterns {
+		if pr.Rule.Mirror != "" {
+			copies[pr.Rule.Mirror] = true
+		}
+	}
+	for _, m := range r.migrations {
+		copies[m.Secondary()] = true
+	}
+
+	selected := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		if owners == nil || owners[backend] || !copies[backend] {
+			selected = append(selected, backend)
+		}
+	}
+	return selected
+}
+
+// owners returns the backends that own (or may own) a schema; `nil` if any
+// backend may, i.e. a rule has a backend template (e.g. `shard_$1`) or a
+// lookup whose contents are unknown.
+func (r *Router) owners() map[string]bool {
+	owners := map[string]bool{r.defaultBackend: true}
+	for schema, backend := range r.schemas {
+		if _, ok := r.migrations[schema]; !ok {
+			owners[backend] = true
+		}
+	}
+	for _, m := range r.migrations {
+		owners[m.Owner()] = true
+	}
+	for _, pr := range r.patterns {
+		if strings.Contains(pr.Rule.Backend, "$") {
+			return nil
+		}
+		if pr.Rule.Backend != "" {
+			owners[pr.Rule.Backend] = true
+		}
+		if pr.Rule.Shard != nil {
+			for _, backend := range pr.Rule.Shard.Backends {
+				owners[backend] = true
+			}
+		}
+		if pr.Rule.Lookup != "" {
+			t, ok := r.lookups[pr.Rule.Lookup].(*Table)
+			if !ok {
+				return nil
+			}
+			for _, backend := range t.Backends() {
+				owners[backend] = true
+			}
+		}
+	}
+	for _, cr := range r.connections {
+		owners[cr.Backend] = true
+	}
+	for _, fr := range r.functions {
+		if fr.Backend != "" {
+			owners[fr.Backend] = true
+		}
+	}
+	return owners
+}
+
+// match finds the first rule that determines a backend for the schema.
+func (r *Router) match(schema string) (string, bool) {
+	if m, ok := r.migrations[schema]; ok {
+		return m.Owner(), true
+	}
+	if backend, ok := r.schemas[schema]; ok {
+		return backend, true
+	}
+	for _, pr := range r.patterns {
+		if backend, ok := pr.Backend(schema, r.lookups); ok {
+			return backend, true
+		}
+	}
+	return "", false
+}
+
+func (r *Router) resolveSchema(name string, s Session) string {
+	// NOTE: PostgreSQL implicitly searches `pg_catalog` before the
+	//       `search_path`. The `pg_` prefix is only reserved for schema
+	//       names, so e.g. a `pg_jobs` table is resolved as usual.
+	if catalogRelations[name] {
+		return "pg_catalog"
+	}
+
+	searchPath := s.SearchPath
+	if len(searchPath) == 0 {
+		searchPath = defaultSearchPath
+	}
+
+	first := ""
+	for _, schema := range searchPath {
+		if schema == "$user" {
+			schema = s.User
+		}
+		if schema == "" || isSystemSchema(schema) {
+			continue
+		}
+		if _, ok := r.match(schema); ok {
+			return schema
+		}
+		if first == "" && schema != s.User {
+			first = schema
+		}
+	}
+
+	if first == "" {
+		return "public"
+	}
+	return first
+}
+
+func isSystemSchema(schema string) bool {
+	return systemSchemas[schema] || strings.HasPrefix(schema, "pg_toast") || strings.HasPrefix(schema, "pg_temp")
+}
+
+// CrossBackendError is the error returned when the relations referenced by
+// one or more statements are owned by more than one backend.
+type CrossBackendError struct {
+	// Owners maps each backend to the (resolved) relations it owns.
+	Owners map[string][]Relation
+	// DDL indicates the statements change the schema, e.g. a `CREATE TABLE`
+	// with a foreign key to a table owned by another backend.
+	DDL bool
+}
+
+// Error implements `error`.
+func (e *CrossBackendError) Error() string {
+	return fmt.Sprintf("%v; %s", ErrCrossBackend, e.Detail())
+}
+
+// Unwrap allows `errors.Is(err, ErrCrossBackend)`.
+func (e *CrossBackendError) Unwrap() error {
+	return ErrCrossBackend
+}
+
+// Detail lists the relations owned by each backend, e.g.
+// `backend "billing": billing.invoices; backend "crm": crm.customers`.
+func (e *CrossBackendError) Detail() string {
+	backends := make([]string, 0, len(e.Owners))
+	for backend := range e.Owners {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+
+	parts := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		names := make([]string, 0, len(e.Owners[backend]))
+		for _, relation := range e.Owners[backend] {
+			names = append(names, relation.String())
+		}
+		parts = append(parts, fmt.Sprintf("backend %q: %s", backend, strings.Join(names, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Hint suggests how to fix the statement.
+func (e *CrossBackendError) Hint() string {
+	if e.DDL {
+		return "Objects owned by different backends cannot reference each other (e.g. via a foreign key or a view); " +
+			"create related objects in schemas routed to the same backend."
+	}
+	return "Split the statement so that each statement only references relations owned by a single backend."
+}
@@ -0,0 +1,262 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ShardHash assigns a key to backend `hash(key) mod N`.
+	ShardHash = "hash"
+	// ShardHashRange splits the hash space into N contiguous ranges and
+	// assigns a key to the backend owning the range containing `hash(key)`.
+	ShardHashRange = "hash_range"
+	// ShardModulo assigns a (decimal integer) key to backend `key mod N`.
+	ShardModulo = "modulo"
+)
+
+// Rule maps a schema (or every schema matching a pattern) to the backend
+// that owns it. Exactly one of `Schema`, `Pattern` or `Regex` must be set.
+//
+// For `Pattern` and `Regex` rules, the backend can be determined from the
+// schema name: `Backend` and `Key` may reference capture groups as `$1` or
+// `${name}`, the key can be sharded across a fixed list of backends or the
+// key can be looked up in a lookup table (see `Lookup`).
+type Rule struct {
+	Schema string `json:"schema,omitempty"`
+	// Pattern is a glob matched against the full schema name. Each `*`
+	// (any run of characters) or `?` (a single character) is a capture
+	// group, e.g. `tenant_*` captures `0001` from `tenant_0001`.
+	Pattern string `json:"pattern,omitempty"`
+	// Regex is a regular expression matched against the full schema name.
+	Regex string `json:"regex,omitempty"`
+	// Backend is the backend that owns matching schemas. When `Lookup` is
+	// set, this is the fallback for keys missing from the lookup table;
+	// without a fallback, such schemas are handled by later rules (or the
+	// default backend).
+	Backend string `json:"backend,omitempty"`
+	// Key is the template used to compute the shard or lookup key. It
+	// defaults to the first capture group (or the full schema name if there
+	// are no capture groups).
+	Key string `json:"key,omitempty"`
+	// Shard distributes matching schemas across several backends.
+	Shard *Shard `json:"shard,omitempty"`
+	// Lookup is the name of a lookup table mapping keys to backends.
+	Lookup string `json:"lookup,omitempty"`
+	// Rename is the name of the schema on the backend when it differs from
+	// the name used by clients (e.g. during a migration); statements are
+	// rewritten to use it. Only valid for `Schema` rules.
+	Rename string `json:"rename,omitempty"`
+	// Mirror is a shadow backend that receives a copy of the statements
+	// routed by this rule; its results are compared with (but never affect)
+	// the responses from the owning backend.
+	Mirror string `json:"mirror,omitempty"`
+	// MigrateTo is the backend a schema is being moved to: writes are
+	// applied to both backends while reads are served by `Backend` until
+	// the migration is cut over. Only valid for `Schema` rules.
+	MigrateTo string `json:"migrate_to,omitempty"`
+}
+
+// Shard describes how keys are distributed across a list of backends.
+type Shard struct {
+	// Function is one of `hash` (the default), `hash_range` or `modulo`.
+	Function string   `json:"function,omitempty"`
+	Backends []string `json:"backends"`
+}
+
+// Name returns the schema, pattern or regular expression matched by the
+// rule, for use in messages.
+func (r Rule) Name() string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	if r.Regex != "" {
+		return r.Regex
+	}
+	return r.Schema
+}
+
+// Backends returns the backend names that appear literally in the rule
+// (i.e. excluding templates and lookup table contents).
+func (r Rule) Backends() []string {
+	var backends []string
+	if r.Backend != "" && !strings.Contains(r.Backend, "$") {
+		backends = append(backends, r.Backend)
+	}
+	if r.Shard != nil {
+		backends = append(backends, r.Shard.Backends...)
+	}
+	if r.Mirror != "" {
+		backends = append(backends, r.Mirror)
+	}
+	if r.MigrateTo != "" {
+		backends = append(backends, r.MigrateTo)
+	}
+	return backends
+}
+
+// Validate checks that a rule is well-formed.
+func (r Rule) Validate() error {
+	matchers := 0
+	for _, value := range []string{r.Schema, r.Pattern, r.Regex} {
+		if value != "" {
+			matchers++
+		}
+	}
+	if matchers == 0 {
+		return fmt.Errorf("%w, schema, pattern or regex is required", ErrInvalidRule)
+	}
+	if matchers > 1 {
+		return fmt.Errorf("%w, only one of schema, pattern or regex may be set for %q", ErrInvalidRule, r.Name())
+	}
+	if r.Mirror != "" && r.Mirror == r.Backend {
+		return fmt.Errorf("%w, rule %q cannot mirror to its own backend", ErrInvalidRule, r.Name())
+	}
+
+	if r.Schema != "" {
+		if systemSchemas[r.Schema] {
+			return fmt.Errorf("%w, system schema %q cannot be routed", ErrInvalidRule, r.Schema)
+		}
+		if r.Backend == "" || r.Shard != nil || r.Lookup != "" || r.Key != "" {
+			return fmt.Errorf("%w, schema %q requires a backend (and only a backend)", ErrInvalidRule, r.Schema)
+		}
+		if strings.Contains(r.Backend, "$") {
+			return fmt.Errorf("%w, backend for schema %q cannot be a template", ErrInvalidRule, r.Schema)
+		}
+		if r.Rename == r.Schema || isSystemSchema(r.Rename) {
+			return fmt.Errorf("%w, schema %q cannot be renamed to %q", ErrInvalidRule, r.Schema, r.Rename)
+		}
+		if r.MigrateTo == r.Backend {
+			return fmt.Errorf("%w, schema %q cannot migrate to its own backend", ErrInvalidRule, r.Schema)
+		}
+		if r.MigrateTo != "" && r.Mirror != "" {
+			return fmt.Errorf("%w, schema %q cannot both mirror and migrate", ErrInvalidRule, r.Schema)
+		}
+		return nil
+	}
+	if r.Rename != "" {
+		return fmt.Errorf("%w, rename requires a single schema, not %q", ErrInvalidRule, r.Name())
+	}
+	if r.MigrateTo != "" {
+		return fmt.Errorf("%w, migrate_to requires a single schema, not %q", ErrInvalidRule, r.Name())
+	}
+
+	_, err := r.compile()
+	if err != nil {
+		return err
+	}
+
+	if r.Shard != nil {
+		if r.Backend != "" || r.Lookup != "" {
+			return fmt.Errorf("%w, rule %q cannot combine shard with backend or lookup", ErrInvalidRule, r.Name())
+		}
+		if len(r.Shard.Backends) == 0 {
+			return fmt.Errorf("%w, shard for rule %q requires at least one backend", ErrInvalidRule, r.Name())
+		}
+		switch r.Shard.Function {
+		case "", ShardHash, ShardHashRange, ShardModulo:
+		default:
+			return fmt.Errorf("%w, rule %q has unknown shard function %q", ErrInvalidRule, r.Name(), r.Shard.Function)
+		}
+		return nil
+	}
+
+	if r.Backend == "" && r.Lookup == "" {
+		return fmt.Errorf("%w, backend, shard or lookup is required for rule %q", ErrInvalidRule, r.Name())
+	}
+	return nil
+}
+
+// compile converts a `Pattern` or `Regex` rule into an anchored regular
+// expression.
+func (r Rule) compile() (*regexp.Regexp, error) {
+	expr := r.Regex
+	if r.Pattern != "" {
+		expr = globToRegex(r.Pattern)
+	}
+
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("%w, rule %q is not a valid pattern; %v", ErrInvalidRule, r.Name(), err)
+	}
+	return re, nil
+}
+
+func globToRegex(pattern string) string {
+	var b strings.Builder
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString("(.*)")
+		case '?':
+			b.WriteString("(.)")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// patternRule is a validated `Pattern` or `Regex` rule.
+type patternRule struct {
+	Rule   Rule
+	Regexp *regexp.Regexp
+}
+
+// Backend determines the backend for a schema matching the rule. Returns
+// `false` if the schema does not match (or a `modulo` key is not an
+// integer).
+func (pr patternRule) Backend(schema string, lookups map[string]Lookup) (string, bool) {
+	match := pr.Regexp.FindStringSubmatchIndex(schema)
+	if match == nil {
+		return "", false
+	}
+
+	template := pr.Rule.Key
+	if template == "" {
+		template = "${0}"
+		if pr.Regexp.NumSubexp() > 0 {
+			template = "${1}"
+		}
+	}
+	key := string(pr.Regexp.ExpandString(nil, template, schema, match))
+
+	if pr.Rule.Shard != nil {
+		return shardBackend(*pr.Rule.Shard, key)
+	}
+	if pr.Rule.Lookup != "" {
+		if lookup, ok := lookups[pr.Rule.Lookup]; ok {
+			if backend, ok := lookup.Backend(key); ok {
+				return backend, true
+			}
+		}
+		if pr.Rule.Backend == "" {
+			return "", false
+		}
+	}
+	return string(pr.Regexp.ExpandString(nil, pr.Rule.Backend, schema, match)), true
+}
+
+func shardBackend(s Shard, key string) (string, bool) {
+	n := uint64(len(s.Backends))
+	switch s.Function {
+	case ShardModulo:
+		value, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		return s.Backends[value%n], true
+	case ShardHashRange:
+		return s.Backends[(uint64(hash32(key))*n)>>32], true
+	}
+	return s.Backends[uint64(hash32(key))%n], true
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,234 @@
+package router
+
+import (
+	"strings"
+)
+
+// tokenKind is the kind of a token found by `scanSQL`.
+type tokenKind int
+
+const (
+	// tokenComment is a `-- ...` or `/* ... */` comment.
+	tokenComment tokenKind = iota
+	// tokenSemicolon separates statements.
+	tokenSemicolon
+	// tokenIdentifier is an unquoted identifier or keyword.
+	tokenIdentifier
+	// tokenQuotedIdentifier is a double quoted identifier.
+	tokenQuotedIdentifier
+	// tokenString is a string literal (including `E'...'` and dollar quoted
+	// strings).
+	tokenString
+)
+
+// token is a span `[Start, End)` of a SQL string. Only the tokens needed to
+// find comments, statements and names are reported; operators, numbers and
+// parameters are skipped.
+type token struct {
+	Kind  tokenKind
+	Start int
+	End   int
+}
+
+// Text returns the token from the SQL string it was found in.
+func (t token) Text(sql string) string {
+	return sql[t.Start:t.End]
+}
+
+// Comment returns the contents of a comment token, without the delimiters.
+func (t token) Comment(sql string) string {
+	text := t.Text(sql)
+	if strings.HasPrefix(text, "--") {
+		return text[2:]
+	}
+	text = text[2:]
+	if strings.HasSuffix(text, "*/") {
+		text = text[:len(text)-2]
+	}
+	return text
+}
+
+// scanSQL scans a SQL string and invokes `onToken` for each comment,
+// semicolon, identifier and string literal.
+func scanSQL(sql string, onToken func(t token)) {
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		start := i
+		switch {
+		case (c == 'e' || c == 'E') && i+1 < len(sql) && sql[i+1] == '\'':
+			i = skipEscaped(sql, i+1)
+			onToken(token{Kind: tokenString, Start: start, End: end(sql, i)})
+		case c == '\'':
+			i = skipQuoted(sql, i, c)
+			onToken(token{Kind: tokenString, Start: start, End: end(sql, i)})
+		case c == '"':
+			i = skipQuoted(sql, i, c)
+			onToken(token{Kind: tokenQuotedIdentifier, Start: start, End: end(sql, i)})
+		case c == '$':
+			i = skipDollarQuoted(sql, i)
+			if i > start {
+				onToken(token{Kind: tokenString, Start: start, End: end(sql, i)})
+			}
+		case c == ';':
+			onToken(token{Kind: tokenSemicolon, Start: start, End: i + 1})
+		case c == '_' || isLetter(c):
+			for i+1 < len(sql) && (sql[i+1] == '_' || sql[i+1] == '$' || sql[i+1] >= 0x80 || isAlphanumeric(sql[i+1])) {
+				i++
+			}
+			onToken(token{Kind: tokenIdentifier, Start: start, End: i + 1})
+		case c >= '0' && c <= '9':
+			// NOTE: Numbers such as `1e5` must not be mistaken for identifiers.
+			for i+1 < len(sql) && (sql[i+1] == '_' || sql[i+1] == '.' || isAlphanumeric(sql[i+1])) {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "--"):
+			j := strings.IndexByte(sql[i:], '\n')
+			if j == -1 {
+				j = len(sql) - i
+			}
+			i += j - 1
+			onToken(token{Kind: tokenComment, Start: start, End: i + 1})
+		case strings.HasPrefix(sql[i:], "/*"):
+			// NOTE: Block comments nest in PostgreSQL.
+			depth := 1
+			j := i + 2
+			for j < len(sql) && depth > 0 {
+				switch {
+				case strings.HasPrefix(sql[j:], "/*"):
+					depth++
+					j += 2
+				case strings.HasPrefix(sql[j:], "*/"):
+					depth--
+					j += 2
+				default:
+					j++
+				}
+			}
+			i = j - 1
+			onToken(token{Kind: tokenComment, Start: start, End: j})
+		}
+	}
+}
+
+// end converts the index of the last character of a token (which may be
+// past the end of an unterminated token) into an exclusive end.
+func end(sql string, last int) int {
+	if last >= len(sql) {
+		return len(sql)
+	}
+	return last + 1
+}
+
+// SplitStatements splits a SQL string into its statements (without the
+// separating semicolons); statements that are empty (or only contain
+// whitespace) are omitted.
+func SplitStatements(sql string) []string {
+	var statements []string
+	start := 0
+	add := func(end int) {
+		if statement := sql[start:end]; strings.TrimSpace(statement) != "" {
+			statements = append(statements, statement)
+		}
+		start = end + 1
+	}
+	scanSQL(sql, func(t token) {
+		if t.Kind == tokenSemicolon {
+			add(t.Start)
+		}
+	})
+	add(len(sql))
+	return statements
+}
+
+// skipQuoted returns the index of the quote that closes the string literal
+// or quoted identifier starting at `start`. Doubled quotes are escapes.
+func skipQuoted(sql string, start int, quote byte) int {
+	for i := start + 1; i < len(sql); i++ {
+		if sql[i] != quote {
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == quote {
+			i++
+			continue
+		}
+		return i
+	}
+	return len(sql)
+}
+
+// skipEscaped returns the index of the quote that closes the escape string
+// (e.g. `E'it\'s'`) whose opening quote is at `start`.
+func skipEscaped(sql string, start int) int {
+	for i := start + 1; i < len(sql); i++ {
+		switch {
+		case sql[i] == '\\':
+			i++
+		case sql[i] != '\'':
+		case i+1 < len(sql) && sql[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted returns the index of the last character of the dollar
+// quoted string (e.g. `$body$ ... $body$`) starting at `start`. If `start`
+// is not the beginning of a dollar quote (e.g. it is a parameter such as
+// `$1`), `start` is returned.
+func skipDollarQuoted(sql string, start int) int {
+	end := start + 1
+	for end < len(sql) && (sql[end] == '_' || isAlphanumeric(sql[end])) {
+		end++
+	}
+	if end >= len(sql) || sql[end] != '$' || (end > start+1 && sql[start+1] >= '0' && sql[start+1] <= '9') {
+		return start
+	}
+
+	tag := sql[start : end+1]
+	closing := strings.Index(sql[end+1:], tag)
+	if closing == -1 {
+		return len(sql)
+	}
+	return end + closing + len(tag)
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isAlphanumeric(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// ScanRelations finds the qualified names (e.g. `billing.invoices`) in SQL
+// that could not be parsed, skipping comments and string literals. A scanner
+// cannot tell `schema.table` from `alias.column`, so every pair of names
+// joined by a dot is reported (`a.b.c` is reported as `a.b` and `b.c`); the
+// caller decides which schemas are meaningful.
+func ScanRelations(sql string) []Relation {
+	var names []token
+	scanSQL(sql, func(t token) {
+		names = append(names, t)
+	})
+
+	var relations []Relation
+	seen := map[Relation]bool{}
+	for i := 0; i+1 < len(names); i++ {
+		a, b := names[i], names[i+1]
+		if !isName(a) || !isName(b) || strings.TrimSpace(sql[a.End:b.Start]) != "." {
+			continue
+		}
+		relation := Relation{Schema: identifier(a.Text(sql)), Name: identifier(b.Text(sql)), Explicit: true}
+		if !seen[relation] {
+			seen[relation] = true
+			relations = append(relations, relation)
+		}
+	}
+	return relations
+}
+
+func isName(t token) bool {
+	return t.Kind == tokenIdentifier || t.Kind == tokenQuotedIdentifier
+}
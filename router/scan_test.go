@@ -0,0 +1,129 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanSQL(t *testing.T) {
+	t.Parallel()
+	type scanned struct {
+		Kind tokenKind
+		Text string
+	}
+	cases := []struct {
+		SQL    string
+		Tokens []scanned
+	}{
+		{
+			SQL: "SELECT a1, 1e5 FROM t",
+			Tokens: []scanned{
+				{Kind: tokenIdentifier, Text: "SELECT"},
+				{Kind: tokenIdentifier, Text: "a1"},
+				{Kind: tokenIdentifier, Text: "FROM"},
+				{Kind: tokenIdentifier, Text: "t"},
+			},
+		},
+		{
+			SQL: `SELECT 'it''s', "a ""b""", E'x\'y'; $1`,
+			Tokens: []scanned{
+				{Kind: tokenIdentifier, Text: "SELECT"},
+				{Kind: tokenString, Text: `'it''s'`},
+				{Kind: tokenQuotedIdentifier, Text: `"a ""b"""`},
+				{Kind: tokenString, Text: `E'x\'y'`},
+				{Kind: tokenSemicolon, Text: ";"},
+			},
+		},
+		{
+			SQL: "SELECT $tag$ ; 'x' $tag$ -- c;\n/* a /* nested */ ; */",
+			Tokens: []scanned{
+				{Kind: tokenIdentifier, Text: "SELECT"},
+				{Kind: tokenString, Text: "$tag$ ; 'x' $tag$"},
+				{Kind: tokenComment, Text: "-- c;"},
+				{Kind: tokenComment, Text: "/* a /* nested */ ; */"},
+			},
+		},
+		{
+			SQL: "SELECT 'unterminated",
+			Tokens: []scanned{
+				{Kind: tokenIdentifier, Text: "SELECT"},
+				{Kind: tokenString, Text: "'unterminated"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			var tokens []scanned
+			scanSQL(tc.SQL, func(tok token) {
+				tokens = append(tokens, scanned{Kind: tok.Kind, Text: tok.Text(tc.SQL)})
+			})
+			if !reflect.DeepEqual(tokens, tc.Tokens) {
+				t.Fatalf("scanSQL() = %#v, expected %#v", tokens, tc.Tokens)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL        string
+		Statements []string
+	}{
+		{SQL: "SELECT 1", Statements: []string{"SELECT 1"}},
+		{SQL: "SELECT 1; SELECT 2;", Statements: []string{"SELECT 1", " SELECT 2"}},
+		{SQL: "SELECT ';'; -- ;\n ;", Statements: []string{"SELECT ';'", " -- ;\n "}},
+		{SQL: " ; ", Statements: nil},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			if statements := SplitStatements(tc.SQL); !reflect.DeepEqual(statements, tc.Statements) {
+				t.Fatalf("SplitStatements() = %q, expected %q", statements, tc.Statements)
+			}
+		})
+	}
+}
+
+func TestScanRelations(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		SQL       string
+		Relations []Relation
+	}{
+		{SQL: "LOCK TABLE contacts", Relations: nil},
+		{
+			SQL: `LOCK TABLE crm.contacts, "Billing"."Invoices"`,
+			Relations: []Relation{
+				{Schema: "crm", Name: "contacts", Explicit: true},
+				{Schema: "Billing", Name: "Invoices", Explicit: true},
+			},
+		},
+		{
+			SQL: "SELECT i.id FROM Billing . invoices i",
+			Relations: []Relation{
+				{Schema: "i", Name: "id", Explicit: true},
+				{Schema: "billing", Name: "invoices", Explicit: true},
+			},
+		},
+		{
+			SQL: "SELECT 'crm.contacts' /* crm.notes */ FROM db.crm.contacts",
+			Relations: []Relation{
+				{Schema: "db", Name: "crm", Explicit: true},
+				{Schema: "crm", Name: "contacts", Explicit: true},
+			},
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.SQL, func(t *testing.T) {
+			t.Parallel()
+			if relations := ScanRelations(tc.SQL); !reflect.DeepEqual(relations, tc.Relations) {
+				t.Fatalf("ScanRelations() = %#v, expected %#v", relations, tc.Relations)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+)
+
+// TransactionControl identifies statements that start or end a transaction.
+type TransactionControl int
+
+const (
+	// TransactionNone is a statement that does not start or end a
+	// transaction.
+	TransactionNone TransactionControl = iota
+	// TransactionBegin is a `BEGIN` / `START TRANSACTION` statement.
+	TransactionBegin
+	// TransactionEnd is a `COMMIT` / `ROLLBACK` statement.
+	TransactionEnd
+)
+
+// Transaction determines if a statement starts or ends a transaction. For a
+// `BEGIN` statement, `readOnly` indicates the `READ ONLY` mode was requested.
+func Transaction(statement parser.Statement) (tc TransactionControl, readOnly bool) {
+	switch n := statement.AST.(type) {
+	case *tree.BeginTransaction:
+		return TransactionBegin, n.Modes.ReadWriteMode == tree.ReadOnly
+	case *tree.CommitTransaction, *tree.RollbackTransaction:
+		return TransactionEnd, false
+	}
+	return TransactionNone, false
+}
+
+// ParseSearchPath parses a `search_path` value such as `"$user", public`,
+// e.g. as sent in a startup parameter.
+func ParseSearchPath(value string) []string {
+	var searchPath []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) >= 2 && part[0] == '"' && part[len(part)-1] == '"' {
+			part = strings.ReplaceAll(part[1:len(part)-1], `""`, `"`)
+		} else {
+			part = strings.ToLower(part)
+		}
+		if part != "" {
+			searchPath = append(searchPath, part)
+		}
+	}
+	return searchPath
+}
+
+// SearchPath determines if a statement is `SET search_path = ...` and if so,
+// returns the new `search_path`. A `nil` result with `ok` set indicates the
+// `search_path` was reset to the default.
+func SearchPath(statement parser.Statement) (searchPath []string, ok bool) {
+	sv, isSet := statement.AST.(*tree.SetVar)
+	if !isSet || !strings.EqualFold(sv.Name, "search_path") {
+		return nil, false
+	}
+
+	for _, expr := range sv.Values {
+		switch v := expr.(type) {
+		case tree.DefaultVal:
+			return nil, true
+		case *tree.StrVal:
+			searchPath = append(searchPath, ParseSearchPath(v.RawString())...)
+		case *tree.UnresolvedName:
+			searchPath = append(searchPath, v.Parts[0])
+		default:
+			searchPath = append(searchPath, ParseSearchPath(tree.AsString(expr))...)
+		}
+	}
+
+	return searchPath, true
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"reflect"
+)
+
+// visitFunc is invoked for every node in a syntax tree. Nodes are always
+// passed as pointers (e.g. `*tree.TableName`) so they can be modified in
+// place. Returning `false` stops the walk from descending into the node.
+type visitFunc func(node interface{}) bool
+
+// walk visits every node reachable from `root`.
+//
+// The `tree.Visitor` / `tree.WalkExpr` machinery in the parser only visits a
+// subset of expressions (and no statements), so this uses reflection to
+// reach every table name, function call and subquery regardless of where it
+// occurs in the syntax tree.
+func walk(root interface{}, visit visitFunc) {
+	seen := map[visited]bool{}
+	walkValue(reflect.ValueOf(root), seen, visit)
+}
+
+// visited identifies a node by address and type; a struct and its first
+// field (e.g. `tree.CreateView` and its `Name`) share an address.
+type visited struct {
+	Pointer uintptr
+	Type    reflect.Type
+}
+
+func walkValue(v reflect.Value, seen map[visited]bool, visit visitFunc) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		key := visited{Pointer: v.Pointer(), Type: v.Type()}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if v.Elem().Kind() != reflect.Struct {
+			walkValue(v.Elem(), seen, visit)
+			return
+		}
+		if v.CanInterface() && !visit(v.Interface()) {
+			return
+		}
+		walkFields(v.Elem(), seen, visit)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		walkValue(v.Elem(), seen, visit)
+	case reflect.Struct:
+		if v.CanAddr() {
+			walkValue(v.Addr(), seen, visit)
+			return
+		}
+		// NOTE: A struct stored by value inside an interface is not
+		//       addressable, so it can only be inspected (not modified).
+		if v.CanInterface() && !visit(v.Interface()) {
+			return
+		}
+		walkFields(v, seen, visit)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkValue(v.Index(i), seen, visit)
+		}
+	}
+}
+
+func walkFields(v reflect.Value, seen map[visited]bool, visit visitFunc) {
+	for i := 0; i < v.NumField(); i++ {
+		walkValue(v.Field(i), seen, visit)
+	}
+}
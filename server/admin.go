@@ -0,0 +1,525 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// adminServerVersion is reported to admin console clients; `psql` uses
+	// it to decide which catalog queries it can send.
+	adminServerVersion = "14.0 (postgresql-schema-router)"
+)
+
+// adminTable is the result of an admin console `SHOW` command.
+type adminTable struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Add appends a row; there must be one value per column.
+func (t *adminTable) Add(values ...string) {
+	t.Rows = append(t.Rows, values)
+}
+
+// RunAdmin serves the admin console: the proxy answers the client itself,
+// like a PostgreSQL server with a single (virtual) database. Only simple
+// queries are supported.
+func (s *session) RunAdmin() error {
+	err := s.authenticateAdmin()
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for {
+		chunk, err := postgres.ReadMessage(s.Reader)
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			return err
+		}
+		fm, err := postgres.ParseChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		switch m := fm.(type) {
+		case *pgproto3.Terminate:
+			return nil
+		case *pgproto3.Query:
+			err = s.handleAdmin(m.String)
+		case *pgproto3.Sync:
+			failed = false
+			err = s.send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+		default:
+			if !failed {
+				failed = true
+				err = s.send(errorResponse(fmt.Errorf("%w; the admin console only supports simple queries", ErrAdminCommand)))
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// authenticateAdmin requires MD5 password authentication from one of the
+// admin users and then completes the startup as a server would.
+func (s *session) authenticateAdmin() error {
+	admin := s.Server.config().Admin
+	user := s.Parameters["user"]
+
+	salt := [4]byte{}
+	_, err := rand.Read(salt[:])
+	if err != nil {
+		return err
+	}
+	err = s.send(&pgproto3.AuthenticationMD5Password{Salt: salt})
+	if err != nil {
+		return err
+	}
+
+	chunk, err := postgres.ReadMessage(s.Reader)
+	if err != nil {
+		return err
+	}
+	fm, err := postgres.ParseChunk(chunk)
+	if err != nil {
+		return err
+	}
+	password := ""
+	if pm, ok := fm.(*postgres.Byte1pMessage); ok {
+		password = strings.TrimSuffix(pm.Data, "\x00")
+	}
+
+	allowed := false
+	for _, candidate := range admin.Users {
+		allowed = allowed || candidate == user
+	}
+	expected := postgres.MD5Password(user, admin.Password, salt)
+	if !allowed || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		// NOTE: The error is returned (not just sent) so the connection is
+		//       closed even if the client ignores the `FATAL`.
+		err = fmt.Errorf("%w; user %q", ErrAdminAuthentication, user)
+		return appendErrs(err, s.sendFatal(err))
+	}
+
+	logf("Admin console login from user %q", user)
+	return s.send(
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.ParameterStatus{Name: "server_version", Value: adminServerVersion},
+		&pgproto3.ParameterStatus{Name: "server_encoding", Value: "UTF8"},
+		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
+		&pgproto3.ParameterStatus{Name: "DateStyle", Value: "ISO, MDY"},
+		&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+}
+
+// handleAdmin runs a single admin console command.
+func (s *session) handleAdmin(sql string) error {
+	command := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(sql), ";"))
+	words := strings.Fields(strings.ToUpper(command))
+	if len(words) == 0 {
+		return s.send(&pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+	args := strings.Fields(command)[1:]
+	if schema, cutOver, ok := router.ParseCutOver(command); ok {
+		return s.adminCutOver(schema, cutOver)
+	}
+
+	ps := s.Server
+	switch {
+	case words[0] == "SHOW" && len(words) == 2:
+		var t adminTable
+		switch words[1] {
+		case "SESSIONS":
+			t = ps.showSessions()
+		case "BACKENDS":
+			t = ps.showBackends()
+		case "ROUTES":
+			t = ps.showRoutes()
+		case "POOLS":
+			t = ps.showPools()
+		case "STATS":
+			t = ps.showStats()
+		case "MIGRATIONS":
+			t = ps.showMigrations()
+		case "LATENCY":
+			t = ps.showLatency()
+		case "STATEMENTS":
+			t = ps.showStatements()
+		case "ALLOWLIST":
+			t = ps.showAllowlist()
+		case "UNPARSED":
+			t = ps.showUnparsed()
+		default:
+			return s.rejectAdmin(fmt.Errorf("%w; SHOW %s", ErrAdminCommand, args[0]))
+		}
+		return s.sendTable(t)
+	case words[0] == "RELOAD" && len(words) == 1:
+		err := ps.reload()
+		if err != nil {
+			return s.rejectAdmin(err)
+		}
+		logf("Configuration reloaded by admin user %q", s.Parameters["user"])
+		return s.sendCommandComplete("RELOAD")
+	case words[0] == "RESET" && len(words) == 2 && words[1] == "STATEMENTS":
+		ps.Statements.Reset()
+		logf("Statement statistics reset by admin user %q", s.Parameters["user"])
+		return s.sendCommandComplete("RESET")
+	case words[0] == "PAUSE" && len(words) == 2:
+		inFlight, err := ps.drain(args[0])
+		if err != nil {
+			return s.rejectAdmin(err)
+		}
+		if inFlight > 0 {
+			err = s.send(&pgproto3.NoticeResponse{
+				Severity: "WARNING",
+				Code:     "01000",
+				Message:  fmt.Sprintf("%d transactions on backend %q are still open", inFlight, args[0]),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return s.sendCommandComplete("PAUSE")
+	case words[0] == "RESUME" && len(words) == 2:
+		err := ps.resume(args[0])
+		if err != nil {
+			return s.rejectAdmin(err)
+		}
+		return s.sendCommandComplete("RESUME")
+	case words[0] == "KILL" && len(words) == 2:
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err == nil {
+			err = ps.kill(id)
+		} else {
+			err = fmt.Errorf("%w; session %q", ErrAdminObjectNotFound, args[0])
+		}
+		if err != nil {
+			return s.rejectAdmin(err)
+		}
+		logf("Session %d killed by admin user %q", id, s.Parameters["user"])
+		return s.sendCommandComplete("KILL")
+	}
+	return s.rejectAdmin(fmt.Errorf("%w; %q", ErrAdminCommand, command))
+}
+
+// adminCutOver runs `CUTOVER schema` (or `REVERT CUTOVER schema`) from the
+// admin console; unlike in a proxied session, no `migration.users` check
+// is needed.
+func (s *session) adminCutOver(schema string, cutOver bool) error {
+	r := s.Server.router()
+	err := r.CutOver(schema, cutOver)
+	if err != nil {
+		return s.rejectAdmin(err)
+	}
+	backend := r.SchemaBackend(schema, router.Session{})
+	logf("Reads of migrating schema %q are served by %q (requested by admin user %q)", schema, backend, s.Parameters["user"])
+	if cutOver {
+		return s.sendCommandComplete("CUTOVER")
+	}
+	return s.sendCommandComplete("REVERT CUTOVER")
+}
+
+func (s *session) rejectAdmin(err error) error {
+	return s.send(errorResponse(err), &pgproto3.ReadyForQuery{TxStatus: 'I'})
+}
+
+func (s *session) sendCommandComplete(tag string) error {
+	return s.send(
+		&pgproto3.CommandComplete{CommandTag: []byte(tag)},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+}
+
+func (s *session) sendTable(t adminTable) error {
+	rd := &pgproto3.RowDescription{}
+	for _, column := range t.Columns {
+		rd.Fields = append(rd.Fields, pgproto3.FieldDescription{
+			Name:         []byte(column),
+			DataTypeOID:  textOID,
+			DataTypeSize: -1,
+			TypeModifier: -1,
+		})
+	}
+	messages := []pgproto3.BackendMessage{rd}
+	for _, row := range t.Rows {
+		values := make([][]byte, len(row))
+		for i, value := range row {
+			values[i] = []byte(value)
+		}
+		messages = append(messages, &pgproto3.DataRow{Values: values})
+	}
+	messages = append(
+		messages,
+		&pgproto3.CommandComplete{CommandTag: []byte("SHOW")},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	return s.send(messages...)
+}
+
+// kill ends a session: the client is sent a fatal error and its connection
+// is closed.
+func (ps *proxyServer) kill(id uint64) error {
+	s, err := ps.Sessions.Get(id)
+	if err != nil {
+		return err
+	}
+	_ = s.sendFatal(ErrSessionKilled)
+	err = s.Client.Close()
+	if isClosed(err) {
+		return nil
+	}
+	return err
+}
+
+func (ps *proxyServer) showSessions() adminTable {
+	t := adminTable{Columns: []string{
+		"id", "user", "database", "application_name", "client_addr", "backend", "state", "current_backends",
+		"connections", "statement", "started", "last_activity", "bytes_received", "bytes_sent",
+		"messages_received", "messages_sent",
+	}}
+	for _, si := range ps.sessionInfos() {
+		var conns []string
+		for _, ci := range si.Connections {
+			conns = append(conns, ci.String())
+		}
+		t.Add(
+			strconv.FormatUint(si.ID, 10),
+			si.User,
+			si.Database,
+			si.ApplicationName,
+			si.ClientAddr,
+			si.Backend,
+			si.State,
+			strings.Join(si.CurrentBackends, ", "),
+			strings.Join(conns, ", "),
+			si.Statement,
+			si.Started.Format(time.RFC3339),
+			si.LastActivity.Format(time.RFC3339),
+			strconv.FormatInt(si.BytesReceived, 10),
+			strconv.FormatInt(si.BytesSent, 10),
+			strconv.FormatInt(si.MessagesReceived, 10),
+			strconv.FormatInt(si.MessagesSent, 10),
+		)
+	}
+	return t
+}
+
+// state describes what a session is doing: `waiting` (for a paused backend),
+// `active` (waiting for a response), `in transaction`, `in failed
+// transaction` or `idle`.
+func (s *session) state() string {
+	s.Mutex.Lock()
+	waiting := s.Waiting
+	s.Mutex.Unlock()
+	if waiting != "" {
+		return fmt.Sprintf("waiting (backend %s paused)", waiting)
+	}
+
+	for _, sc := range s.conns() {
+		if sc.Busy() {
+			return "active"
+		}
+	}
+	return s.Activity.Transaction()
+}
+
+func (ci connInfo) String() string {
+	return fmt.Sprintf("%s %s %s", ci.Backend, ci.Role, ci.Addr)
+}
+
+func (ps *proxyServer) showBackends() adminTable {
+	t := adminTable{Columns: []string{
+		"name", "role", "addr", "connections", "lag", "available", "paused_for",
+	}}
+	for _, bi := range ps.backendInfos() {
+		paused := ""
+		if bi.Paused {
+			paused = time.Duration(bi.PausedFor).String()
+		}
+		t.Add(bi.Name, "primary", bi.Primary.Addr, strconv.FormatInt(bi.Primary.Connections, 10), "", "true", paused)
+		for _, mi := range bi.Replicas {
+			lag := ""
+			if mi.Lag != nil {
+				lag = time.Duration(*mi.Lag).String()
+			}
+			t.Add(
+				bi.Name, "replica", mi.Addr,
+				strconv.FormatInt(mi.Connections, 10),
+				lag,
+				strconv.FormatBool(mi.Available),
+				paused,
+			)
+		}
+	}
+	return t
+}
+
+func (ps *proxyServer) showRoutes() adminTable {
+	t := adminTable{Columns: []string{
+		"match", "kind", "backend", "shard", "lookup", "rename", "mirror", "migrate_to",
+	}}
+	for _, rule := range ps.config().Routes {
+		kind := "schema"
+		if rule.Pattern != "" {
+			kind = "pattern"
+		} else if rule.Regex != "" {
+			kind = "regex"
+		}
+		shard := ""
+		if rule.Shard != nil {
+			function := rule.Shard.Function
+			if function == "" {
+				function = router.ShardHash
+			}
+			shard = fmt.Sprintf("%s: %s", function, strings.Join(rule.Shard.Backends, ", "))
+		}
+		t.Add(rule.Name(), kind, rule.Backend, shard, rule.Lookup, rule.Rename, rule.Mirror, rule.MigrateTo)
+	}
+	return t
+}
+
+// showPools summarizes the server connections held by sessions for each
+// server: the proxy does not pool connections, each session has its own.
+func (ps *proxyServer) showPools() adminTable {
+	type pool struct {
+		connInfo
+		Connections, Active, InTransaction int
+	}
+	var pools []*pool
+	index := map[connInfo]*pool{}
+	for _, s := range ps.Sessions.List() {
+		for _, sc := range s.conns() {
+			ci := newConnInfo(sc)
+			p, ok := index[ci]
+			if !ok {
+				p = &pool{connInfo: ci}
+				index[ci] = p
+				pools = append(pools, p)
+			}
+			p.Connections++
+			if sc.Busy() {
+				p.Active++
+			}
+			if sc.Status() != 'I' {
+				p.InTransaction++
+			}
+		}
+	}
+
+	t := adminTable{Columns: []string{
+		"backend", "role", "addr", "connections", "active", "in_transaction",
+	}}
+	for _, p := range pools {
+		t.Add(p.Backend, p.Role, p.Addr, strconv.Itoa(p.Connections), strconv.Itoa(p.Active), strconv.Itoa(p.InTransaction))
+	}
+	return t
+}
+
+func (ps *proxyServer) showStats() adminTable {
+	ms := ps.Mirroring
+	ms.Mutex.Lock()
+	mirrored := []int64{ms.Statements, ms.Matched, ms.Mismatched, ms.Dropped}
+	ms.Mutex.Unlock()
+	parseFailures, parseOverflow := ps.ParseFailures.Count()
+
+	t := adminTable{Columns: []string{"stat", "value"}}
+	t.Add("total_sessions", strconv.FormatInt(atomic.LoadInt64(&ps.Stats.Sessions), 10))
+	t.Add("open_sessions", strconv.Itoa(ps.Sessions.Len()))
+	t.Add("queries", strconv.FormatInt(atomic.LoadInt64(&ps.Stats.Queries), 10))
+	t.Add("parse_failures", strconv.FormatInt(parseFailures, 10))
+	t.Add("parse_failures_untracked", strconv.FormatInt(parseOverflow, 10))
+	t.Add("mirrored_statements", strconv.FormatInt(mirrored[0], 10))
+	t.Add("mirror_matched", strconv.FormatInt(mirrored[1], 10))
+	t.Add("mirror_mismatched", strconv.FormatInt(mirrored[2], 10))
+	t.Add("mirror_dropped", strconv.FormatInt(mirrored[3], 10))
+	return t
+}
+
+func (ps *proxyServer) showMigrations() adminTable {
+	t := adminTable{Columns: []string{"schema", "from", "to", "reads", "cut_over"}}
+	for _, m := range ps.router().Migrations() {
+		t.Add(m.Schema, m.From, m.To, m.Owner(), strconv.FormatBool(m.CutOver()))
+	}
+	return t
+}
+
+func (ps *proxyServer) showLatency() adminTable {
+	t := adminTable{Columns: []string{"backend", "statements", "samples", "p50", "p95", "p99", "max"}}
+	for _, ls := range ps.Latency.Summaries() {
+		t.Add(
+			ls.Backend,
+			strconv.FormatInt(ls.Statements, 10),
+			strconv.Itoa(ls.Samples),
+			time.Duration(ls.P50).String(),
+			time.Duration(ls.P95).String(),
+			time.Duration(ls.P99).String(),
+			time.Duration(ls.Max).String(),
+		)
+	}
+	return t
+}
+
+func (ps *proxyServer) showStatements() adminTable {
+	t := adminTable{Columns: []string{
+		"fingerprint", "backend", "calls", "total_time", "mean_time", "min_time", "max_time", "rows", "errors", "query",
+	}}
+	for _, ss := range ps.Statements.Summaries() {
+		t.Add(
+			ss.Fingerprint,
+			ss.Backend,
+			strconv.FormatInt(ss.Calls, 10),
+			time.Duration(ss.TotalTime).String(),
+			time.Duration(ss.MeanTime).String(),
+			time.Duration(ss.MinTime).String(),
+			time.Duration(ss.MaxTime).String(),
+			strconv.FormatInt(ss.Rows, 10),
+			strconv.FormatInt(ss.Errors, 10),
+			ss.Query,
+		)
+	}
+	return t
+}
+
+func (ps *proxyServer) showAllowlist() adminTable {
+	t := adminTable{Columns: []string{"user", "application_name", "fingerprint", "learned", "query"}}
+	al := ps.allowlist()
+	if al == nil {
+		return t
+	}
+	for _, entry := range al.List() {
+		t.Add(entry.User, entry.ApplicationName, entry.Fingerprint, entry.Learned.Format(time.RFC3339), entry.Query)
+	}
+	return t
+}
+
+func (ps *proxyServer) showUnparsed() adminTable {
+	t := adminTable{Columns: []string{"fingerprint", "count", "first_seen", "last_seen", "error", "query"}}
+	for _, failure := range ps.ParseFailures.List() {
+		t.Add(
+			failure.Fingerprint,
+			strconv.FormatInt(failure.Count, 10),
+			failure.FirstSeen.Format(time.RFC3339),
+			failure.LastSeen.Format(time.RFC3339),
+			failure.Error,
+			failure.Query,
+		)
+	}
+	return t
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+)
+
+func TestAdminAuthentication(t *testing.T) {
+	t.Parallel()
+	c := Config{
+		RemoteAddr: "127.0.0.1:1",
+		Admin:      AdminConfig{Database: "router", Users: []string{"admin"}, Password: "adminpw"},
+	}
+	_, addr := startProxy(t, c)
+
+	cases := []struct {
+		Name     string
+		User     string
+		Password string
+		Allowed  bool
+	}{
+		{Name: "admin", User: "admin", Password: "adminpw", Allowed: true},
+		{Name: "wrong password", User: "admin", Password: "guess"},
+		{Name: "not an admin", User: "app", Password: "adminpw"},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			t.Parallel()
+			client := dialProxy(t, addr, map[string]string{"user": tc.User, "database": "router"})
+			auth, ok := client.Receive().(*pgproto3.AuthenticationMD5Password)
+			if !ok {
+				t.Fatal("expected MD5 password authentication")
+			}
+			client.Send(&pgproto3.PasswordMessage{Password: postgres.MD5Password(tc.User, tc.Password, auth.Salt)})
+
+			if tc.Allowed {
+				messages := client.ReceiveUntilReady()
+				if _, ok := messages[0].(*pgproto3.AuthenticationOk); !ok {
+					t.Fatalf("received %#v, expected AuthenticationOk", messages[0])
+				}
+				client.Send(&pgproto3.Query{String: "SHOW BACKENDS"})
+				messages = client.ReceiveUntilReady()
+				if er, ok := messages[0].(*pgproto3.ErrorResponse); ok {
+					t.Fatalf("SHOW BACKENDS failed; %s", er.Message)
+				}
+				client.Send(&pgproto3.Terminate{})
+				return
+			}
+
+			er, ok := client.Receive().(*pgproto3.ErrorResponse)
+			if !ok || er.Severity != "FATAL" || er.Code != "28P01" {
+				t.Fatalf("received %#v, expected a FATAL invalid_password error", er)
+			}
+			// NOTE: A client that ignores the `FATAL` must not be able to run
+			//       admin commands.
+			client.Send(&pgproto3.Query{String: "SHOW BACKENDS"})
+			client.ExpectClosed()
+		})
+	}
+}
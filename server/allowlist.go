@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// allowlistLearn records the fingerprint of every statement.
+	allowlistLearn = "learn"
+	// allowlistLog logs statements that are not on the allowlist.
+	allowlistLog = "log"
+	// allowlistEnforce rejects statements that are not on the allowlist.
+	allowlistEnforce = "enforce"
+)
+
+// allowlist is the set of statement fingerprints (see `router.Fingerprint()`)
+// allowed for each user and application, persisted to a file.
+type allowlist struct {
+	Mutex   sync.Mutex
+	Path    string
+	Entries map[allowlistKey]allowlistEntry
+}
+
+type allowlistKey struct {
+	User            string
+	ApplicationName string
+	Fingerprint     string
+}
+
+// allowlistEntry is an allowed statement; Query is the normalized SQL (with
+// constants hidden) of the first statement seen with the fingerprint.
+type allowlistEntry struct {
+	User            string    `json:"user"`
+	ApplicationName string    `json:"application_name,omitempty"`
+	Fingerprint     string    `json:"fingerprint"`
+	Query           string    `json:"query"`
+	Learned         time.Time `json:"learned"`
+}
+
+// allowlistFile is the format of the allowlist file.
+type allowlistFile struct {
+	Statements []allowlistEntry `json:"statements"`
+}
+
+// openAllowlist loads the allowlist file (a missing file is an empty
+// allowlist); returns `nil` if no file is configured.
+func openAllowlist(ac AllowlistConfig) (*allowlist, error) {
+	if ac.File == "" {
+		return nil, nil
+	}
+	al := &allowlist{Path: ac.File}
+	err := al.Load()
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Load reads the allowlist file again, e.g. after it was edited.
+func (al *allowlist) Load() error {
+	entries := map[allowlistKey]allowlistEntry{}
+	data, err := os.ReadFile(al.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var af allowlistFile
+		err = json.Unmarshal(data, &af)
+		if err != nil {
+			return fmt.Errorf("%w, failed to parse allowlist %q; %v", ErrInvalidConfiguration, al.Path, err)
+		}
+		for _, entry := range af.Statements {
+			entries[entry.key()] = entry
+		}
+	}
+
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	al.Entries = entries
+	return nil
+}
+
+func (entry allowlistEntry) key() allowlistKey {
+	return allowlistKey{User: entry.User, ApplicationName: entry.ApplicationName, Fingerprint: entry.Fingerprint}
+}
+
+// Contains determines if a fingerprint is allowed.
+func (al *allowlist) Contains(key allowlistKey) bool {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	_, ok := al.Entries[key]
+	return ok
+}
+
+// Learn adds a fingerprint (if it is new) and saves the allowlist; returns
+// `true` if the fingerprint was added.
+func (al *allowlist) Learn(key allowlistKey, query string) (bool, error) {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	if _, ok := al.Entries[key]; ok {
+		return false, nil
+	}
+	al.Entries[key] = allowlistEntry{
+		User:            key.User,
+		ApplicationName: key.ApplicationName,
+		Fingerprint:     key.Fingerprint,
+		Query:           query,
+		Learned:         time.Now().UTC(),
+	}
+	return true, al.save()
+}
+
+// List returns the allowed statements, ordered by user, application and
+// query.
+func (al *allowlist) List() []allowlistEntry {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	return al.list()
+}
+
+func (al *allowlist) list() []allowlistEntry {
+	entries := make([]allowlistEntry, 0, len(al.Entries))
+	for _, entry := range al.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.ApplicationName != b.ApplicationName {
+			return a.ApplicationName < b.ApplicationName
+		}
+		if a.Query != b.Query {
+			return a.Query < b.Query
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+	return entries
+}
+
+// save writes the allowlist file (via a temporary file, so it is replaced
+// atomically). Must be called with `Mutex` held.
+func (al *allowlist) save() error {
+	data, err := json.MarshalIndent(allowlistFile{Statements: al.list()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := al.Path + ".tmp"
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, al.Path)
+}
+
+// checkAllowlist applies the allowlist (see `AllowlistConfig`) to the SQL of
+// a `Query` or `Parse`; `statements` is `nil` if the SQL could not be
+// parsed.
+func (s *session) checkAllowlist(sql string, statements parser.Statements) error {
+	al := s.Server.allowlist()
+	ac := s.Server.config().Allowlist
+	key, query, ok := s.allowlistKey(ac, sql, statements)
+	if al == nil || !ok {
+		return nil
+	}
+	user, application := key.User, key.ApplicationName
+	if ac.Mode == allowlistLearn {
+		added, err := al.Learn(key, query)
+		if err != nil {
+			logf("Failed to save allowlist %q; %v", al.Path, err)
+		}
+		if added {
+			logf("Learned statement %s for user %q (application %q); %s", key.Fingerprint, user, application, query)
+		}
+		return nil
+	}
+	if al.Contains(key) {
+		return nil
+	}
+
+	logf("Statement %s from user %q (application %q) is not on the allowlist; %s", key.Fingerprint, user, application, query)
+	if ac.Mode == allowlistEnforce {
+		return fmt.Errorf("%w; fingerprint %s", ErrNotAllowlisted, key.Fingerprint)
+	}
+	return nil
+}
+
+// allowlistKey identifies the SQL of a `Query` or `Parse` on the allowlist
+// and returns its normalized SQL; `false` if the allowlist does not apply to
+// it.
+func (s *session) allowlistKey(ac AllowlistConfig, sql string, statements parser.Statements) (allowlistKey, string, bool) {
+	if ac.Mode == "" || strings.TrimSpace(sql) == "" {
+		return allowlistKey{}, "", false
+	}
+	user := s.Parameters["user"]
+	// NOTE: A `traceparent` (see `applicationTraceparent()`) changes with
+	//       every trace, so it is not part of the application.
+	application := strings.TrimSpace(traceparentPattern.ReplaceAllString(s.Parameters["application_name"], ""))
+	if !ac.Covers(user, application) {
+		return allowlistKey{}, "", false
+	}
+
+	query := normalizeSQL(sql, statements, statements != nil, true)
+	key := allowlistKey{User: user, ApplicationName: application, Fingerprint: router.Fingerprint(query)}
+	return key, query, true
+}
+
+// Covers determines if the allowlist applies to a user and application.
+func (ac AllowlistConfig) Covers(user, application string) bool {
+	return globAny(ac.Users, user) && globAny(ac.Applications, application)
+}
+
+// globAny determines if a value matches one of the patterns (see
+// `path.Match`); an empty list matches every value.
+func globAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
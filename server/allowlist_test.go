@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig saves a configuration file that `reload()` can read.
+func writeConfig(t *testing.T, filename string, c Config) {
+	t.Helper()
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filename, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowlistReload(t *testing.T) {
+	t.Parallel()
+	billing := startBackend(t, "billing")
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	c := Config{
+		ProxyPort: 1,
+		Backends:  []BackendConfig{{Name: "billing", Primary: billing.Addr}},
+		Path:      filename,
+	}
+	writeConfig(t, filename, c)
+	ps, addr := startProxy(t, c)
+	client := login(t, addr, map[string]string{"user": "app", "database": "app"})
+
+	// NOTE: The first configuration has no allowlist, so `RELOAD` must open
+	//       one.
+	c.Allowlist = AllowlistConfig{Mode: allowlistLearn, File: filepath.Join(dir, "allowlist.json")}
+	writeConfig(t, filename, c)
+	err := ps.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, er := client.Query("SELECT * FROM invoices WHERE id = 1")
+	if er != nil {
+		t.Fatalf("learning failed; %s", er.Message)
+	}
+
+	c.Allowlist.Mode = allowlistEnforce
+	writeConfig(t, filename, c)
+	err = ps.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		SQL     string
+		Allowed bool
+	}{
+		{SQL: "SELECT * FROM invoices WHERE id = 2", Allowed: true},
+		{SQL: "select *  from invoices where id = 'x'", Allowed: true},
+		{SQL: "DELETE FROM invoices"},
+		{SQL: "SELECT * FROM invoices WHERE id = 1 FOR UPDATE"},
+		{SQL: "LOCK TABLE invoices"},
+	}
+	for _, tc := range cases {
+		rows, er := client.Query(tc.SQL)
+		if tc.Allowed {
+			if er != nil || len(rows) != 1 || rows[0][1] != tc.SQL {
+				t.Fatalf("%q was not forwarded; rows %q, error %#v", tc.SQL, rows, er)
+			}
+			continue
+		}
+		if er == nil || er.Code != "42501" {
+			t.Fatalf("%q was not rejected with SQLSTATE 42501; rows %q, error %#v", tc.SQL, rows, er)
+		}
+	}
+
+	// NOTE: A new allowlist file is opened (and is empty).
+	c.Allowlist.File = filepath.Join(dir, "other.json")
+	writeConfig(t, filename, c)
+	err = ps.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, er = client.Query("SELECT * FROM invoices WHERE id = 2")
+	if er == nil || er.Code != "42501" {
+		t.Fatalf("statement was not rejected with SQLSTATE 42501 by the new allowlist; error %#v", er)
+	}
+}
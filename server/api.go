@@ -0,0 +1,347 @@
+package server
+
+import (
+	"crypto/subtle"
+	// NOTE: Needed for `go:embed`.
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// maxAPIBody is the largest request body (e.g. a routing table) the HTTP
+	// API accepts.
+	maxAPIBody = 1 << 20
+	// redacted replaces secrets (passwords and the API token) in the
+	// configuration returned by the HTTP API.
+	redacted = "REDACTED"
+)
+
+// openAPIDocument is the OpenAPI description of the HTTP API, served at
+// `/openapi.json`.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// apiRoute is a single endpoint of the HTTP API. Segments of `Path` in braces
+// (e.g. `{id}`) match any value and are passed to `Handle` in order.
+type apiRoute struct {
+	Method string
+	Path   string
+	Handle func(ps *proxyServer, r *http.Request, params []string) (interface{}, error)
+}
+
+// apiRoutes are the endpoints of the HTTP API; a handler that returns `nil`
+// (and no error) responds with `204 No Content`.
+var apiRoutes = []apiRoute{
+	{Method: http.MethodGet, Path: "/openapi.json", Handle: getOpenAPI},
+	{Method: http.MethodGet, Path: "/sessions", Handle: getSessions},
+	{Method: http.MethodGet, Path: "/sessions/{id}", Handle: getSession},
+	{Method: http.MethodDelete, Path: "/sessions/{id}", Handle: deleteSession},
+	{Method: http.MethodGet, Path: "/backends", Handle: getBackends},
+	{Method: http.MethodGet, Path: "/backends/{name}", Handle: getBackend},
+	{Method: http.MethodPost, Path: "/backends/{name}/pause", Handle: pauseBackend},
+	{Method: http.MethodPost, Path: "/backends/{name}/resume", Handle: resumeBackend},
+	{Method: http.MethodPost, Path: "/backends/{name}/drain", Handle: drainBackend},
+	{Method: http.MethodGet, Path: "/latency", Handle: getLatency},
+	{Method: http.MethodGet, Path: "/statements", Handle: getStatements},
+	{Method: http.MethodDelete, Path: "/statements", Handle: deleteStatements},
+	{Method: http.MethodGet, Path: "/unparsed", Handle: getUnparsed},
+	{Method: http.MethodGet, Path: "/routes", Handle: getRoutes},
+	{Method: http.MethodPut, Path: "/routes", Handle: putRoutes},
+	{Method: http.MethodGet, Path: "/config", Handle: getConfig},
+}
+
+// apiError is the body of every HTTP API error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// serveAPI starts the HTTP API listener (in the background); errors after
+// the listener is open are logged.
+func serveAPI(ps *proxyServer, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := http.Serve(listener, ps)
+		logf("HTTP API on %s stopped; %v", addr, err)
+	}()
+	return nil
+}
+
+// ServeHTTP implements `http.Handler` for the HTTP API.
+func (ps *proxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ps.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="postgresql-schema-router"`)
+		writeAPIError(w, ErrAPIUnauthorized)
+		return
+	}
+
+	route, params, err := matchAPIRoute(r.Method, r.URL.Path)
+	if errors.Is(err, ErrAPIMethod) {
+		w.Header().Set("Allow", strings.Join(params, ", "))
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBody)
+	v, err := route.Handle(ps, r, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// authorized checks the bearer token of an HTTP API request.
+func (ps *proxyServer) authorized(r *http.Request) bool {
+	token := ps.config().API.Token
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// matchAPIRoute finds the route for a request and the values of the
+// parameters in its path. If the path matches but the method does not, the
+// returned parameters are the allowed methods instead.
+func matchAPIRoute(method, path string) (apiRoute, []string, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var allowed []string
+	for _, route := range apiRoutes {
+		params, ok := matchAPIPath(route.Path, segments)
+		if !ok {
+			continue
+		}
+		if route.Method == method {
+			return route, params, nil
+		}
+		allowed = append(allowed, route.Method)
+	}
+
+	if len(allowed) > 0 {
+		return apiRoute{}, allowed, fmt.Errorf("%w; %s %s", ErrAPIMethod, method, path)
+	}
+	return apiRoute{}, nil, fmt.Errorf("%w; %s", ErrAPINotFound, path)
+}
+
+func matchAPIPath(pattern string, segments []string) ([]string, bool) {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+	var params []string
+	for i, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			params = append(params, segments[i])
+			continue
+		}
+		if part != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// httpStatus determines the HTTP status code used when reporting an error
+// from the HTTP API.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrAPIUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrAPINotFound), errors.Is(err, ErrAdminObjectNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAPIMethod):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrInvalidConfiguration), errors.Is(err, ErrReload):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatus(err), apiError{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(v)
+	if err != nil {
+		logf("Failed to write HTTP API response; %v", err)
+	}
+}
+
+func getOpenAPI(_ *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return json.RawMessage(openAPIDocument), nil
+}
+
+func getSessions(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return ps.sessionInfos(), nil
+}
+
+func getSession(ps *proxyServer, _ *http.Request, params []string) (interface{}, error) {
+	id, err := parseSessionID(params[0])
+	if err != nil {
+		return nil, err
+	}
+	s, err := ps.Sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.info(), nil
+}
+
+func deleteSession(ps *proxyServer, r *http.Request, params []string) (interface{}, error) {
+	id, err := parseSessionID(params[0])
+	if err != nil {
+		return nil, err
+	}
+	err = ps.kill(id)
+	if err != nil {
+		return nil, err
+	}
+	logf("Session %d killed through the HTTP API from %s", id, r.RemoteAddr)
+	return nil, nil
+}
+
+func parseSessionID(value string) (uint64, error) {
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w; session %q", ErrAdminObjectNotFound, value)
+	}
+	return id, nil
+}
+
+func getBackends(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return ps.backendInfos(), nil
+}
+
+func getBackend(ps *proxyServer, _ *http.Request, params []string) (interface{}, error) {
+	bi, ok := ps.backendInfo(params[0])
+	if !ok {
+		return nil, fmt.Errorf("%w; backend %q", ErrAdminObjectNotFound, params[0])
+	}
+	return bi, nil
+}
+
+// pauseBackend holds new statements for a backend and returns immediately;
+// unlike `drainBackend`, it does not wait for the work in flight.
+func pauseBackend(ps *proxyServer, r *http.Request, params []string) (interface{}, error) {
+	_, err := ps.pause(params[0])
+	if err != nil {
+		return nil, err
+	}
+	return getBackend(ps, r, params)
+}
+
+func resumeBackend(ps *proxyServer, r *http.Request, params []string) (interface{}, error) {
+	err := ps.resume(params[0])
+	if err != nil {
+		return nil, err
+	}
+	return getBackend(ps, r, params)
+}
+
+// drainBackend pauses a backend and waits for the work in flight on it to
+// finish (like the admin console `PAUSE` command); `in_flight` in the
+// response counts what is still open when the maximum pause duration is
+// reached.
+func drainBackend(ps *proxyServer, r *http.Request, params []string) (interface{}, error) {
+	_, err := ps.drain(params[0])
+	if err != nil {
+		return nil, err
+	}
+	return getBackend(ps, r, params)
+}
+
+func getLatency(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return ps.Latency.Summaries(), nil
+}
+
+func getStatements(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return ps.Statements.Summaries(), nil
+}
+
+func deleteStatements(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	ps.Statements.Reset()
+	return nil, nil
+}
+
+func getUnparsed(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	return ps.ParseFailures.List(), nil
+}
+
+func getRoutes(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	routes := ps.config().Routes
+	if routes == nil {
+		routes = []router.Rule{}
+	}
+	return routes, nil
+}
+
+// putRoutes replaces the routing table; the resulting configuration is
+// validated (see `Config.Validate()`) before it is applied.
+func putRoutes(ps *proxyServer, r *http.Request, params []string) (interface{}, error) {
+	var routes []router.Rule
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&routes)
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to parse routes; %v", ErrInvalidConfiguration, err)
+	}
+
+	err = ps.replaceRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	logf("Routes replaced through the HTTP API from %s", r.RemoteAddr)
+	return getRoutes(ps, r, params)
+}
+
+// getConfig returns the effective configuration with passwords, the API
+// token and the tracing headers redacted.
+func getConfig(ps *proxyServer, _ *http.Request, _ []string) (interface{}, error) {
+	c := ps.config()
+	c.Backends = append([]BackendConfig(nil), c.Backends...)
+	for i := range c.Backends {
+		c.Backends[i].Password = redact(c.Backends[i].Password)
+	}
+	c.Admin.Password = redact(c.Admin.Password)
+	c.API.Token = redact(c.API.Token)
+	if c.Tracing.Headers != nil {
+		headers := map[string]string{}
+		for name, value := range c.Tracing.Headers {
+			headers[name] = redact(value)
+		}
+		c.Tracing.Headers = headers
+	}
+	return c, nil
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
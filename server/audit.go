@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// defaultAuditBackups is the number of rotated audit log files kept when
+	// `AuditConfig.MaxBackups` is not set.
+	defaultAuditBackups = 5
+	// defaultSyslogTag identifies the proxy in syslog messages.
+	defaultSyslogTag = "postgresql-schema-router"
+	// syslogPriority is the priority of audit records sent to syslog:
+	// facility `local0` (16) and severity `info` (6).
+	syslogPriority = 16*8 + 6
+)
+
+// auditRecord is a single entry in the audit log: one simple query or one
+// extended query protocol batch.
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	Session         uint64    `json:"session"`
+	User            string    `json:"user"`
+	Database        string    `json:"database"`
+	ApplicationName string    `json:"application_name,omitempty"`
+	Backends        []string  `json:"backends"`
+	SQL             string    `json:"sql"`
+	Parameters      int       `json:"parameters"`
+	Duration        Duration  `json:"duration"`
+	Rows            int64     `json:"rows"`
+	SQLState        string    `json:"sqlstate,omitempty"`
+}
+
+// auditSink is a destination for audit records, each a single line of JSON.
+type auditSink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// auditLog writes a record of every execution that passes the filters from
+// `AuditConfig` to each sink.
+type auditLog struct {
+	Mutex sync.Mutex
+	Sinks []auditSink
+}
+
+// openAuditLog opens the sinks from the audit configuration; returns `nil`
+// if no sink is configured.
+func openAuditLog(ac AuditConfig) (*auditLog, error) {
+	al := &auditLog{}
+	if ac.File != "" {
+		fs, err := openFileSink(ac.File, int64(ac.MaxSizeMB)<<20, ac.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		al.Sinks = append(al.Sinks, fs)
+	}
+	if ac.Syslog.Addr != "" {
+		al.Sinks = append(al.Sinks, newSyslogSink(ac.Syslog))
+	}
+	if len(al.Sinks) == 0 {
+		return nil, nil
+	}
+	return al, nil
+}
+
+// Record writes an audit record for an execution (if it passes the filters).
+// The filters and redaction are read from the current configuration.
+func (al *auditLog) Record(ps *proxyServer, e *execution) {
+	ac := ps.config().Audit
+	sql := e.SQL()
+	if strings.TrimSpace(sql) == "" {
+		return
+	}
+	if len(ac.Users) > 0 && !contains(ac.Users, e.Session.User) {
+		return
+	}
+
+	statements, ok := e.Parsed()
+	if ok && !auditMatches(ac, ps.router(), statements, e.Session) {
+		return
+	}
+
+	record := auditRecord{
+		Time:            e.Outcome.Started.UTC(),
+		Session:         e.SessionID,
+		User:            e.Session.User,
+		Database:        e.Session.Database,
+		ApplicationName: e.ApplicationName,
+		Backends:        e.Backends,
+		SQL:             e.Normalized(ac.RedactLiterals),
+		Parameters:      e.Parameters,
+		Duration:        e.Outcome.Latency,
+		Rows:            e.Outcome.Rows,
+		SQLState:        e.Outcome.Code,
+	}
+	if record.Backends == nil {
+		record.Backends = []string{}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		logf("Failed to encode audit record; %v", err)
+		return
+	}
+
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	for _, sink := range al.Sinks {
+		err = sink.Write(line)
+		if err != nil {
+			logf("Failed to write audit record; %v", err)
+		}
+	}
+}
+
+// Close closes every sink.
+func (al *auditLog) Close() error {
+	al.Mutex.Lock()
+	defer al.Mutex.Unlock()
+	var errs []error
+	for _, sink := range al.Sinks {
+		errs = append(errs, sink.Close())
+	}
+	return appendErrs(errs...)
+}
+
+// auditMatches applies the schema and statement type filters: at least one
+// statement must reference one of the schemas (after resolving unqualified
+// names with the session's `search_path`) and at least one statement must
+// have one of the statement types.
+func auditMatches(ac AuditConfig, r *router.Router, statements parser.Statements, s router.Session) bool {
+	schemaMatch := len(ac.Schemas) == 0
+	typeMatch := len(ac.StatementTypes) == 0
+	for _, statement := range statements {
+		a := router.Analyze(statement)
+		for _, statementType := range ac.StatementTypes {
+			if strings.EqualFold(statementType, a.Tag) || (a.DDL && strings.EqualFold(statementType, router.StatementTypeDDL)) {
+				typeMatch = true
+			}
+		}
+		for _, relation := range a.Relations {
+			resolved, _ := r.Resolve(relation, s)
+			if contains(ac.Schemas, resolved.Schema) {
+				schemaMatch = true
+			}
+		}
+	}
+	return schemaMatch && typeMatch
+}
+
+// normalizeSQL returns the normalized statements (see `router.Normalize()`);
+// SQL that could not be parsed is returned as is, unless literals must be
+// hidden.
+func normalizeSQL(sql string, statements parser.Statements, parsed, hideConstants bool) string {
+	if !parsed || len(statements) == 0 {
+		if hideConstants {
+			return router.HideLiterals(strings.TrimSpace(sql))
+		}
+		return strings.TrimSpace(sql)
+	}
+	normalized := make([]string, 0, len(statements))
+	for _, statement := range statements {
+		normalized = append(normalized, router.Normalize(statement, hideConstants))
+	}
+	return strings.Join(normalized, "; ")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSink appends audit records to a file. When the file would grow past
+// `MaxSize` (if set), it is rotated: `audit.log` is renamed to `audit.log.1`,
+// `audit.log.1` to `audit.log.2` and so on, keeping `MaxBackups` files.
+type fileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	File       *os.File
+	Size       int64
+}
+
+func openFileSink(path string, maxSize int64, maxBackups int) (*fileSink, error) {
+	if maxBackups == 0 {
+		maxBackups = defaultAuditBackups
+	}
+	fs := &fileSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	err := fs.open()
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) open() error {
+	f, err := os.OpenFile(fs.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return appendErrs(err, f.Close())
+	}
+	fs.File = f
+	fs.Size = info.Size()
+	return nil
+}
+
+// Write implements `auditSink`.
+func (fs *fileSink) Write(line []byte) error {
+	if fs.MaxSize > 0 && fs.Size > 0 && fs.Size+int64(len(line))+1 > fs.MaxSize {
+		err := fs.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := fs.File.Write(append(line, '\n'))
+	fs.Size += int64(n)
+	return err
+}
+
+func (fs *fileSink) rotate() error {
+	err := fs.File.Close()
+	if err != nil {
+		return err
+	}
+	for i := fs.MaxBackups - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", fs.Path, i), fmt.Sprintf("%s.%d", fs.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = os.Rename(fs.Path, fs.Path+".1")
+	if err != nil {
+		return err
+	}
+	return fs.open()
+}
+
+// Close implements `auditSink`.
+func (fs *fileSink) Close() error {
+	return fs.File.Close()
+}
+
+// syslogSink sends audit records to a syslog socket, e.g. `/dev/log`. The
+// connection is opened on first use and reopened after a failed write.
+type syslogSink struct {
+	Config   SyslogConfig
+	Hostname string
+	Conn     net.Conn
+}
+
+func newSyslogSink(sc SyslogConfig) *syslogSink {
+	if sc.Network == "" {
+		sc.Network = "unixgram"
+	}
+	if sc.Tag == "" {
+		sc.Tag = defaultSyslogTag
+	}
+	hostname, _ := os.Hostname()
+	return &syslogSink{Config: sc, Hostname: hostname}
+}
+
+// Write implements `auditSink`; a failed write is retried once on a new
+// connection.
+func (ss *syslogSink) Write(line []byte) error {
+	message := ss.format(line)
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if ss.Conn == nil {
+			ss.Conn, err = net.Dial(ss.Config.Network, ss.Config.Addr)
+			if err != nil {
+				continue
+			}
+		}
+		_, err = ss.Conn.Write(message)
+		if err == nil {
+			return nil
+		}
+		_ = ss.Conn.Close()
+		ss.Conn = nil
+	}
+	return err
+}
+
+// format formats a syslog message: local sockets (e.g. `/dev/log`) omit the
+// hostname, as with the C library `syslog()`.
+func (ss *syslogSink) format(line []byte) []byte {
+	now := time.Now()
+	if strings.HasPrefix(ss.Config.Network, "unix") {
+		return []byte(fmt.Sprintf(
+			"<%d>%s %s[%d]: %s\n",
+			syslogPriority, now.Format(time.Stamp), ss.Config.Tag, os.Getpid(), line,
+		))
+	}
+	return []byte(fmt.Sprintf(
+		"<%d>%s %s %s[%d]: %s\n",
+		syslogPriority, now.Format(time.RFC3339), ss.Hostname, ss.Config.Tag, os.Getpid(), line,
+	))
+}
+
+// Close implements `auditSink`.
+func (ss *syslogSink) Close() error {
+	if ss.Conn == nil {
+		return nil
+	}
+	return ss.Conn.Close()
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// lagCheckInterval is how long a replication lag measurement is trusted
+	// before it is measured again.
+	lagCheckInterval = time.Second
+	// replicaRetryInterval is how long a replica is skipped after a failed
+	// connection attempt.
+	replicaRetryInterval = 5 * time.Second
+)
+
+// backend is the runtime state for a configured backend.
+type backend struct {
+	Config   BackendConfig
+	Replicas []*replica
+	Balancer balancer
+	// Connections is the number of open connections to the primary across
+	// all sessions.
+	Connections int64
+
+	// Paused holds statements for the backend (see `PAUSE`) until it is
+	// resumed; `Resumed` is closed when it is.
+	PauseMutex sync.Mutex
+	Paused     bool
+	PausedAt   time.Time
+	Resumed    chan struct{}
+}
+
+func newBackend(bc BackendConfig) *backend {
+	b := &backend{Config: bc}
+	for _, m := range bc.Replicas {
+		weight := m.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		b.Replicas = append(b.Replicas, &replica{Addr: m.Addr, Weight: weight})
+	}
+	b.Balancer = newBalancer(bc, b.Replicas)
+	return b
+}
+
+// replica tracks the health of a single replica; it is shared by all sessions.
+type replica struct {
+	Addr        string
+	Weight      int
+	Connections int64
+	Mutex       sync.RWMutex
+	Lag         time.Duration
+	CheckedAt   time.Time
+	FailedAt    time.Time
+}
+
+// Acquire records a new connection to the replica and returns a function
+// that must be called when the connection is closed.
+func (r *replica) Acquire() func() {
+	return acquire(&r.Connections)
+}
+
+// Acquire records a new connection to the primary and returns a function
+// that must be called when the connection is closed.
+func (b *backend) Acquire() func() {
+	return acquire(&b.Connections)
+}
+
+// OpenConnections returns the number of open connections to the primary
+// across all sessions.
+func (b *backend) OpenConnections() int64 {
+	return atomic.LoadInt64(&b.Connections)
+}
+
+// Pause holds statements for the backend until `Resume()`. Returns `false`
+// if the backend was already paused.
+func (b *backend) Pause() bool {
+	b.PauseMutex.Lock()
+	defer b.PauseMutex.Unlock()
+	if b.Paused {
+		return false
+	}
+	b.Paused = true
+	b.PausedAt = time.Now()
+	b.Resumed = make(chan struct{})
+	return true
+}
+
+// Resume releases the statements held by `Pause()`. Returns `false` if the
+// backend was not paused.
+func (b *backend) Resume() bool {
+	b.PauseMutex.Lock()
+	defer b.PauseMutex.Unlock()
+	if !b.Paused {
+		return false
+	}
+	b.Paused = false
+	close(b.Resumed)
+	return true
+}
+
+// IsPaused determines if statements for the backend are being held.
+func (b *backend) IsPaused() bool {
+	b.PauseMutex.Lock()
+	defer b.PauseMutex.Unlock()
+	return b.Paused
+}
+
+// PausedFor returns how long the backend has been paused; zero if it is not
+// paused.
+func (b *backend) PausedFor() time.Duration {
+	b.PauseMutex.Lock()
+	defer b.PauseMutex.Unlock()
+	if !b.Paused {
+		return 0
+	}
+	return time.Since(b.PausedAt)
+}
+
+// WaitResumed blocks while the backend is paused. If `maxPause` is set, a
+// pause that lasts longer is an error (for every statement waiting on it,
+// and any that arrive later) rather than holding the statements further.
+func (b *backend) WaitResumed(maxPause time.Duration) error {
+	b.PauseMutex.Lock()
+	paused, resumed, deadline := b.Paused, b.Resumed, b.PausedAt.Add(maxPause)
+	b.PauseMutex.Unlock()
+	if !paused {
+		return nil
+	}
+	if maxPause == 0 {
+		<-resumed
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-resumed:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w; %s: paused for more than %s", ErrBackendPaused, b.Config.Name, maxPause)
+	}
+}
+
+// acquire increments a connection counter and returns a function that
+// decrements it (at most once).
+func acquire(counter *int64) func() {
+	atomic.AddInt64(counter, 1)
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(counter, -1)
+		})
+	}
+}
+
+// OpenConnections returns the number of open connections to the replica
+// across all sessions.
+func (r *replica) OpenConnections() int64 {
+	return atomic.LoadInt64(&r.Connections)
+}
+
+// LagKnown returns the last measured replication lag if it was measured
+// within `lagCheckInterval`.
+func (r *replica) LagKnown() (time.Duration, bool) {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	if r.CheckedAt.IsZero() || time.Since(r.CheckedAt) > lagCheckInterval {
+		return 0, false
+	}
+	return r.Lag, true
+}
+
+// SetLag records a replication lag measurement.
+func (r *replica) SetLag(lag time.Duration) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.Lag = lag
+	r.CheckedAt = time.Now()
+}
+
+// MarkFailed records a failed connection attempt.
+func (r *replica) MarkFailed() {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.FailedAt = time.Now()
+}
+
+// Available determines if the replica is healthy. A replica is excluded for
+// `replicaRetryInterval` after a failure and, if `maxLag` is set, while its
+// most recent replication lag measurement exceeds `maxLag`.
+func (r *replica) Available(maxLag time.Duration) bool {
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+	if !r.FailedAt.IsZero() && time.Since(r.FailedAt) <= replicaRetryInterval {
+		return false
+	}
+	if maxLag > 0 && !r.CheckedAt.IsZero() && time.Since(r.CheckedAt) <= lagCheckInterval {
+		return r.Lag <= maxLag
+	}
+	return true
+}
+
+// pickReplica uses the balancing strategy to choose among the healthy
+// replicas (other than those in `exclude`). Returns `nil` if no replica is
+// available.
+func (b *backend) pickReplica(bc balanceContext, exclude map[*replica]bool) *replica {
+	maxLag := time.Duration(b.Config.MaxReplicationLag)
+	var candidates []*replica
+	for _, r := range b.Replicas {
+		if !exclude[r] && r.Available(maxLag) {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return b.Balancer.Pick(candidates, bc)
+}
+
+// replica returns the replica with a given address.
+func (b *backend) replica(addr string) *replica {
+	for _, r := range b.Replicas {
+		if r.Addr == addr {
+			return r
+		}
+	}
+	return nil
+}
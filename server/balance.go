@@ -0,0 +1,153 @@
+package server
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// BalanceRoundRobin cycles through the members in order.
+	BalanceRoundRobin = "round_robin"
+	// BalanceLeastConnections chooses the member with the fewest open
+	// connections (relative to its weight).
+	BalanceLeastConnections = "least_connections"
+	// BalanceWeightedRandom chooses a member at random, in proportion to its
+	// weight.
+	BalanceWeightedRandom = "weighted_random"
+	// BalanceConsistentHash chooses a member by hashing a startup parameter
+	// (see `BackendConfig.HashKey`) onto a hash ring, so a given client
+	// always lands on the same member while it is healthy.
+	BalanceConsistentHash = "consistent_hash"
+
+	// ringPointsPerWeight is the number of points each unit of weight adds to
+	// the consistent hash ring.
+	ringPointsPerWeight = 64
+)
+
+// balanceContext is the information about a session that a balancer may use.
+type balanceContext struct {
+	Parameters map[string]string
+}
+
+// balancer chooses one member out of a set of healthy candidates. The
+// candidates are never empty.
+type balancer interface {
+	Pick(candidates []*replica, bc balanceContext) *replica
+}
+
+// newBalancer creates the balancer for a backend. This assumes the backend
+// configuration has already been validated.
+func newBalancer(bc BackendConfig, members []*replica) balancer {
+	switch bc.Balance {
+	case BalanceLeastConnections:
+		return leastConnections{}
+	case BalanceWeightedRandom:
+		return weightedRandom{}
+	case BalanceConsistentHash:
+		return newHashRing(members, bc.HashKey)
+	}
+	return &roundRobin{}
+}
+
+func isBalanceStrategy(strategy string) bool {
+	switch strategy {
+	case "", BalanceRoundRobin, BalanceLeastConnections, BalanceWeightedRandom, BalanceConsistentHash:
+		return true
+	}
+	return false
+}
+
+type roundRobin struct {
+	Next uint64
+}
+
+func (rr *roundRobin) Pick(candidates []*replica, _ balanceContext) *replica {
+	i := atomic.AddUint64(&rr.Next, 1) - 1
+	return candidates[i%uint64(len(candidates))]
+}
+
+type leastConnections struct{}
+
+func (leastConnections) Pick(candidates []*replica, _ balanceContext) *replica {
+	best := candidates[0]
+	for _, r := range candidates[1:] {
+		// NOTE: Compare `connections / weight` without division.
+		if r.OpenConnections()*int64(best.Weight) < best.OpenConnections()*int64(r.Weight) {
+			best = r
+		}
+	}
+	return best
+}
+
+type weightedRandom struct{}
+
+func (weightedRandom) Pick(candidates []*replica, _ balanceContext) *replica {
+	total := 0
+	for _, r := range candidates {
+		total += r.Weight
+	}
+
+	n := rand.Intn(total)
+	for _, r := range candidates {
+		n -= r.Weight
+		if n < 0 {
+			return r
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+type ringPoint struct {
+	Hash    uint32
+	Replica *replica
+}
+
+type hashRing struct {
+	Key    string
+	Points []ringPoint
+}
+
+func newHashRing(members []*replica, key string) *hashRing {
+	hr := &hashRing{Key: key}
+	for _, r := range members {
+		for i := 0; i < r.Weight*ringPointsPerWeight; i++ {
+			point := ringPoint{Hash: hash32(r.Addr + "#" + strconv.Itoa(i)), Replica: r}
+			hr.Points = append(hr.Points, point)
+		}
+	}
+	sort.Slice(hr.Points, func(i, j int) bool {
+		return hr.Points[i].Hash < hr.Points[j].Hash
+	})
+	return hr
+}
+
+// Pick walks the ring clockwise from the hash of the session key to the first
+// point owned by a healthy candidate; an unhealthy member only displaces the
+// sessions that hashed to it.
+func (hr *hashRing) Pick(candidates []*replica, bc balanceContext) *replica {
+	healthy := map[*replica]bool{}
+	for _, r := range candidates {
+		healthy[r] = true
+	}
+
+	h := hash32(bc.Parameters[hr.Key])
+	start := sort.Search(len(hr.Points), func(i int) bool {
+		return hr.Points[i].Hash >= h
+	})
+	for i := 0; i < len(hr.Points); i++ {
+		point := hr.Points[(start+i)%len(hr.Points)]
+		if healthy[point.Replica] {
+			return point.Replica
+		}
+	}
+	return candidates[0]
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -1,30 +1,612 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dhermes/postgresql-schema-router/router"
 )
 
 const (
 	// DefaultProxyPort is the default value for `Config.Port`.
 	DefaultProxyPort = 5397
+	// DefaultBackendName is the name of the backend created from
+	// `Config.RemoteAddr` when no `Config.Backends` are provided.
+	DefaultBackendName = "default"
 )
 
 // Config represents the values needed to configure a server.
 type Config struct {
 	// ProxyPort is the port where the proxy should expose the server
-	ProxyPort int
+	ProxyPort int `json:"port"`
 	// RemoteAddr is the address where the proxy should forward traffic. For
-	// example `localhost:22089`
-	RemoteAddr string
+	// example `localhost:22089`. This is a shorthand for a single backend
+	// (named `default`) with no replicas.
+	RemoteAddr string `json:"remote,omitempty"`
+	// Backends are the PostgreSQL clusters that own schemas.
+	Backends []BackendConfig `json:"backends,omitempty"`
+	// Routes map schemas (or schema name patterns) to the backend that owns
+	// them.
+	Routes []router.Rule `json:"routes,omitempty"`
+	// Functions map functions and procedures that are called without a
+	// schema (e.g. `SELECT charge_customer($1)`) to the backend that
+	// defines them. Schema qualified calls are routed by their schema. A
+	// function can also be marked read-only; any other function called
+	// without a schema that is not a known read-only built-in keeps a
+	// statement off the replicas.
+	Functions map[string]router.FunctionRule `json:"functions,omitempty"`
+	// DDL determines how `CREATE SCHEMA` for a schema without a route is
+	// handled: sent to the default backend or rejected.
+	DDL router.DDLRule `json:"ddl,omitempty"`
+	// Firewall rules allow or deny statements by type, referenced schema,
+	// called function, user and time; denied statements never reach a
+	// backend.
+	Firewall []router.FirewallRule `json:"firewall,omitempty"`
+	// Unparsed determines how SQL the parser does not support is handled:
+	// forwarded, rejected or routed by the schema names it mentions.
+	Unparsed UnparsedConfig `json:"unparsed,omitempty"`
+	// Catalog determines how queries that only reference system catalogs
+	// (e.g. from `psql` meta-commands) are routed.
+	Catalog router.CatalogRule `json:"catalog,omitempty"`
+	// Hints configures routing hints in SQL comments, e.g.
+	// `/* route: backend=billing */`.
+	Hints HintConfig `json:"hints,omitempty"`
+	// FanOut configures sending read-only queries to every backend and
+	// merging the results. A fan-out can also be requested per query with a
+	// `/* route: fan_out */` comment.
+	FanOut FanOutConfig `json:"fan_out,omitempty"`
+	// Mirroring configures replaying statements on shadow backends (see
+	// the `mirror` of a route).
+	Mirroring MirrorConfig `json:"mirroring,omitempty"`
+	// Migration configures who may cut over schemas that are being moved
+	// between backends (see the `migrate_to` of a route).
+	Migration MigrationConfig `json:"migration,omitempty"`
+	// Audit configures the audit log, a record of every statement executed
+	// through the proxy.
+	Audit AuditConfig `json:"audit,omitempty"`
+	// SlowQueries configures logging statements that take longer than a
+	// threshold.
+	SlowQueries SlowQueryConfig `json:"slow_queries,omitempty"`
+	// Allowlist configures learning the statements each user and
+	// application runs and then rejecting any others.
+	Allowlist AllowlistConfig `json:"allowlist,omitempty"`
+	// Tracing configures exporting OpenTelemetry spans for sessions and
+	// statements.
+	Tracing TracingConfig `json:"tracing,omitempty"`
+	// Pause configures how statements are held while a backend is paused
+	// (see the admin console `PAUSE` command).
+	Pause PauseConfig `json:"pause,omitempty"`
+	// Admin configures the admin console, a virtual database on the proxy
+	// listener (e.g. `psql -d router`).
+	Admin AdminConfig `json:"admin,omitempty"`
+	// API configures the HTTP (JSON) admin API, a separate listener for
+	// automation.
+	API APIConfig `json:"api,omitempty"`
+	// ConnectionRoutes choose a backend for each client connection from its
+	// startup parameters (e.g. `user` or `application_name`); it replaces
+	// `DefaultBackend` for that connection. Routes still apply per
+	// statement.
+	ConnectionRoutes []router.ConnectionRule `json:"connection_routes,omitempty"`
+	// Lookups are tables, referenced by routes, that map a key captured from
+	// a schema name (e.g. a tenant ID) to a backend.
+	Lookups []LookupConfig `json:"lookups,omitempty"`
+	// DefaultBackend is the backend used for relations in schemas without a
+	// route and for the initial (startup) connection from each client. It
+	// is optional when there is exactly one backend.
+	DefaultBackend string `json:"default_backend,omitempty"`
+	// Path is the file the configuration was loaded from (if any); the
+	// admin console `RELOAD` command reads it again.
+	Path string `json:"-"`
+}
+
+// BackendConfig describes a single PostgreSQL cluster: a primary and zero or
+// more read replicas.
+type BackendConfig struct {
+	Name string `json:"name"`
+	// Primary is the address of the primary, e.g. `localhost:22089`.
+	Primary string `json:"primary"`
+	// Replicas are the read replicas (hot standbys).
+	Replicas []Member `json:"replicas,omitempty"`
+	// Balance is the strategy used to choose among the replicas; one of
+	// `round_robin` (the default), `least_connections`, `weighted_random`
+	// or `consistent_hash`.
+	Balance string `json:"balance,omitempty"`
+	// HashKey is the startup parameter (e.g. `user` or `application_name`)
+	// used by the `consistent_hash` strategy.
+	HashKey string `json:"hash_key,omitempty"`
+	// MaxReplicationLag is the largest replication lag (as reported by
+	// `pg_last_xact_replay_timestamp()`) that a replica can have before
+	// read-only statements are sent to the primary instead. A zero value
+	// disables the check.
+	MaxReplicationLag Duration `json:"max_replication_lag,omitempty"`
+	// User is used when the proxy opens additional connections to this
+	// backend (i.e. anything other than the client's startup connection).
+	// If empty, the user from the client's startup message is used.
+	User string `json:"user,omitempty"`
+	// Password is used to respond to password authentication requests for
+	// additional connections to this backend.
+	Password string `json:"password,omitempty"`
+	// Database overrides the database from the client's startup message for
+	// additional connections to this backend.
+	Database string `json:"database,omitempty"`
+}
+
+// HintConfig controls which clients may use routing hints.
+type HintConfig struct {
+	// Disabled ignores routing hints entirely (they are treated as ordinary
+	// comments).
+	Disabled bool `json:"disabled,omitempty"`
+	// Users restricts routing hints to these users; a hint from any other
+	// user is rejected. If empty, every user may use hints.
+	Users []string `json:"users,omitempty"`
+}
+
+// FanOutConfig describes when queries are sent to every backend.
+type FanOutConfig struct {
+	// Users are dedicated users (e.g. for reporting) whose read-only queries
+	// are always sent to every backend.
+	Users []string `json:"users,omitempty"`
+	// BackendColumn adds a `backend` column (first) to every fan-out result;
+	// it can also be requested per query with a `backend_column` hint.
+	BackendColumn bool `json:"backend_column,omitempty"`
+}
+
+// MirrorConfig describes how the outcomes of mirrored statements are
+// recorded.
+type MirrorConfig struct {
+	// Log is a file where each comparison of a statement on the owning
+	// backend and the shadow backend is appended as a JSON line.
+	Log string `json:"log,omitempty"`
+	// Queue is the number of statements (per session) that may be waiting
+	// to be replayed on a shadow backend; further statements are dropped
+	// rather than delaying the client. Defaults to 100.
+	Queue int `json:"queue,omitempty"`
+}
+
+// MigrationConfig controls the `CUTOVER` commands for migrating schemas.
+type MigrationConfig struct {
+	// Users may run `CUTOVER schema` and `REVERT CUTOVER schema`. If empty,
+	// no user may.
+	Users []string `json:"users,omitempty"`
+}
+
+// AuditConfig describes where audit records are written and which
+// statements are recorded. The sinks (`File` and `Syslog`) cannot be changed
+// by `RELOAD`; the filters and `RedactLiterals` can.
+type AuditConfig struct {
+	// File is a file where each record is appended as a JSON line.
+	File string `json:"file,omitempty"`
+	// MaxSizeMB is the size (in megabytes) at which `File` is rotated; a
+	// zero value never rotates it.
+	MaxSizeMB int `json:"max_size_mb,omitempty"`
+	// MaxBackups is the number of rotated files kept (`audit.log.1`,
+	// `audit.log.2`, ...). Defaults to 5.
+	MaxBackups int `json:"max_backups,omitempty"`
+	// Syslog sends each record to a syslog socket.
+	Syslog SyslogConfig `json:"syslog,omitempty"`
+	// RedactLiterals replaces the literals in recorded SQL with `_`.
+	RedactLiterals bool `json:"redact_literals,omitempty"`
+	// Users restricts the audit log to statements from these users.
+	Users []string `json:"users,omitempty"`
+	// Schemas restricts the audit log to statements that reference one of
+	// these schemas.
+	Schemas []string `json:"schemas,omitempty"`
+	// StatementTypes restricts the audit log to statements with one of these
+	// tags (e.g. `INSERT` or `DROP TABLE`); `DDL` matches any statement that
+	// changes the schema.
+	StatementTypes []string `json:"statement_types,omitempty"`
+}
+
+// SyslogConfig describes a syslog socket.
+type SyslogConfig struct {
+	// Network is one of `unixgram` (the default), `unix`, `udp` or `tcp`.
+	Network string `json:"network,omitempty"`
+	// Addr is the socket path (e.g. `/dev/log`) or `host:port`.
+	Addr string `json:"addr,omitempty"`
+	// Tag identifies the proxy in each message; defaults to
+	// `postgresql-schema-router`.
+	Tag string `json:"tag,omitempty"`
+}
+
+// SlowQueryConfig describes which statements are logged as slow.
+type SlowQueryConfig struct {
+	// Threshold is the duration (measured at the proxy, from the `Query` or
+	// `Execute` until the `ReadyForQuery`) above which a statement is
+	// logged. A zero value disables the slow query log.
+	Threshold Duration `json:"threshold,omitempty"`
+}
+
+// AllowlistConfig describes how statement fingerprints are learned and
+// enforced. `RELOAD` reads the file again (or opens a new one, if `File`
+// changed) and applies a new mode and filters.
+type AllowlistConfig struct {
+	// Mode is one of `learn` (add the fingerprint of every statement to the
+	// allowlist), `log` (log statements that are not on the allowlist) or
+	// `enforce` (also reject them). If empty, the allowlist is not used.
+	Mode string `json:"mode,omitempty"`
+	// File is where the allowlist is persisted (as JSON).
+	File string `json:"file,omitempty"`
+	// Users and Applications restrict the allowlist to sessions with a
+	// matching user and `application_name` (glob patterns, see
+	// `path.Match`).
+	Users        []string `json:"users,omitempty"`
+	Applications []string `json:"applications,omitempty"`
+}
+
+// UnparsedConfig describes how SQL the parser does not support is handled.
+// Unless it is rejected, a `backend` or `schema` routing hint takes
+// precedence over the policy.
+type UnparsedConfig struct {
+	// Policy is one of `forward` (the default: send the SQL to `Backend`),
+	// `reject` (fail with SQLSTATE `42601`) or `tokenize` (route by the
+	// qualified names, e.g. `billing.invoices`, found by a tokenizer; SQL
+	// without one is forwarded).
+	Policy string `json:"policy,omitempty"`
+	// Backend receives forwarded SQL; defaults to the backend the session
+	// last used (or its default backend).
+	Backend string `json:"backend,omitempty"`
+}
+
+// TracingConfig describes where OpenTelemetry spans are exported. It cannot
+// be changed by `RELOAD`.
+type TracingConfig struct {
+	// Endpoint is the URL spans are sent to with OTLP over HTTP (JSON
+	// encoding), e.g. `http://localhost:4318/v1/traces`. If empty, tracing
+	// is disabled.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export request (e.g. for authentication).
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the `service.name` of the proxy; defaults to
+	// `postgresql-schema-router`.
+	ServiceName string `json:"service_name,omitempty"`
+	// FlushInterval is how often finished spans are exported. Defaults to 5
+	// seconds.
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+}
+
+// PauseConfig limits how long statements are held for a paused backend.
+type PauseConfig struct {
+	// MaxDuration is the longest a backend can be paused before the
+	// statements held for it fail with a retryable error (SQLSTATE `57P03`).
+	// A zero value holds statements until the backend is resumed.
+	MaxDuration Duration `json:"max_duration,omitempty"`
+}
+
+// AdminConfig describes who may connect to the admin console.
+type AdminConfig struct {
+	// Database is the name of the virtual database; if empty, the admin
+	// console is disabled.
+	Database string `json:"database,omitempty"`
+	// Users may connect to the admin console.
+	Users []string `json:"users,omitempty"`
+	// Password is required (via MD5 password authentication) to connect to
+	// the admin console.
+	Password string `json:"password,omitempty"`
+}
+
+// APIConfig describes the HTTP admin API listener.
+type APIConfig struct {
+	// Addr is the address the HTTP API listens on, e.g. `localhost:5398`;
+	// if empty, the HTTP API is disabled. It cannot be changed by `RELOAD`.
+	Addr string `json:"addr,omitempty"`
+	// Token is required (as `Authorization: Bearer <token>`) on every HTTP
+	// API request.
+	Token string `json:"token,omitempty"`
+}
+
+// LookupConfig describes where the entries of a lookup table are loaded from:
+// either a CSV file or a "directory" table in PostgreSQL. Either way, the
+// entries have two columns: the key and the backend.
+type LookupConfig struct {
+	Name string `json:"name"`
+	// CSV is the path to a CSV file.
+	CSV string `json:"csv,omitempty"`
+	// Backend is the backend whose primary holds the directory table; the
+	// connection uses the `user` / `password` from the backend configuration.
+	Backend string `json:"backend,omitempty"`
+	// Query selects the entries from the directory table, e.g.
+	// `SELECT tenant_id, backend FROM directory.tenants`.
+	Query string `json:"query,omitempty"`
+	// Refresh is how often the entries are reloaded; a zero value loads the
+	// entries once at startup.
+	Refresh Duration `json:"refresh,omitempty"`
+}
+
+// Member is a single server in a group of interchangeable servers. In JSON it
+// can be given either as an address string or as an object with an address
+// and a weight.
+type Member struct {
+	Addr string `json:"addr"`
+	// Weight is the relative share of connections this member receives; a
+	// zero value is treated as 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (m *Member) UnmarshalJSON(data []byte) error {
+	var addr string
+	if json.Unmarshal(data, &addr) == nil {
+		*m = Member{Addr: addr}
+		return nil
+	}
+
+	type member Member
+	parsed := member{}
+	err := json.Unmarshal(data, &parsed)
+	if err != nil {
+		return err
+	}
+	*m = Member(parsed)
+	return nil
+}
+
+// LoadConfig reads a JSON configuration file.
+func LoadConfig(filename string) (Config, error) {
+	c := Config{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(data, &c)
+	if err != nil {
+		return c, fmt.Errorf("%w, failed to parse %s; %v", ErrInvalidConfiguration, filename, err)
+	}
+	c.Path = filename
+
+	return c, nil
 }
 
 func (c Config) Validate() error {
 	if c.ProxyPort == 0 {
 		return fmt.Errorf("%w, ProxyPort is required", ErrInvalidConfiguration)
 	}
-	if c.RemoteAddr == "" {
+	if c.RemoteAddr == "" && len(c.Backends) == 0 {
 		// TODO: Validate it's of the form `host:port` as well
-		return fmt.Errorf("%w, RemoteAddr is required", ErrInvalidConfiguration)
+		return fmt.Errorf("%w, RemoteAddr or Backends is required", ErrInvalidConfiguration)
+	}
+	if c.RemoteAddr != "" && len(c.Backends) > 0 {
+		return fmt.Errorf("%w, RemoteAddr and Backends cannot both be set", ErrInvalidConfiguration)
+	}
+
+	names := map[string]bool{}
+	for _, bc := range c.BackendConfigs() {
+		if bc.Name == "" {
+			return fmt.Errorf("%w, backend name is required", ErrInvalidConfiguration)
+		}
+		if names[bc.Name] {
+			return fmt.Errorf("%w, backend %q is defined more than once", ErrInvalidConfiguration, bc.Name)
+		}
+		names[bc.Name] = true
+		if bc.Primary == "" {
+			return fmt.Errorf("%w, backend %q requires a primary", ErrInvalidConfiguration, bc.Name)
+		}
+		if bc.MaxReplicationLag < 0 {
+			return fmt.Errorf("%w, backend %q has a negative max replication lag", ErrInvalidConfiguration, bc.Name)
+		}
+		if !isBalanceStrategy(bc.Balance) {
+			return fmt.Errorf("%w, backend %q has unknown balance strategy %q", ErrInvalidConfiguration, bc.Name, bc.Balance)
+		}
+		if bc.Balance == BalanceConsistentHash && bc.HashKey == "" {
+			return fmt.Errorf("%w, backend %q requires a hash key for consistent hashing", ErrInvalidConfiguration, bc.Name)
+		}
+		for _, m := range bc.Replicas {
+			if m.Addr == "" {
+				return fmt.Errorf("%w, backend %q has a replica without an address", ErrInvalidConfiguration, bc.Name)
+			}
+			if m.Weight < 0 {
+				return fmt.Errorf("%w, replica %s of backend %q has a negative weight", ErrInvalidConfiguration, m.Addr, bc.Name)
+			}
+		}
+	}
+
+	defaultBackend := c.DefaultBackendName()
+	if defaultBackend == "" {
+		return fmt.Errorf("%w, DefaultBackend is required with multiple backends", ErrInvalidConfiguration)
+	}
+	if !names[defaultBackend] {
+		return fmt.Errorf("%w, DefaultBackend %q is not a backend", ErrInvalidConfiguration, defaultBackend)
+	}
+
+	err := c.Catalog.Validate()
+	if err != nil {
+		return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+	}
+	if c.Catalog.Backend != "" && !names[c.Catalog.Backend] {
+		return fmt.Errorf("%w, catalog uses unknown backend %q", ErrInvalidConfiguration, c.Catalog.Backend)
+	}
+
+	switch c.Unparsed.Policy {
+	case "", unparsedForward, unparsedReject, unparsedTokenize:
+	default:
+		return fmt.Errorf("%w, unparsed has unknown policy %q", ErrInvalidConfiguration, c.Unparsed.Policy)
+	}
+	if c.Unparsed.Backend != "" && !names[c.Unparsed.Backend] {
+		return fmt.Errorf("%w, unparsed uses unknown backend %q", ErrInvalidConfiguration, c.Unparsed.Backend)
+	}
+
+	err = c.DDL.Validate()
+	if err != nil {
+		return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+	}
+
+	if c.Admin.Database != "" && (len(c.Admin.Users) == 0 || c.Admin.Password == "") {
+		return fmt.Errorf("%w, admin console requires users and a password", ErrInvalidConfiguration)
+	}
+
+	if c.API.Addr != "" && c.API.Token == "" {
+		return fmt.Errorf("%w, HTTP API requires a token", ErrInvalidConfiguration)
+	}
+
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxBackups < 0 {
+		return fmt.Errorf("%w, audit max_size_mb and max_backups must not be negative", ErrInvalidConfiguration)
+	}
+	switch c.Audit.Syslog.Network {
+	case "", "unixgram", "unix", "udp", "tcp":
+	default:
+		return fmt.Errorf("%w, audit syslog has unknown network %q", ErrInvalidConfiguration, c.Audit.Syslog.Network)
+	}
+
+	if c.SlowQueries.Threshold < 0 {
+		return fmt.Errorf("%w, slow_queries threshold must not be negative", ErrInvalidConfiguration)
+	}
+
+	switch c.Allowlist.Mode {
+	case "", allowlistLearn, allowlistLog, allowlistEnforce:
+	default:
+		return fmt.Errorf("%w, allowlist has unknown mode %q", ErrInvalidConfiguration, c.Allowlist.Mode)
+	}
+	if c.Allowlist.Mode != "" && c.Allowlist.File == "" {
+		return fmt.Errorf("%w, allowlist requires a file", ErrInvalidConfiguration)
+	}
+	for _, pattern := range append(append([]string(nil), c.Allowlist.Users...), c.Allowlist.Applications...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("%w, allowlist has an invalid pattern %q", ErrInvalidConfiguration, pattern)
+		}
+	}
+
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w, tracing endpoint must be an HTTP URL; %q", ErrInvalidConfiguration, c.Tracing.Endpoint)
+		}
+	}
+	if c.Tracing.FlushInterval < 0 {
+		return fmt.Errorf("%w, tracing flush_interval must not be negative", ErrInvalidConfiguration)
+	}
+
+	if c.Pause.MaxDuration < 0 {
+		return fmt.Errorf("%w, pause max_duration must not be negative", ErrInvalidConfiguration)
+	}
+
+	if c.Mirroring.Queue < 0 {
+		return fmt.Errorf("%w, mirroring queue must not be negative", ErrInvalidConfiguration)
+	}
+
+	for name, fr := range c.Functions {
+		err := fr.Validate(name)
+		if err != nil {
+			return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+		}
+		if fr.Backend != "" && !names[fr.Backend] {
+			return fmt.Errorf("%w, function %q uses unknown backend %q", ErrInvalidConfiguration, name, fr.Backend)
+		}
+	}
+
+	for _, fr := range c.Firewall {
+		err := fr.Validate()
+		if err != nil {
+			return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+		}
 	}
+
+	for _, cr := range c.ConnectionRoutes {
+		err := cr.Validate()
+		if err != nil {
+			return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+		}
+		if !names[cr.Backend] {
+			return fmt.Errorf("%w, connection route %s uses unknown backend %q", ErrInvalidConfiguration, cr, cr.Backend)
+		}
+	}
+
+	lookups := map[string]bool{}
+	for _, lc := range c.Lookups {
+		if lc.Name == "" {
+			return fmt.Errorf("%w, lookup name is required", ErrInvalidConfiguration)
+		}
+		if lookups[lc.Name] {
+			return fmt.Errorf("%w, lookup %q is defined more than once", ErrInvalidConfiguration, lc.Name)
+		}
+		lookups[lc.Name] = true
+		if (lc.CSV == "") == (lc.Query == "") {
+			return fmt.Errorf("%w, lookup %q requires exactly one of csv or query", ErrInvalidConfiguration, lc.Name)
+		}
+		if lc.Query != "" && !names[lc.Backend] {
+			return fmt.Errorf("%w, lookup %q uses unknown backend %q", ErrInvalidConfiguration, lc.Name, lc.Backend)
+		}
+		if lc.Refresh < 0 {
+			return fmt.Errorf("%w, lookup %q has a negative refresh interval", ErrInvalidConfiguration, lc.Name)
+		}
+	}
+
+	for _, rule := range c.Routes {
+		err := rule.Validate()
+		if err != nil {
+			return fmt.Errorf("%w; %v", ErrInvalidConfiguration, err)
+		}
+		for _, backend := range rule.Backends() {
+			if !names[backend] {
+				return fmt.Errorf("%w, route for %q uses unknown backend %q", ErrInvalidConfiguration, rule.Name(), backend)
+			}
+		}
+		if rule.Lookup != "" && !lookups[rule.Lookup] {
+			return fmt.Errorf("%w, route for %q uses unknown lookup %q", ErrInvalidConfiguration, rule.Name(), rule.Lookup)
+		}
+	}
+
+	return nil
+}
+
+// BackendConfigs returns the configured backends; if only `RemoteAddr` is
+// set, this will be a single backend named `default`.
+func (c Config) BackendConfigs() []BackendConfig {
+	if len(c.Backends) > 0 || c.RemoteAddr == "" {
+		return c.Backends
+	}
+	return []BackendConfig{{Name: DefaultBackendName, Primary: c.RemoteAddr}}
+}
+
+// BackendNames returns the names of the configured backends.
+func (c Config) BackendNames() []string {
+	backends := c.BackendConfigs()
+	names := make([]string, 0, len(backends))
+	for _, bc := range backends {
+		names = append(names, bc.Name)
+	}
+	return names
+}
+
+// DefaultBackendName returns the name of the default backend, accounting for
+// the case where there is exactly one backend.
+func (c Config) DefaultBackendName() string {
+	if c.DefaultBackend != "" {
+		return c.DefaultBackend
+	}
+	backends := c.BackendConfigs()
+	if len(backends) == 1 {
+		return backends[0].Name
+	}
+	return ""
+}
+
+// Duration is a `time.Duration` that is represented in JSON as a string
+// such as `"1.5s"`.
+type Duration time.Duration
+
+// MarshalJSON implements `json.Marshaler`.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements `json.Unmarshaler`.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
 	return nil
 }
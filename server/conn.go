@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+)
+
+// messageHandler is invoked for each message received from a server.
+type messageHandler func(chunk []byte) error
+
+// cycle is a single request / response cycle with a server, i.e. everything
+// up to and including the next `ReadyForQuery`.
+type cycle struct {
+	// Handle receives every message in the cycle. If `nil`, messages are
+	// passed to the default handler for the connection (i.e. forwarded to
+	// the client).
+	Handle messageHandler
+	Done   chan struct{}
+}
+
+func newCycle(handle messageHandler) *cycle {
+	return &cycle{Handle: handle, Done: make(chan struct{})}
+}
+
+// serverConn is a connection from the proxy to a PostgreSQL server.
+type serverConn struct {
+	Backend string
+	Addr    string
+	Replica bool
+	Conn    net.Conn
+	Reader  *bufio.Reader
+	KeyData *pgproto3.BackendKeyData
+	// Release is invoked (at most once) when the connection is closed.
+	Release func()
+
+	WriteMutex sync.Mutex
+	Mutex      sync.Mutex
+	Idle       *sync.Cond
+	Cycles     []*cycle
+	TxStatus   byte
+	Err        error
+}
+
+func dialServer(backend, addr string, isReplica bool) (*serverConn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &serverConn{
+		Backend:  backend,
+		Addr:     addr,
+		Replica:  isReplica,
+		Conn:     conn,
+		Reader:   bufio.NewReader(conn),
+		Release:  func() {},
+		TxStatus: 'I',
+	}
+	sc.Idle = sync.NewCond(&sc.Mutex)
+	return sc, nil
+}
+
+// Startup sends a `StartupMessage`, authenticates and then waits for the
+// server to be ready for queries. This is used for all connections other than
+// the client's startup connection (which relays authentication to the
+// client).
+func (sc *serverConn) Startup(parameters map[string]string, password string) error {
+	sm := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      parameters,
+	}
+	_, err := sc.Conn.Write(sm.Encode(nil))
+	if err != nil {
+		return err
+	}
+
+	err = postgres.Authenticate(sc.Reader, sc.Conn, parameters["user"], password)
+	if err != nil {
+		return err
+	}
+
+	for {
+		chunk, err := postgres.ReadMessage(sc.Reader)
+		if err != nil {
+			return err
+		}
+		bm, err := postgres.ParseBackendChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		switch m := bm.(type) {
+		case *pgproto3.BackendKeyData:
+			sc.KeyData = m
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("%w; %s (SQLSTATE %s)", postgres.ErrAuthentication, m.Message, m.Code)
+		case *pgproto3.ReadyForQuery:
+			sc.TxStatus = m.TxStatus
+			return nil
+		}
+	}
+}
+
+// Start begins reading messages from the server in a goroutine. Messages that
+// are not part of a cycle with a custom handler are passed to `handle`. When
+// the connection fails or is closed, `onClose` is invoked; `pending`
+// indicates if any cycles were still outstanding.
+func (sc *serverConn) Start(handle messageHandler, onClose func(err error, pending bool)) {
+	go func() {
+		for {
+			chunk, err := postgres.ReadMessage(sc.Reader)
+			if err != nil {
+				pending := sc.fail(err)
+				onClose(err, pending)
+				return
+			}
+			sc.dispatch(chunk, handle)
+		}
+	}()
+}
+
+func (sc *serverConn) dispatch(chunk []byte, handle messageHandler) {
+	sc.Mutex.Lock()
+	var head *cycle
+	if len(sc.Cycles) > 0 {
+		head = sc.Cycles[0]
+	}
+	sc.Mutex.Unlock()
+
+	if head != nil && head.Handle != nil {
+		handle = head.Handle
+	}
+	err := handle(chunk)
+	if err != nil {
+		sc.fail(err)
+	}
+
+	if chunk[0] != 'Z' || len(chunk) < 6 {
+		return
+	}
+
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	sc.TxStatus = chunk[5]
+	// NOTE: If the connection failed while handling this message, the cycle
+	//       has already been completed by `fail()`.
+	if head != nil && len(sc.Cycles) > 0 && sc.Cycles[0] == head {
+		sc.Cycles = sc.Cycles[1:]
+		close(head.Done)
+	}
+	sc.Idle.Broadcast()
+}
+
+// fail marks the connection as failed and completes every outstanding cycle.
+// Returns `true` if any cycles were outstanding.
+func (sc *serverConn) fail(err error) bool {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	if sc.Err == nil {
+		sc.Err = err
+	}
+	pending := len(sc.Cycles) > 0
+	for _, c := range sc.Cycles {
+		close(c.Done)
+	}
+	sc.Cycles = nil
+	sc.Idle.Broadcast()
+	return pending
+}
+
+// Send writes a message to the server. If `c` is not `nil`, it is registered
+// as the cycle that will receive the responses.
+func (sc *serverConn) Send(chunk []byte, c *cycle) error {
+	sc.WriteMutex.Lock()
+	defer sc.WriteMutex.Unlock()
+
+	if c != nil {
+		sc.Mutex.Lock()
+		if sc.Err != nil {
+			sc.Mutex.Unlock()
+			return sc.Err
+		}
+		sc.Cycles = append(sc.Cycles, c)
+		sc.Mutex.Unlock()
+	}
+
+	_, err := sc.Conn.Write(chunk)
+	return err
+}
+
+// WaitIdle blocks until every outstanding cycle has completed.
+func (sc *serverConn) WaitIdle() {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	for len(sc.Cycles) > 0 && sc.Err == nil {
+		sc.Idle.Wait()
+	}
+}
+
+// Status returns the transaction status from the most recent
+// `ReadyForQuery`.
+func (sc *serverConn) Status() byte {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	return sc.TxStatus
+}
+
+// Broken determines if the connection has failed.
+func (sc *serverConn) Broken() bool {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	return sc.Err != nil
+}
+
+// Query runs a simple query on behalf of the proxy (rather than the client)
+// and collects the results. This should only be called when the connection
+// is idle.
+func (sc *serverConn) Query(sql string) (*result, error) {
+	r := &result{}
+	c := newCycle(r.Collect)
+	q := &pgproto3.Query{String: sql}
+	err := sc.Send(q.Encode(nil), c)
+	if err != nil {
+		return nil, err
+	}
+
+	<-c.Done
+	if sc.Broken() {
+		return nil, sc.Err
+	}
+	if r.Err != nil {
+		return r, fmt.Errorf("%s (SQLSTATE %s)", r.Err.Message, r.Err.Code)
+	}
+	return r, nil
+}
+
+// Busy determines if any cycle is outstanding.
+func (sc *serverConn) Busy() bool {
+	sc.Mutex.Lock()
+	defer sc.Mutex.Unlock()
+	return len(sc.Cycles) > 0
+}
+
+// Cancel asks the server (over a new connection) to cancel the query that is
+// currently running on this connection.
+func (sc *serverConn) Cancel() (err error) {
+	conn, err := net.Dial("tcp", sc.Addr)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = appendErrs(err, conn.Close())
+	}()
+
+	cr := &pgproto3.CancelRequest{ProcessID: sc.KeyData.ProcessID, SecretKey: sc.KeyData.SecretKey}
+	_, err = conn.Write(cr.Encode(nil))
+	return
+}
+
+// Close sends a `Terminate` message (on a best effort basis) and closes the
+// connection.
+func (sc *serverConn) Close() error {
+	sc.Release()
+	sc.WriteMutex.Lock()
+	_, _ = sc.Conn.Write((&pgproto3.Terminate{}).Encode(nil))
+	sc.WriteMutex.Unlock()
+	return sc.Conn.Close()
+}
+
+// result collects the messages from a proxy-initiated query.
+type result struct {
+	Fields []pgproto3.FieldDescription
+	Rows   [][][]byte
+	Tags   []string
+	Err    *pgproto3.ErrorResponse
+}
+
+// Collect is a `messageHandler` that accumulates a result.
+func (r *result) Collect(chunk []byte) error {
+	bm, err := postgres.ParseBackendChunk(chunk)
+	if err != nil {
+		return err
+	}
+
+	switch m := bm.(type) {
+	case *pgproto3.RowDescription:
+		r.Fields = m.Fields
+	case *pgproto3.DataRow:
+		r.Rows = append(r.Rows, m.Values)
+	case *pgproto3.CommandComplete:
+		r.Tags = append(r.Tags, string(m.CommandTag))
+	case *pgproto3.ErrorResponse:
+		r.Err = m
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"net"
 
 	multierror "github.com/hashicorp/go-multierror"
+
+	"github.com/dhermes/postgresql-schema-router/router"
 )
 
 var (
@@ -14,6 +16,74 @@ var (
 	// ErrPacketTooLarge is the error returned when a TCP packet from a read
 	// is too large.
 	ErrPacketTooLarge = errors.New("packet too large")
+	// ErrUnexpectedMessage is the error returned when a client sends a
+	// message that is not valid at the current point in the protocol.
+	ErrUnexpectedMessage = errors.New("unexpected message")
+	// ErrBackendUnavailable is the error returned when a connection to a
+	// backend cannot be established.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrBackendPaused is the error returned when a statement was held for a
+	// paused backend longer than the maximum pause duration; the client
+	// should retry.
+	ErrBackendPaused = errors.New("backend is paused")
+	// ErrCrossBackendTransaction is the error returned when a statement in an
+	// open transaction must be sent to a different backend than the one
+	// where the transaction was started.
+	ErrCrossBackendTransaction = errors.New("transaction cannot span multiple backends")
+	// ErrCrossBackendBatch is the error returned when messages in a single
+	// extended query protocol batch (i.e. between two `Sync` messages) must be
+	// sent to different backends.
+	ErrCrossBackendBatch = errors.New("extended query batch cannot span multiple backends")
+	// ErrIncompatibleResults is the error returned when a query sent to
+	// multiple backends returns results that cannot be merged.
+	ErrIncompatibleResults = errors.New("results from multiple backends cannot be merged")
+	// ErrFanOutNotSupported is the error returned when a fan-out is requested
+	// for statements that cannot be sent to every backend.
+	ErrFanOutNotSupported = errors.New("fan-out requires a single read-only statement outside of a transaction")
+	// ErrHintNotAllowed is the error returned when a user that is not
+	// allowed to use routing hints sends a statement with a hint.
+	ErrHintNotAllowed = errors.New("routing hints are not allowed for this user")
+	// ErrCutOverNotAllowed is the error returned when a user that is not
+	// allowed to cut over migrations sends a `CUTOVER` command.
+	ErrCutOverNotAllowed = errors.New("cutting over migrations is not allowed for this user")
+
+	// ErrAdminAuthentication is the error returned when a client fails to
+	// authenticate to the admin console.
+	ErrAdminAuthentication = errors.New("admin console authentication failed")
+	// ErrAdminCommand is the error returned when the admin console receives
+	// a command it does not support.
+	ErrAdminCommand = errors.New("unsupported admin command")
+	// ErrAdminObjectNotFound is the error returned when an admin command
+	// names a backend or session that does not exist.
+	ErrAdminObjectNotFound = errors.New("no such backend or session")
+	// ErrSessionKilled is the error sent to a client whose session is ended
+	// by the admin console `KILL` command.
+	ErrSessionKilled = errors.New("terminating connection due to administrator command")
+	// ErrReload is the error returned when the configuration cannot be
+	// reloaded.
+	ErrReload = errors.New("configuration cannot be reloaded")
+	// ErrAPIUnauthorized is the error returned when an HTTP API request does
+	// not have the configured bearer token.
+	ErrAPIUnauthorized = errors.New("missing or invalid API token")
+	// ErrAPINotFound is the error returned when an HTTP API request is for
+	// an unknown path.
+	ErrAPINotFound = errors.New("no such API endpoint")
+	// ErrAPIMethod is the error returned when an HTTP API request uses a
+	// method that is not supported for its path.
+	ErrAPIMethod = errors.New("method not allowed")
+	// ErrNotAllowlisted is the error returned when the allowlist is enforced
+	// and a statement is not on it.
+	ErrNotAllowlisted = errors.New("statement is not on the allowlist")
+	// ErrUnparsedSQL is the error returned when the parser does not support
+	// a statement and the `unparsed` policy is `reject`.
+	ErrUnparsedSQL = errors.New("statement could not be parsed by the proxy")
+	// ErrTraceExport is the error logged when the tracing endpoint rejects
+	// exported spans.
+	ErrTraceExport = errors.New("failed to export spans")
+
+	// errFanOutResponse indicates a backend taking part in a fan-out returned
+	// an error response (which is relayed to the client).
+	errFanOutResponse = errors.New("fan-out backend returned an error")
 )
 
 func appendErrs(errs ...error) error {
@@ -27,11 +97,62 @@ func appendErrs(errs ...error) error {
 	return combined
 }
 
-func isTimeout(err error) bool {
-	noe, ok := err.(*net.OpError)
-	if !ok {
-		return false
-	}
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
 
-	return noe.Timeout()
+// sqlState determines the SQLSTATE code used when reporting an error from the
+// proxy to a client.
+func sqlState(err error) string {
+	switch {
+	case errors.Is(err, ErrBackendUnavailable):
+		// connection_exception
+		return "08000"
+	case errors.Is(err, ErrBackendPaused):
+		// cannot_connect_now
+		return "57P03"
+	case errors.Is(err, router.ErrCrossBackend),
+		errors.Is(err, ErrCrossBackendTransaction),
+		errors.Is(err, ErrCrossBackendBatch),
+		errors.Is(err, ErrIncompatibleResults),
+		errors.Is(err, ErrFanOutNotSupported),
+		errors.Is(err, router.ErrRewrite):
+		// feature_not_supported
+		return "0A000"
+	}
+	if errors.Is(err, ErrHintNotAllowed) || errors.Is(err, ErrCutOverNotAllowed) || errors.Is(err, router.ErrFirewallDenied) ||
+		errors.Is(err, ErrNotAllowlisted) {
+		// insufficient_privilege
+		return "42501"
+	}
+	if errors.Is(err, router.ErrUnknownSchema) || errors.Is(err, router.ErrNotMigrating) {
+		// invalid_schema_name
+		return "3F000"
+	}
+	if errors.Is(err, ErrAdminAuthentication) {
+		// invalid_password
+		return "28P01"
+	}
+	if errors.Is(err, ErrSessionKilled) {
+		// admin_shutdown
+		return "57P01"
+	}
+	if errors.Is(err, ErrAdminCommand) || errors.Is(err, ErrUnparsedSQL) {
+		// syntax_error
+		return "42601"
+	}
+	if errors.Is(err, ErrAdminObjectNotFound) {
+		// undefined_object
+		return "42704"
+	}
+	if errors.Is(err, ErrInvalidConfiguration) || errors.Is(err, ErrReload) {
+		// config_file_error
+		return "F0000"
+	}
+	if errors.Is(err, router.ErrInvalidHint) {
+		// invalid_parameter_value
+		return "22023"
+	}
+	// internal_error
+	return "XX000"
 }
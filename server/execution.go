@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+// execution is a simple query or an extended query protocol batch (up to its
+// `Sync`) as the client sees it: from the message that starts it until the
+// client is sent the `ReadyForQuery` that ends it. Statements rejected by the
+// proxy are executions too.
+type execution struct {
+	SessionID       uint64
+	Session         router.Session
+	ApplicationName string
+	// Statements is the SQL of the `Query` or of each `Execute` in a batch;
+	// Prepared is the SQL of each `Parse` in a batch (used when no statement
+	// was executed, e.g. because the `Parse` was rejected).
+	Statements []string
+	Prepared   []string
+	// Parameters is the number of bind parameters (across every `Bind`) and
+	// ParameterBytes is their total size.
+	Parameters     int
+	ParameterBytes int
+	// Backends received the statements (every backend for a fan-out).
+	// Backends and Done are guarded by the session `Mutex`; once the
+	// execution is done, neither changes.
+	Backends []string
+	Done     bool
+	Outcome  *outcome
+	// Span is the execution's span (see `endSpan()`); `nil` if tracing is
+	// disabled.
+	Span *span
+
+	// The parsed statements and normalized SQL are computed (once) when
+	// the execution is observed.
+	parsed     parser.Statements
+	parseErr   error
+	parseDone  bool
+	normalized map[bool]string
+}
+
+// SQL returns the statements that were executed (or, if none were, the
+// statements that were prepared).
+func (e *execution) SQL() string {
+	if len(e.Statements) > 0 {
+		return strings.Join(e.Statements, "; ")
+	}
+	return strings.Join(e.Prepared, "; ")
+}
+
+// Parsed returns the parsed statements; `ok` is false if the SQL could not
+// be parsed.
+func (e *execution) Parsed() (parser.Statements, bool) {
+	if !e.parseDone {
+		e.parsed, e.parseErr = router.Parse(e.SQL())
+		e.parseDone = true
+	}
+	return e.parsed, e.parseErr == nil
+}
+
+// Normalized returns the normalized SQL (see `normalizeSQL()`).
+func (e *execution) Normalized(hideConstants bool) string {
+	if normalized, ok := e.normalized[hideConstants]; ok {
+		return normalized
+	}
+	statements, ok := e.Parsed()
+	normalized := normalizeSQL(e.SQL(), statements, ok, hideConstants)
+	if e.normalized == nil {
+		e.normalized = map[bool]string{}
+	}
+	e.normalized[hideConstants] = normalized
+	return normalized
+}
+
+// Fingerprint identifies the shape of the executed SQL (see
+// `router.Fingerprint()`).
+func (e *execution) Fingerprint() string {
+	return router.Fingerprint(e.Normalized(true))
+}
+
+func (s *session) newExecution() *execution {
+	e := &execution{
+		SessionID:       s.ID,
+		Session:         s.routerSession(),
+		ApplicationName: s.Parameters["application_name"],
+		Outcome:         newOutcome(),
+		Span:            s.Server.Tracer.Start("statement", spanKindServer, nil),
+	}
+	e.Span.Adopt(applicationTraceparent(e.ApplicationName))
+	return e
+}
+
+// batchExecution returns the execution for the current extended query
+// protocol batch.
+func (s *session) batchExecution() *execution {
+	if s.BatchExecution == nil {
+		s.BatchExecution = s.newExecution()
+	}
+	return s.BatchExecution
+}
+
+// queueExecution records that an execution will end with the next
+// `ReadyForQuery` sent to the client (after those of executions already
+// queued). It becomes the current execution, which `attribute()` applies to.
+func (s *session) queueExecution(e *execution) {
+	s.Mutex.Lock()
+	s.Executions = append(s.Executions, e)
+	s.Mutex.Unlock()
+	s.Execution = e
+}
+
+// attribute records that the current execution was sent to a backend.
+func (s *session) attribute(backend string) {
+	e := s.Execution
+	if e == nil {
+		return
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if e.Done {
+		return
+	}
+	for _, existing := range e.Backends {
+		if existing == backend {
+			return
+		}
+	}
+	e.Backends = append(e.Backends, backend)
+}
+
+// observeSent observes the messages sent to the client for the oldest queued
+// execution; once its `ReadyForQuery` is sent, the execution is complete.
+// Must be called with `WriteMutex` held, so messages are observed in order.
+func (s *session) observeSent(chunk []byte) {
+	eachMessage(chunk, func(message []byte) {
+		s.Mutex.Lock()
+		var e *execution
+		if len(s.Executions) > 0 {
+			e = s.Executions[0]
+			if message[0] == 'Z' {
+				s.Executions = s.Executions[1:]
+				e.Done = true
+			}
+		}
+		s.Mutex.Unlock()
+		if e == nil {
+			return
+		}
+
+		e.Outcome.Observe(message)
+		if message[0] == 'Z' {
+			s.Server.observe(e)
+		}
+	})
+}
+
+// observe is invoked for every completed execution.
+func (ps *proxyServer) observe(e *execution) {
+	ps.observeLatency(e)
+	ps.Statements.Record(e)
+	e.endSpan()
+	if ps.Audit != nil {
+		ps.Audit.Record(ps, e)
+	}
+}
+
+// eachMessage invokes `fn` for each complete message in a chunk of
+// (backend) messages: a type byte followed by a length that includes
+// itself.
+func eachMessage(chunk []byte, fn func(message []byte)) {
+	for len(chunk) >= 5 {
+		length := int(binary.BigEndian.Uint32(chunk[1:5]))
+		if length < 4 || length+1 > len(chunk) {
+			return
+		}
+		fn(chunk[:length+1])
+		chunk = chunk[length+1:]
+	}
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/spf13/cobra"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// targetPrimary indicates a statement would be sent to the primary of its
+	// backend.
+	targetPrimary = "primary"
+	// targetReplica indicates a statement would be sent to a replica of its
+	// backend (if one is healthy).
+	targetReplica = "replica"
+)
+
+// routeExplanation describes the routing decision for a single statement.
+type routeExplanation struct {
+	SQL string `json:"sql"`
+	// Rewritten is the SQL sent to the backend, if schemas are renamed.
+	Rewritten string `json:"rewritten,omitempty"`
+	// Unparsed is the parser error for SQL the proxy cannot parse; it is
+	// routed by the `unparsed` policy.
+	Unparsed  string          `json:"unparsed,omitempty"`
+	Tag       string          `json:"tag,omitempty"`
+	Relations []relationRoute `json:"relations"`
+	// Backend is the backend the statement would be sent to.
+	Backend string `json:"backend,omitempty"`
+	// SessionBackend indicates no relation determined the backend, so the
+	// statement would go to the session's backend (or whichever backend
+	// received the previous statement).
+	SessionBackend bool `json:"session_backend"`
+	// FanOut indicates the statement would be sent to every backend and the
+	// rows merged.
+	FanOut   bool   `json:"fan_out"`
+	Target   string `json:"target,omitempty"`
+	ReadOnly bool   `json:"read_only"`
+	// Mirror is the shadow backend that would receive a copy.
+	Mirror string `json:"mirror,omitempty"`
+	// DualWrite is the other backend of a migration that would also apply
+	// the statement.
+	DualWrite string `json:"dual_write,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// relationRoute is a relation with its schema resolved and its owner.
+type relationRoute struct {
+	router.Relation
+	Backend string `json:"backend,omitempty"`
+}
+
+// explainRoute routes `sql` exactly as the proxy would if a client connected
+// with the startup `parameters` sent it as a simple query: a session (without
+// server connections) applies the firewall, the allowlist, routing hints,
+// schema renaming, fan-out and the `unparsed` policy. Just like
+// `handleQuery()`, the statements in `sql` are routed together (e.g. they are
+// rejected if they span backends); they are only split to describe each of
+// them.
+func explainRoute(ps *proxyServer, parameters map[string]string, sql string) []routeExplanation {
+	s := &session{
+		Server:     ps,
+		Parameters: parameters,
+		Backend:    ps.router().ConnectionBackend(parameters),
+	}
+	if searchPath, ok := parameters["search_path"]; ok {
+		s.SearchPath = router.ParseSearchPath(searchPath)
+	}
+
+	pieces := router.SplitStatements(sql)
+	if len(pieces) == 0 {
+		return []routeExplanation{}
+	}
+	explanations := make([]routeExplanation, 0, len(pieces))
+	for _, piece := range pieces {
+		explanations = append(explanations, s.describe(strings.TrimSpace(piece)))
+	}
+
+	routed := s.explain(sql)
+	if len(pieces) == 1 {
+		routed.SQL = explanations[0].SQL
+		return []routeExplanation{routed}
+	}
+	for i := range explanations {
+		explanations[i].setRoute(routed)
+	}
+	return explanations
+}
+
+// describe parses one of the statements for `explainRoute()` and resolves the
+// relations it references (and renames its schemas), without routing it.
+func (s *session) describe(sql string) routeExplanation {
+	e := routeExplanation{SQL: sql, Relations: []relationRoute{}}
+	r := s.Server.router()
+	var relations []router.Relation
+	statements, parseErr := router.Parse(sql)
+	if parseErr != nil {
+		e.Unparsed = parseErr.Error()
+		d, _ := r.RouteScanned(sql, s.routerSession())
+		relations = d.Relations
+	}
+	for _, statement := range statements {
+		relations = append(relations, router.Analyze(statement).Relations...)
+	}
+	if len(statements) == 1 {
+		e.Tag = router.Analyze(statements[0]).Tag
+	}
+	if rewritten, err := s.rewrite(sql, parseErr); err == nil && rewritten != sql {
+		e.Rewritten = rewritten
+	}
+
+	for _, relation := range relations {
+		resolved, backend := r.Resolve(relation, s.routerSession())
+		e.Relations = append(e.Relations, relationRoute{
+			Relation: resolved,
+			Backend:  backend,
+		})
+	}
+	return e
+}
+
+// setRoute copies the routing decision for the statements sent together onto
+// the explanation of one of them; it is only shown rewritten if they are.
+func (e *routeExplanation) setRoute(routed routeExplanation) {
+	e.Backend = routed.Backend
+	e.SessionBackend = routed.SessionBackend
+	e.FanOut = routed.FanOut
+	e.Target = routed.Target
+	e.ReadOnly = routed.ReadOnly
+	e.Mirror = routed.Mirror
+	e.DualWrite = routed.DualWrite
+	e.Error = routed.Error
+	if routed.Rewritten == "" {
+		e.Rewritten = ""
+	}
+}
+
+// explain routes the statements for `explainRoute()`.
+func (s *session) explain(sql string) routeExplanation {
+	e := routeExplanation{SQL: sql, Relations: []relationRoute{}}
+	statements, parseErr := router.Parse(sql)
+	if parseErr != nil {
+		e.Unparsed = parseErr.Error()
+	}
+	if len(statements) == 1 {
+		e.Tag = router.Analyze(statements[0]).Tag
+	}
+
+	d, err := s.explainDecision(sql, statements, parseErr, &e)
+	for _, relation := range d.Relations {
+		_, backend := s.Server.router().Resolve(relation, s.routerSession())
+		e.Relations = append(e.Relations, relationRoute{
+			Relation: relation,
+			Backend:  backend,
+		})
+	}
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+
+	e.ReadOnly = d.ReadOnly
+	e.Backend = d.Backend
+	e.Mirror = d.Mirror
+	e.DualWrite = d.DualWrite
+	s.trackSearchPath(statements)
+	if e.FanOut {
+		return e
+	}
+	if e.Backend == "" {
+		e.Backend = s.Backend
+		e.SessionBackend = true
+	}
+	e.Target = targetPrimary
+	if d.ReadOnly && len(s.Server.backend(e.Backend).Replicas) > 0 {
+		e.Target = targetReplica
+	}
+	return e
+}
+
+// explainDecision follows `handleQuery()` up to the routing decision; it
+// sets the rewritten SQL and fan-out of the explanation.
+func (s *session) explainDecision(sql string, statements parser.Statements, parseErr error, e *routeExplanation) (router.Decision, error) {
+	err := s.firewall(statements, parseErr)
+	if err != nil {
+		return router.Decision{}, err
+	}
+	ac := s.Server.config().Allowlist
+	if key, _, ok := s.allowlistKey(ac, sql, statements); ok {
+		if al := s.Server.allowlist(); ac.Mode == allowlistEnforce && (al == nil || !al.Contains(key)) {
+			return router.Decision{}, fmt.Errorf("%w; fingerprint %s", ErrNotAllowlisted, key.Fingerprint)
+		}
+	}
+
+	hints, err := s.parseHints(sql)
+	if err != nil {
+		return router.Decision{}, err
+	}
+	rewritten, err := s.rewrite(sql, parseErr)
+	if err != nil {
+		return router.Decision{}, err
+	}
+	if rewritten != sql {
+		e.Rewritten = rewritten
+	}
+	_, fanOut, err := s.requestedFanOut(hints, statements)
+	if err != nil {
+		return router.Decision{}, err
+	}
+
+	var d router.Decision
+	if parseErr != nil {
+		d, err = s.unparsedDecision(sql, parseErr, hints)
+	} else {
+		d, err = s.decision(statements, hints, true)
+	}
+	if fanOut {
+		// NOTE: A requested fan-out is sent to every backend without routing.
+		d.FanOut, err = true, nil
+	}
+	e.FanOut = d.FanOut
+	return d, err
+}
+
+func writeExplanationsText(w io.Writer, explanations []routeExplanation) error {
+	for i, e := range explanations {
+		var b strings.Builder
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "Statement %d: %s\n", i+1, e.SQL)
+		if e.Tag != "" {
+			fmt.Fprintf(&b, "  Tag:       %s\n", e.Tag)
+		}
+		if e.Unparsed != "" {
+			fmt.Fprintf(&b, "  Unparsed:  %s\n", e.Unparsed)
+		}
+		if e.Rewritten != "" {
+			fmt.Fprintf(&b, "  Rewritten: %s\n", e.Rewritten)
+		}
+		for j, r := range e.Relations {
+			label := "          "
+			if j == 0 {
+				label = "Relations:"
+			}
+			owner := r.Backend
+			if owner == "" {
+				owner = "(system schema, any backend)"
+			}
+			fmt.Fprintf(&b, "  %s %s -> %s\n", label, r.String(), owner)
+		}
+		if e.Error != "" {
+			fmt.Fprintf(&b, "  Error:     %s\n", e.Error)
+		} else if e.FanOut {
+			b.WriteString("  Backend:   (every backend, rows merged)\n")
+		} else {
+			note := ""
+			if e.SessionBackend {
+				note = ", session backend"
+			}
+			fmt.Fprintf(&b, "  Backend:   %s (%s%s)\n", e.Backend, e.Target, note)
+		}
+		if e.DualWrite != "" {
+			fmt.Fprintf(&b, "  Copy:      %s (dual write)\n", e.DualWrite)
+		} else if e.Mirror != "" {
+			fmt.Fprintf(&b, "  Copy:      %s (mirror)\n", e.Mirror)
+		}
+
+		_, err := io.WriteString(w, b.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newExplainRouteCommand creates the `explain-route` subcommand. It shares
+// the root command's configuration flags.
+func newExplainRouteCommand(c *Config, configFile *string) *cobra.Command {
+	var parameters map[string]string
+	user := ""
+	database := ""
+	searchPath := ""
+	format := "text"
+	cmd := &cobra.Command{
+		Use:   "explain-route [SQL]",
+		Short: "Show where statements would be routed",
+		Long: "Show where statements would be routed\n\n" +
+			"Parses the SQL (from the argument or stdin) and prints the relations\n" +
+			"referenced by each statement, their resolved schemas and the backend\n" +
+			"the proxy would choose for all of the statements sent as one query,\n" +
+			"applying the firewall, allowlist, routing hints and unparsed SQL\n" +
+			"policy of the configuration. No backend is connected to, except to\n" +
+			"load lookups from a directory table.",
+		Args:          cobra.MaximumNArgs(1),
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "text" && format != "json" {
+				return fmt.Errorf("unknown format %q, expected text or json", format)
+			}
+
+			loaded, err := resolveConfig(cmd, *c, *configFile)
+			if err != nil {
+				return err
+			}
+			err = loaded.Validate()
+			if err != nil {
+				return err
+			}
+			ps, err := newProxyServer(loaded)
+			if err != nil {
+				return err
+			}
+			ps.Allowlist, err = openAllowlist(loaded.Allowlist)
+			if err != nil {
+				return err
+			}
+
+			sql := ""
+			if len(args) == 1 {
+				sql = args[0]
+			} else {
+				data, err := io.ReadAll(cmd.InOrStdin())
+				if err != nil {
+					return err
+				}
+				sql = string(data)
+			}
+
+			if parameters == nil {
+				parameters = map[string]string{}
+			}
+			if user != "" {
+				parameters["user"] = user
+			}
+			if database != "" {
+				parameters["database"] = database
+			}
+			if cmd.Flags().Changed("search-path") {
+				parameters["search_path"] = searchPath
+			}
+			explanations := explainRoute(ps, parameters, sql)
+
+			if format == "json" {
+				encoder := json.NewEncoder(cmd.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(explanations)
+			}
+			return writeExplanationsText(cmd.OutOrStdout(), explanations)
+		},
+	}
+
+	cmd.Flags().StringVar(&user, "user", "", "The user the client connects as")
+	cmd.Flags().StringVar(&database, "database", "", "The database the client connects to")
+	cmd.Flags().StringVar(&searchPath, "search-path", "", "The initial search_path (e.g. \"tenant_0001, public\")")
+	cmd.Flags().StringToStringVar(
+		&parameters,
+		"param",
+		nil,
+		"Additional startup parameters (e.g. application_name=reports), used by connection routes",
+	)
+	cmd.Flags().StringVar(&format, "format", "text", "The output format: text or json")
+
+	return cmd
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplainRoute(t *testing.T) {
+	t.Parallel()
+	ps, err := newProxyServer(fanOutConfig("127.0.0.1:1", "127.0.0.1:2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parameters := map[string]string{"user": "app", "database": "app"}
+
+	explanations := explainRoute(ps, parameters, "SELECT * FROM crm.a; SELECT * FROM crm.b")
+	if len(explanations) != 2 {
+		t.Fatalf("explained %d statements, expected 2", len(explanations))
+	}
+	for _, e := range explanations {
+		if e.Error != "" || e.Backend != "crm" || len(e.Relations) != 1 {
+			t.Fatalf("statement %q was not routed to crm; %#v", e.SQL, e)
+		}
+	}
+
+	// NOTE: The statements are sent as one query, so they must be rejected
+	//       even though each of them could be routed on its own.
+	explanations = explainRoute(ps, parameters, "SELECT * FROM crm.a; SELECT * FROM billing.b")
+	if len(explanations) != 2 {
+		t.Fatalf("explained %d statements, expected 2", len(explanations))
+	}
+	for i, e := range explanations {
+		if !strings.Contains(e.Error, "multiple backends") || e.Backend != "" {
+			t.Fatalf("statement %q was not rejected; %#v", e.SQL, e)
+		}
+		if len(e.Relations) != 1 || e.Relations[0].Backend != []string{"crm", "billing"}[i] {
+			t.Fatalf("statement %q has relations %#v", e.SQL, e.Relations)
+		}
+	}
+}
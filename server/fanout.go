@@ -0,0 +1,337 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// backendColumn is the name of the column added to fan-out results that
+	// identifies the backend each row came from.
+	backendColumn = "backend"
+	// textOID is the type OID for `text`.
+	textOID = 25
+)
+
+// fanOutOptions control how the results of a fan-out are merged.
+type fanOutOptions struct {
+	// BackendColumn adds the backend name as the first column of each row.
+	BackendColumn bool
+	// Dedupe only sends rows that are identical across backends once.
+	Dedupe bool
+}
+
+// fanOutStream is the state shared by the backends taking part in a fan-out.
+// Rows are streamed to the client as they arrive, but only once every
+// backend has described its result and the descriptions are compatible.
+type fanOutStream struct {
+	Session *session
+	Options fanOutOptions
+	// Proceed is closed once rows may be sent (or, if `Abort` is set,
+	// discarded).
+	Proceed chan struct{}
+	Abort   bool
+
+	Mutex sync.Mutex
+	Seen  map[string]bool
+	Count int
+}
+
+// Row sends a row from one backend to the client.
+func (fs *fanOutStream) Row(backend string, chunk []byte) error {
+	if fs.Options.BackendColumn {
+		bm, err := postgres.ParseBackendChunk(chunk)
+		if err != nil {
+			return err
+		}
+		dr, ok := bm.(*pgproto3.DataRow)
+		if !ok {
+			return fmt.Errorf("%w; expected DataRow, got %T", ErrUnexpectedMessage, bm)
+		}
+		values := append([][]byte{[]byte(backend)}, dr.Values...)
+		chunk = (&pgproto3.DataRow{Values: values}).Encode(nil)
+	}
+
+	fs.Mutex.Lock()
+	if fs.Options.Dedupe {
+		if fs.Seen[string(chunk)] {
+			fs.Mutex.Unlock()
+			return nil
+		}
+		fs.Seen[string(chunk)] = true
+	}
+	fs.Count++
+	fs.Mutex.Unlock()
+
+	return fs.Session.writeClient(chunk)
+}
+
+// abort discards the rows of a failed fan-out and waits until every backend
+// the query was sent to has responded, so no response arrives after the
+// client is told about the failure.
+func (fs *fanOutStream) abort(cycles []*cycle) {
+	fs.Abort = true
+	close(fs.Proceed)
+	for _, c := range cycles {
+		<-c.Done
+	}
+}
+
+// fanOutResult collects the response from one backend to a query that was
+// sent to every backend.
+type fanOutResult struct {
+	Backend string
+	Stream  *fanOutStream
+	// Header is closed once the backend has described its result (or
+	// failed, or completed without returning rows).
+	Header      chan struct{}
+	HeaderOnce  sync.Once
+	Description *pgproto3.RowDescription
+	Tag         string
+	Error       []byte
+}
+
+func (r *fanOutResult) header() {
+	r.HeaderOnce.Do(func() {
+		close(r.Header)
+	})
+}
+
+// Collect is a `messageHandler` that accumulates the result description and
+// status and streams rows once the stream proceeds.
+func (r *fanOutResult) Collect(chunk []byte) error {
+	switch chunk[0] {
+	case 'T':
+		bm, err := postgres.ParseBackendChunk(chunk)
+		if err != nil {
+			return err
+		}
+		r.Description, _ = bm.(*pgproto3.RowDescription)
+		r.header()
+	case 'D':
+		<-r.Stream.Proceed
+		if r.Stream.Abort {
+			return nil
+		}
+		return r.Stream.Row(r.Backend, chunk)
+	case 'C':
+		bm, err := postgres.ParseBackendChunk(chunk)
+		if err != nil {
+			return err
+		}
+		if cc, ok := bm.(*pgproto3.CommandComplete); ok && r.Tag == "" {
+			r.Tag = string(cc.CommandTag)
+		}
+		r.header()
+	case 'E':
+		if r.Error == nil {
+			r.Error = chunk
+		}
+		r.header()
+	case 'Z':
+		r.header()
+	}
+	return nil
+}
+
+// fanOut sends a single read-only query to every backend that owns schemas
+// (see `router.FanOutBackends()`), a replica when one is available, and
+// merges the results into one: the row descriptions must be compatible, rows
+// are streamed from every backend and the row counts are combined in a single
+// `CommandComplete`.
+func (s *session) fanOut(chunk []byte, o fanOutOptions) error {
+	backends := s.Server.backends()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	names = s.Server.router().FanOutBackends(names)
+
+	// NOTE: Every connection is picked before the query is sent to any
+	//       backend, so failing to pick one leaves nothing in flight.
+	conns := make([]*serverConn, 0, len(names))
+	for _, name := range names {
+		sc, err := s.pick(router.Decision{Backend: name, ReadOnly: true})
+		if err != nil {
+			return s.rejectQuery(err)
+		}
+		conns = append(conns, sc)
+	}
+
+	fs := &fanOutStream{
+		Session: s,
+		Options: o,
+		Proceed: make(chan struct{}),
+		Seen:    map[string]bool{},
+	}
+	results := make([]*fanOutResult, 0, len(names))
+	cycles := make([]*cycle, 0, len(names))
+	for i, sc := range conns {
+		name := names[i]
+		sc.WaitIdle()
+		s.attribute(name)
+
+		r := &fanOutResult{Backend: name, Stream: fs, Header: make(chan struct{})}
+		c := newCycle(r.Collect)
+		err := sc.Send(chunk, c)
+		if err != nil {
+			fs.abort(cycles)
+			return s.rejectQuery(fmt.Errorf("%w; %s: %v", ErrBackendUnavailable, name, err))
+		}
+		results = append(results, r)
+		cycles = append(cycles, c)
+	}
+
+	for i, r := range results {
+		select {
+		case <-r.Header:
+		case <-cycles[i].Done:
+		}
+	}
+
+	err := fanOutError(conns, results)
+	if err == nil {
+		err = compatibleResults(results)
+	}
+	if err != nil {
+		fs.abort(cycles)
+		return s.fanOutFailed(conns, results, err)
+	}
+
+	if description := mergedDescription(results, o); description != nil {
+		err = s.send(description)
+		if err != nil {
+			fs.abort(cycles)
+			return err
+		}
+	}
+	close(fs.Proceed)
+	for _, c := range cycles {
+		<-c.Done
+	}
+
+	err = fanOutError(conns, results)
+	if err != nil {
+		return s.fanOutFailed(conns, results, err)
+	}
+
+	tag := ""
+	for _, r := range results {
+		if r.Tag != "" {
+			tag = r.Tag
+			break
+		}
+	}
+	return s.send(
+		&pgproto3.CommandComplete{CommandTag: []byte(replaceRowCount(tag, fs.Count))},
+		&pgproto3.ReadyForQuery{TxStatus: s.clientStatus()},
+	)
+}
+
+// fanOutError returns the first failure among the backends taking part in a
+// fan-out, either a broken connection or an error response.
+func fanOutError(conns []*serverConn, results []*fanOutResult) error {
+	for i, sc := range conns {
+		if sc.Broken() {
+			return fmt.Errorf("%w; %s: %v", ErrBackendUnavailable, sc.Backend, sc.Err)
+		}
+		if results[i].Error != nil {
+			return errFanOutResponse
+		}
+	}
+	return nil
+}
+
+// fanOutFailed ends a failed fan-out. An error response from a backend is
+// relayed to the client as is.
+func (s *session) fanOutFailed(conns []*serverConn, results []*fanOutResult, err error) error {
+	if err != errFanOutResponse {
+		return s.rejectQuery(err)
+	}
+	for _, r := range results {
+		if r.Error != nil {
+			return appendErrs(
+				s.writeClient(r.Error),
+				s.send(&pgproto3.ReadyForQuery{TxStatus: s.clientStatus()}),
+			)
+		}
+	}
+	return nil
+}
+
+// compatibleResults checks that the result from every backend has the same
+// columns, so the rows can be combined.
+func compatibleResults(results []*fanOutResult) error {
+	var first *fanOutResult
+	for _, r := range results {
+		if first == nil {
+			first = r
+			continue
+		}
+		if (first.Description == nil) != (r.Description == nil) {
+			return fmt.Errorf("%w; only some backends returned rows", ErrIncompatibleResults)
+		}
+		if first.Description == nil {
+			continue
+		}
+		if len(first.Description.Fields) != len(r.Description.Fields) {
+			return fmt.Errorf(
+				"%w; backend %q returned %d columns but backend %q returned %d",
+				ErrIncompatibleResults, first.Backend, len(first.Description.Fields), r.Backend, len(r.Description.Fields),
+			)
+		}
+		for i, f := range first.Description.Fields {
+			g := r.Description.Fields[i]
+			if !bytes.Equal(f.Name, g.Name) || f.DataTypeOID != g.DataTypeOID || f.Format != g.Format {
+				return fmt.Errorf(
+					"%w; column %d is %s (type %d) on backend %q but %s (type %d) on backend %q",
+					ErrIncompatibleResults, i+1, f.Name, f.DataTypeOID, first.Backend, g.Name, g.DataTypeOID, r.Backend,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// mergedDescription is the row description sent to the client for a
+// fan-out, or `nil` if the statement does not return rows.
+func mergedDescription(results []*fanOutResult, o fanOutOptions) *pgproto3.RowDescription {
+	if len(results) == 0 || results[0].Description == nil {
+		return nil
+	}
+
+	fields := results[0].Description.Fields
+	if o.BackendColumn {
+		column := pgproto3.FieldDescription{
+			Name:         []byte(backendColumn),
+			DataTypeOID:  textOID,
+			DataTypeSize: -1,
+			TypeModifier: -1,
+		}
+		fields = append([]pgproto3.FieldDescription{column}, fields...)
+	}
+	return &pgproto3.RowDescription{Fields: fields}
+}
+
+// replaceRowCount replaces the row count in a command tag such as
+// `SELECT 3`.
+func replaceRowCount(tag string, count int) string {
+	i := strings.LastIndex(tag, " ")
+	if i == -1 {
+		return tag
+	}
+	if _, err := strconv.Atoi(tag[i+1:]); err != nil {
+		return tag
+	}
+	return tag[:i+1] + strconv.Itoa(count)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+// fanOutConfig routes the `billing` and `crm` schemas to their own backends
+// and fans out every read-only query from the `reporter` user.
+func fanOutConfig(billing, crm string) Config {
+	return Config{
+		ProxyPort: 1,
+		Backends: []BackendConfig{
+			{Name: "billing", Primary: billing},
+			{Name: "crm", Primary: crm},
+		},
+		DefaultBackend: "billing",
+		Routes: []router.Rule{
+			{Schema: "billing", Backend: "billing"},
+			{Schema: "crm", Backend: "crm"},
+		},
+		FanOut: FanOutConfig{Users: []string{"reporter"}},
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	t.Parallel()
+	billing := startBackend(t, "billing")
+	crm := startBackend(t, "crm")
+	_, addr := startProxy(t, fanOutConfig(billing.Addr, crm.Addr))
+	client := login(t, addr, map[string]string{"user": "reporter", "database": "app"})
+
+	sql := "SELECT count(*) FROM pg_catalog.pg_tables"
+	rows, er := client.Query(sql)
+	if er != nil {
+		t.Fatalf("fan-out failed; %s", er.Message)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	expected := [][]string{{"billing", sql}, {"crm", sql}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("rows = %q, expected %q", rows, expected)
+	}
+
+	// NOTE: An error response from a backend is relayed as is.
+	_, er = client.Query("SELECT * FROM pg_catalog.fail")
+	if er == nil || er.Code != "42P01" {
+		t.Fatalf("expected the backend error to be relayed; error %#v", er)
+	}
+
+	// NOTE: Writes and transactions are not sent to every backend.
+	_, er = client.Query("BEGIN")
+	if er != nil {
+		t.Fatal(er.Message)
+	}
+	rows, er = client.Query("SELECT * FROM crm.contacts")
+	if er != nil || len(rows) != 1 || rows[0][0] != "crm" {
+		t.Fatalf("expected a single row from crm; rows %q, error %#v", rows, er)
+	}
+}
+
+func TestFanOutUnavailable(t *testing.T) {
+	t.Parallel()
+	billing := startBackend(t, "billing")
+	// NOTE: Nothing listens on port 1, so a connection to `crm` fails after
+	//       a connection to `billing` was picked.
+	_, addr := startProxy(t, fanOutConfig(billing.Addr, "127.0.0.1:1"))
+	client := login(t, addr, map[string]string{"user": "reporter", "database": "app"})
+
+	_, er := client.Query("SELECT count(*) FROM pg_catalog.pg_tables")
+	if er == nil || er.Code != "08000" {
+		t.Fatalf("expected SQLSTATE 08000; error %#v", er)
+	}
+	// NOTE: Nothing from the failed fan-out arrives after the error (a
+	//       statement in a transaction is not sent to every backend).
+	_, er = client.Query("BEGIN")
+	if er != nil {
+		t.Fatal(er.Message)
+	}
+	rows, er := client.Query("SELECT * FROM billing.invoices")
+	if er != nil || len(rows) != 1 || rows[0][1] != "SELECT * FROM billing.invoices" {
+		t.Fatalf("expected a single row from billing; rows %q, error %#v", rows, er)
+	}
+}
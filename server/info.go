@@ -0,0 +1,165 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// sessionInfo describes a client session for the admin console and the
+// HTTP API.
+type sessionInfo struct {
+	ID              uint64            `json:"id"`
+	User            string            `json:"user"`
+	Database        string            `json:"database"`
+	ApplicationName string            `json:"application_name,omitempty"`
+	ClientAddr      string            `json:"client_addr"`
+	Parameters      map[string]string `json:"parameters"`
+	Backend         string            `json:"backend"`
+	State           string            `json:"state"`
+	Transaction     string            `json:"transaction"`
+	// CurrentBackends are the backends with a statement in flight or an
+	// open transaction for the session.
+	CurrentBackends  []string   `json:"current_backends"`
+	Connections      []connInfo `json:"connections"`
+	Statement        string     `json:"statement,omitempty"`
+	StatementStarted *time.Time `json:"statement_started,omitempty"`
+	Started          time.Time  `json:"started"`
+	LastActivity     time.Time  `json:"last_activity"`
+	BytesReceived    int64      `json:"bytes_received"`
+	BytesSent        int64      `json:"bytes_sent"`
+	MessagesReceived int64      `json:"messages_received"`
+	MessagesSent     int64      `json:"messages_sent"`
+}
+
+// connInfo describes a server connection held by a session.
+type connInfo struct {
+	Backend string `json:"backend"`
+	Role    string `json:"role"`
+	Addr    string `json:"addr"`
+}
+
+// backendInfo describes a backend (its primary and replicas) for the admin
+// console and the HTTP API.
+type backendInfo struct {
+	Name      string       `json:"name"`
+	Primary   memberInfo   `json:"primary"`
+	Replicas  []memberInfo `json:"replicas,omitempty"`
+	Paused    bool         `json:"paused"`
+	PausedFor Duration     `json:"paused_for,omitempty"`
+	// InFlight counts the server connections (across all sessions) that
+	// are waiting for a response or are in a transaction.
+	InFlight int `json:"in_flight"`
+}
+
+// memberInfo describes a single server of a backend. `Lag` is only set for
+// replicas where it has been measured.
+type memberInfo struct {
+	Addr        string    `json:"addr"`
+	Connections int64     `json:"connections"`
+	Lag         *Duration `json:"lag,omitempty"`
+	Available   bool      `json:"available"`
+}
+
+func (s *session) info() sessionInfo {
+	si := sessionInfo{
+		ID:              s.ID,
+		User:            s.Parameters["user"],
+		Database:        s.Parameters["database"],
+		ApplicationName: s.Parameters["application_name"],
+		ClientAddr:      s.Client.RemoteAddr().String(),
+		Parameters:      s.Parameters,
+		Backend:         s.Backend,
+		State:           s.state(),
+		Transaction:     s.Activity.Transaction(),
+		CurrentBackends: []string{},
+		Connections:     []connInfo{},
+		Started:         s.Started.UTC(),
+		LastActivity:    s.Activity.Last().UTC(),
+
+		BytesReceived:    atomic.LoadInt64(&s.Activity.BytesReceived),
+		BytesSent:        atomic.LoadInt64(&s.Activity.BytesSent),
+		MessagesReceived: atomic.LoadInt64(&s.Activity.MessagesReceived),
+		MessagesSent:     atomic.LoadInt64(&s.Activity.MessagesSent),
+	}
+
+	s.Mutex.Lock()
+	si.Statement = s.Statement
+	if !s.StatementStarted.IsZero() {
+		started := s.StatementStarted.UTC()
+		si.StatementStarted = &started
+	}
+	s.Mutex.Unlock()
+
+	current := map[string]bool{}
+	for _, sc := range s.conns() {
+		si.Connections = append(si.Connections, newConnInfo(sc))
+		if (sc.Busy() || sc.Status() != 'I') && !current[sc.Backend] {
+			current[sc.Backend] = true
+			si.CurrentBackends = append(si.CurrentBackends, sc.Backend)
+		}
+	}
+	return si
+}
+
+func newConnInfo(sc *serverConn) connInfo {
+	ci := connInfo{Backend: sc.Backend, Role: "primary", Addr: sc.Addr}
+	if sc.Replica {
+		ci.Role = "replica"
+	}
+	return ci
+}
+
+// sessionInfos describes every tracked session, ordered by ID.
+func (ps *proxyServer) sessionInfos() []sessionInfo {
+	infos := []sessionInfo{}
+	for _, s := range ps.Sessions.List() {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// backendInfo describes a backend; returns `false` if there is no backend
+// with the name.
+func (ps *proxyServer) backendInfo(name string) (backendInfo, bool) {
+	b := ps.backend(name)
+	if b == nil {
+		return backendInfo{}, false
+	}
+
+	bi := backendInfo{
+		Name: name,
+		Primary: memberInfo{
+			Addr:        b.Config.Primary,
+			Connections: b.OpenConnections(),
+			Available:   true,
+		},
+		Paused:    b.IsPaused(),
+		PausedFor: Duration(b.PausedFor().Round(time.Millisecond)),
+		InFlight:  ps.inFlight(name),
+	}
+	maxLag := time.Duration(b.Config.MaxReplicationLag)
+	for _, r := range b.Replicas {
+		mi := memberInfo{
+			Addr:        r.Addr,
+			Connections: r.OpenConnections(),
+			Available:   r.Available(maxLag),
+		}
+		if measured, ok := r.LagKnown(); ok {
+			lag := Duration(measured)
+			mi.Lag = &lag
+		}
+		bi.Replicas = append(bi.Replicas, mi)
+	}
+	return bi, true
+}
+
+// backendInfos describes every backend, in configuration order.
+func (ps *proxyServer) backendInfos() []backendInfo {
+	infos := []backendInfo{}
+	for _, name := range ps.config().BackendNames() {
+		if bi, ok := ps.backendInfo(name); ok {
+			infos = append(infos, bi)
+		}
+	}
+	return infos
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWindow is the number of recent statements per backend that
+	// latency percentiles are computed from.
+	latencyWindow = 1000
+)
+
+// latencyStats keeps the durations of the most recent statements sent to
+// each backend.
+type latencyStats struct {
+	Mutex    sync.Mutex
+	Backends map[string]*latencySamples
+}
+
+// latencySamples is a ring buffer of durations.
+type latencySamples struct {
+	Durations []time.Duration
+	Next      int
+	// Count is the number of durations ever recorded.
+	Count int64
+}
+
+// latencySummary describes the durations recorded for a backend.
+type latencySummary struct {
+	Backend    string   `json:"backend"`
+	Statements int64    `json:"statements"`
+	Samples    int      `json:"samples"`
+	P50        Duration `json:"p50"`
+	P95        Duration `json:"p95"`
+	P99        Duration `json:"p99"`
+	Max        Duration `json:"max"`
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{Backends: map[string]*latencySamples{}}
+}
+
+// Record adds the duration of a statement sent to a backend.
+func (ls *latencyStats) Record(backend string, d time.Duration) {
+	ls.Mutex.Lock()
+	defer ls.Mutex.Unlock()
+	samples, ok := ls.Backends[backend]
+	if !ok {
+		samples = &latencySamples{}
+		ls.Backends[backend] = samples
+	}
+	samples.Count++
+	if len(samples.Durations) < latencyWindow {
+		samples.Durations = append(samples.Durations, d)
+		return
+	}
+	samples.Durations[samples.Next] = d
+	samples.Next = (samples.Next + 1) % latencyWindow
+}
+
+// Summaries describes every backend with recorded durations, ordered by
+// name.
+func (ls *latencyStats) Summaries() []latencySummary {
+	ls.Mutex.Lock()
+	summaries := make([]latencySummary, 0, len(ls.Backends))
+	sorted := map[string][]time.Duration{}
+	for backend, samples := range ls.Backends {
+		summaries = append(summaries, latencySummary{Backend: backend, Statements: samples.Count})
+		sorted[backend] = append([]time.Duration(nil), samples.Durations...)
+	}
+	ls.Mutex.Unlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Backend < summaries[j].Backend
+	})
+	for i := range summaries {
+		durations := sorted[summaries[i].Backend]
+		sort.Slice(durations, func(i, j int) bool {
+			return durations[i] < durations[j]
+		})
+		summaries[i].Samples = len(durations)
+		summaries[i].P50 = percentile(durations, 0.50)
+		summaries[i].P95 = percentile(durations, 0.95)
+		summaries[i].P99 = percentile(durations, 0.99)
+		summaries[i].Max = percentile(durations, 1)
+	}
+	return summaries
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return Duration(sorted[rank-1])
+}
+
+// observeLatency records the duration of an execution for each backend it
+// was sent to and logs it if it exceeds the slow query threshold.
+func (ps *proxyServer) observeLatency(e *execution) {
+	latency := time.Duration(e.Outcome.Latency)
+	for _, backend := range e.Backends {
+		ps.Latency.Record(backend, latency)
+	}
+
+	threshold := time.Duration(ps.config().SlowQueries.Threshold)
+	if threshold == 0 || latency < threshold || len(e.Backends) == 0 {
+		return
+	}
+	logf(
+		"Slow query (%s) in session %d on backend %s; %s (%s)",
+		latency, e.SessionID, strings.Join(e.Backends, ", "), e.Normalized(true), e.parameterSummary(),
+	)
+}
+
+// parameterSummary describes the bind parameters of an execution without
+// their values.
+func (e *execution) parameterSummary() string {
+	switch e.Parameters {
+	case 0:
+		return "no parameters"
+	case 1:
+		return fmt.Sprintf("1 parameter, %d bytes", e.ParameterBytes)
+	}
+	return fmt.Sprintf("%d parameters, %d bytes", e.Parameters, e.ParameterBytes)
+}
@@ -0,0 +1,11 @@
+package server
+
+import (
+	"fmt"
+	"os"
+)
+
+// logf writes a single line to STDERR.
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+// loadLookups creates the lookup tables referenced by routing rules and
+// loads their initial entries.
+func loadLookups(c Config) (map[string]*router.Table, error) {
+	tables := map[string]*router.Table{}
+	for _, lc := range c.Lookups {
+		entries, err := readLookup(c, lc)
+		if err != nil {
+			return nil, err
+		}
+		tables[lc.Name] = router.NewTable(entries)
+	}
+	return tables, nil
+}
+
+// refreshLookups periodically reloads each lookup table that has a refresh
+// interval, until `stop` is closed. A failed reload is logged and the
+// previous entries are kept.
+func refreshLookups(c Config, tables map[string]*router.Table, stop <-chan struct{}) {
+	for _, lc := range c.Lookups {
+		if lc.Refresh == 0 {
+			continue
+		}
+
+		go func(lc LookupConfig, t *router.Table) {
+			ticker := time.NewTicker(time.Duration(lc.Refresh))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+				entries, err := readLookup(c, lc)
+				if err != nil {
+					logf("Failed to refresh lookup %q: %v", lc.Name, err)
+					continue
+				}
+				t.Replace(entries)
+			}
+		}(lc, tables[lc.Name])
+	}
+}
+
+// readLookup reads the entries for a lookup table and ensures every entry
+// refers to a configured backend.
+func readLookup(c Config, lc LookupConfig) (map[string]string, error) {
+	var entries map[string]string
+	var err error
+	if lc.CSV != "" {
+		entries, err = readLookupCSV(lc.CSV)
+	} else {
+		entries, err = queryDirectory(c, lc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w, failed to load lookup %q; %v", ErrInvalidConfiguration, lc.Name, err)
+	}
+
+	names := map[string]bool{}
+	for _, name := range c.BackendNames() {
+		names[name] = true
+	}
+	for key, backend := range entries {
+		if !names[backend] {
+			return nil, fmt.Errorf("%w, lookup %q maps %q to unknown backend %q", ErrInvalidConfiguration, lc.Name, key, backend)
+		}
+	}
+	return entries, nil
+}
+
+func readLookupCSV(filename string) (entries map[string]string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = appendErrs(err, f.Close())
+	}()
+
+	entries, err = router.ReadCSV(f)
+	return
+}
+
+// queryDirectory runs the lookup query against the primary of the lookup's
+// backend. The first two columns of each row are the key and the backend.
+func queryDirectory(c Config, lc LookupConfig) (entries map[string]string, err error) {
+	var bc BackendConfig
+	for _, candidate := range c.BackendConfigs() {
+		if candidate.Name == lc.Backend {
+			bc = candidate
+		}
+	}
+	if bc.User == "" {
+		err = fmt.Errorf("backend %q requires a user to query a directory table", bc.Name)
+		return
+	}
+
+	sc, err := dialServer(bc.Name, bc.Primary, false)
+	if err != nil {
+		return
+	}
+	defer func() {
+		err = appendErrs(err, sc.Close())
+	}()
+
+	parameters := map[string]string{"user": bc.User}
+	if bc.Database != "" {
+		parameters["database"] = bc.Database
+	}
+	err = sc.Startup(parameters, bc.Password)
+	if err != nil {
+		return
+	}
+	sc.Start(discardResponse, func(error, bool) {})
+
+	r, err := sc.Query(lc.Query)
+	if err != nil {
+		return
+	}
+	if len(r.Fields) < 2 {
+		err = fmt.Errorf("directory query must return two columns, got %d", len(r.Fields))
+		return
+	}
+
+	entries = map[string]string{}
+	for _, row := range r.Rows {
+		if row[0] == nil || row[1] == nil {
+			continue
+		}
+		entries[string(row[0])] = string(row[1])
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+// cutOver handles a `CUTOVER schema` (or `REVERT CUTOVER schema`) command
+// from the client, flipping reads of a migrating schema between its
+// backends. The command is answered by the proxy; no backend sees it.
+func (s *session) cutOver(schema string, cutOver bool) error {
+	user := s.Parameters["user"]
+	allowed := false
+	for _, candidate := range s.Server.config().Migration.Users {
+		allowed = allowed || candidate == user
+	}
+	if !allowed {
+		logf("Rejected cut over of schema %q from user %q", schema, user)
+		return s.rejectQuery(ErrCutOverNotAllowed)
+	}
+
+	r := s.Server.router()
+	err := r.CutOver(schema, cutOver)
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+	backend := r.SchemaBackend(schema, router.Session{})
+	logf("Reads of migrating schema %q are served by %q (requested by user %q)", schema, backend, user)
+
+	tag := "CUTOVER"
+	if !cutOver {
+		tag = "REVERT CUTOVER"
+	}
+	return s.send(
+		&pgproto3.CommandComplete{CommandTag: []byte(tag)},
+		&pgproto3.ReadyForQuery{TxStatus: s.clientStatus()},
+	)
+}
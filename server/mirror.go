@@ -0,0 +1,422 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// defaultMirrorQueue is the number of statements that may be waiting to
+	// be replayed on a shadow backend (per session) before statements are
+	// dropped.
+	defaultMirrorQueue = 100
+)
+
+// outcome is the result of a statement (or extended query protocol batch) on
+// one backend.
+type outcome struct {
+	Started time.Time `json:"-"`
+	// Tags are the `CommandComplete` tags, e.g. `INSERT 0 3`.
+	Tags []string `json:"tags,omitempty"`
+	// Rows is the total row count from the tags.
+	Rows    int64    `json:"rows"`
+	Code    string   `json:"code,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Latency Duration `json:"latency"`
+}
+
+func newOutcome() *outcome {
+	return &outcome{Started: time.Now()}
+}
+
+// Observe records the status messages in a response.
+func (o *outcome) Observe(chunk []byte) {
+	switch chunk[0] {
+	case 'C', 'E':
+		bm, err := postgres.ParseBackendChunk(chunk)
+		if err != nil {
+			return
+		}
+		switch m := bm.(type) {
+		case *pgproto3.CommandComplete:
+			tag := string(m.CommandTag)
+			o.Tags = append(o.Tags, tag)
+			if i := strings.LastIndex(tag, " "); i != -1 {
+				rows, err := strconv.ParseInt(tag[i+1:], 10, 64)
+				if err == nil {
+					o.Rows += rows
+				}
+			}
+		case *pgproto3.ErrorResponse:
+			if o.Code == "" {
+				o.Code = m.Code
+				o.Message = m.Message
+			}
+		}
+	case 'Z':
+		o.Latency = Duration(time.Since(o.Started))
+	}
+}
+
+// Matches determines if two outcomes agree: both failed with the same
+// SQLSTATE or both succeeded with the same command tags.
+func (o *outcome) Matches(other *outcome) bool {
+	if o.Code != "" || other.Code != "" {
+		return o.Code == other.Code
+	}
+	if len(o.Tags) != len(other.Tags) {
+		return false
+	}
+	for i, tag := range o.Tags {
+		if tag != other.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// mirrorModeShadow replays statements on a shadow backend (see
+	// `router.Rule.Mirror`); statements may be dropped.
+	mirrorModeShadow = "mirror"
+	// mirrorModeDualWrite applies writes to the other backend of a migration
+	// (see `router.Rule.MigrateTo`); writes are never dropped.
+	mirrorModeDualWrite = "dual_write"
+)
+
+// mirrorJob is a statement (or extended query protocol batch) to replay on
+// a shadow backend.
+type mirrorJob struct {
+	Backend string
+	Mirror  string
+	Mode    string
+	SQL     string
+	Chunk   []byte
+	// Record indicates the outcomes should be compared and recorded; this is
+	// not the case for transaction control that is replayed to keep the
+	// shadow backend consistent.
+	Record bool
+	// InTransaction indicates the client was in a transaction when the
+	// statement was sent.
+	InTransaction bool
+	Primary       *outcome
+	// PrimaryDone is closed once the owning backend has responded.
+	PrimaryDone <-chan struct{}
+}
+
+// mirrorRecord is the comparison of the outcomes of a statement on the
+// owning backend and a shadow backend.
+type mirrorRecord struct {
+	Time    time.Time `json:"time"`
+	Backend string    `json:"backend"`
+	Mirror  string    `json:"mirror"`
+	Mode    string    `json:"mode"`
+	SQL     string    `json:"sql"`
+	Match   bool      `json:"match"`
+	Primary *outcome  `json:"primary"`
+	Shadow  *outcome  `json:"shadow"`
+}
+
+// mirrorStats counts the statements replayed on shadow backends and writes
+// the comparisons to the mirror log (if configured).
+type mirrorStats struct {
+	Mutex      sync.Mutex
+	Log        io.Writer
+	Statements int64
+	Matched    int64
+	Mismatched int64
+	Dropped    int64
+}
+
+// Record counts a comparison and writes it to the log. Mismatches are also
+// logged to STDERR.
+func (ms *mirrorStats) Record(r mirrorRecord) {
+	ms.Mutex.Lock()
+	defer ms.Mutex.Unlock()
+
+	ms.Statements++
+	if r.Match {
+		ms.Matched++
+	} else {
+		ms.Mismatched++
+		logf(
+			"Mismatch (%s) for %q; backend %q: %s, mirror %q: %s",
+			r.Mode, r.SQL, r.Backend, r.Primary.summary(), r.Mirror, r.Shadow.summary(),
+		)
+	}
+
+	if ms.Log == nil {
+		return
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		logf("Failed to encode mirror record; %v", err)
+		return
+	}
+	_, err = ms.Log.Write(append(line, '\n'))
+	if err != nil {
+		logf("Failed to write mirror record; %v", err)
+	}
+}
+
+// Drop counts a statement that was not replayed because the queue was full.
+func (ms *mirrorStats) Drop() {
+	ms.Mutex.Lock()
+	ms.Dropped++
+	ms.Mutex.Unlock()
+}
+
+func (o *outcome) summary() string {
+	if o.Code != "" {
+		return fmt.Sprintf("error %s (%s)", o.Code, o.Message)
+	}
+	return strings.Join(o.Tags, ", ")
+}
+
+// mirror replays a session's statements on a shadow backend, over a
+// connection of its own. Replays happen in a goroutine so they never delay
+// the responses to the client.
+type mirror struct {
+	Session *session
+	Backend *backend
+	Jobs    chan *mirrorJob
+	Conn    *serverConn
+	// InTransaction indicates a transaction was started on the shadow
+	// backend. This is only accessed from the session's goroutine.
+	InTransaction bool
+	// DualWrite indicates the transaction on the shadow backend contains
+	// dual writes, so ending it must not be dropped.
+	DualWrite bool
+	// Skipping indicates the `BEGIN` of the client's transaction was
+	// dropped, so its other shadow jobs are dropped as well (replaying them
+	// outside of the transaction would make the shadow diverge).
+	Skipping bool
+}
+
+// mirrorTo returns the session's mirror for a shadow backend, starting it if
+// needed.
+func (s *session) mirrorTo(name string) *mirror {
+	if m, ok := s.Mirrors[name]; ok {
+		return m
+	}
+
+	queue := s.Server.config().Mirroring.Queue
+	if queue == 0 {
+		queue = defaultMirrorQueue
+	}
+	m := &mirror{
+		Session: s,
+		Backend: s.Server.backend(name),
+		Jobs:    make(chan *mirrorJob, queue),
+	}
+	s.Mirrors[name] = m
+	go m.Run()
+	return m
+}
+
+// mirrorJob prepares the mirroring of a statement (or batch) according to a
+// routing decision. Returns `nil` if the statement is not mirrored. A dual
+// write takes precedence over a shadow backend.
+func (s *session) mirrorJob(d router.Decision, sql string, chunk []byte) *mirrorJob {
+	if d.FanOut {
+		return nil
+	}
+	job := &mirrorJob{
+		Backend:       d.Backend,
+		Mirror:        d.DualWrite,
+		Mode:          mirrorModeDualWrite,
+		SQL:           sql,
+		Chunk:         chunk,
+		Record:        true,
+		InTransaction: s.clientStatus() != 'I',
+	}
+	if job.Mirror == "" {
+		job.Mirror = d.Mirror
+		job.Mode = mirrorModeShadow
+	}
+	if job.Mirror == "" {
+		return nil
+	}
+	return job
+}
+
+// rebindMirror prepares the mirroring of a batch that binds a mirrored
+// prepared statement.
+func (s *session) rebindMirror(prepared *mirrorJob) *mirrorJob {
+	return &mirrorJob{
+		Backend:       prepared.Backend,
+		Mirror:        prepared.Mirror,
+		Mode:          prepared.Mode,
+		SQL:           prepared.SQL,
+		Record:        true,
+		InTransaction: s.clientStatus() != 'I',
+	}
+}
+
+// observedCycle returns the cycle for a request to the owning backend.
+// Responses are forwarded to the client and, if the request is mirrored,
+// observed for comparison.
+func (s *session) observedCycle(job *mirrorJob) *cycle {
+	if job == nil {
+		return newCycle(nil)
+	}
+
+	job.Primary = newOutcome()
+	c := newCycle(func(chunk []byte) error {
+		job.Primary.Observe(chunk)
+		return s.writeClient(chunk)
+	})
+	job.PrimaryDone = c.Done
+	return c
+}
+
+// enqueueMirror queues a job for the shadow backend. A statement inside a
+// transaction is preceded by a `BEGIN` (once per transaction). If the queue
+// is full the job is dropped rather than delaying the client; if the `BEGIN`
+// is dropped, the rest of the transaction is dropped too.
+func (s *session) enqueueMirror(job *mirrorJob) {
+	if job == nil {
+		return
+	}
+	m := s.mirrorTo(job.Mirror)
+	if m.Skipping && job.Mode != mirrorModeDualWrite {
+		s.Server.Mirroring.Drop()
+		return
+	}
+	if job.InTransaction && !m.InTransaction {
+		// NOTE: A dual write waits for room, so its `BEGIN` is never dropped.
+		begin := &mirrorJob{Mode: job.Mode, SQL: "BEGIN", Chunk: (&pgproto3.Query{String: "BEGIN"}).Encode(nil)}
+		m.InTransaction = m.enqueue(begin)
+		m.Skipping = !m.InTransaction
+		if m.Skipping {
+			s.Server.Mirroring.Drop()
+			return
+		}
+	}
+	if m.InTransaction && job.Mode == mirrorModeDualWrite {
+		m.DualWrite = true
+	}
+	m.enqueue(job)
+}
+
+// mirrorTransactionEnd replays a `COMMIT` or `ROLLBACK` on every shadow
+// backend where a transaction was started; a transaction whose `BEGIN` was
+// dropped ends with it.
+func (s *session) mirrorTransactionEnd(sql string, chunk []byte) {
+	for _, m := range s.Mirrors {
+		if m.Skipping {
+			m.Skipping = false
+			s.Server.Mirroring.Drop()
+			continue
+		}
+		if !m.InTransaction {
+			continue
+		}
+		mode := mirrorModeShadow
+		if m.DualWrite {
+			mode = mirrorModeDualWrite
+		}
+		m.enqueue(&mirrorJob{Mode: mode, SQL: sql, Chunk: chunk})
+		m.InTransaction = false
+		m.DualWrite = false
+	}
+}
+
+// enqueue queues a job; a shadow job is dropped if the queue is full while
+// a dual write waits for room.
+func (m *mirror) enqueue(job *mirrorJob) bool {
+	if job.Mode == mirrorModeDualWrite {
+		m.Jobs <- job
+		return true
+	}
+	select {
+	case m.Jobs <- job:
+		return true
+	default:
+		m.Session.Server.Mirroring.Drop()
+		return false
+	}
+}
+
+// Run replays jobs until the queue is closed.
+func (m *mirror) Run() {
+	for job := range m.Jobs {
+		m.replay(job)
+	}
+	if m.Conn != nil {
+		_ = m.Conn.Close()
+	}
+}
+
+func (m *mirror) replay(job *mirrorJob) {
+	shadow := newOutcome()
+	err := m.send(job.Chunk, shadow)
+	if err != nil {
+		shadow.Code = "08000"
+		shadow.Message = err.Error()
+	}
+	if !job.Record {
+		return
+	}
+
+	<-job.PrimaryDone
+	m.Session.Server.Mirroring.Record(mirrorRecord{
+		Time:    shadow.Started,
+		Backend: job.Backend,
+		Mirror:  m.Backend.Config.Name,
+		Mode:    job.Mode,
+		SQL:     job.SQL,
+		Match:   job.Primary.Matches(shadow),
+		Primary: job.Primary,
+		Shadow:  shadow,
+	})
+}
+
+// send sends a request to the shadow backend (connecting if needed) and
+// waits for the response.
+func (m *mirror) send(chunk []byte, o *outcome) error {
+	if m.Conn != nil && m.Conn.Broken() {
+		_ = m.Conn.Close()
+		m.Conn = nil
+	}
+	err := m.Backend.WaitResumed(time.Duration(m.Session.Server.config().Pause.MaxDuration))
+	if err != nil {
+		return err
+	}
+	if m.Conn == nil {
+		sc, err := dialServer(m.Backend.Config.Name, m.Backend.Config.Primary, false)
+		if err != nil {
+			return err
+		}
+		err = sc.Startup(m.Session.backendParameters(m.Backend), m.Backend.Config.Password)
+		if err != nil {
+			return appendErrs(err, sc.Conn.Close())
+		}
+		sc.Start(discardResponse, func(error, bool) {})
+		m.Conn = sc
+	}
+
+	c := newCycle(func(chunk []byte) error {
+		o.Observe(chunk)
+		return nil
+	})
+	err = m.Conn.Send(chunk, c)
+	if err != nil {
+		return err
+	}
+	<-c.Done
+	if m.Conn.Broken() {
+		return m.Conn.Err
+	}
+	return nil
+}
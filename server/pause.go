@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// pausePollInterval is how often `drain()` checks whether the
+	// transactions open on a paused backend have finished.
+	pausePollInterval = 10 * time.Millisecond
+)
+
+// pause holds new statements for a backend.
+func (ps *proxyServer) pause(name string) (*backend, error) {
+	b := ps.backend(name)
+	if b == nil {
+		return nil, fmt.Errorf("%w; backend %q", ErrAdminObjectNotFound, name)
+	}
+	if b.Pause() {
+		logf("Backend %q paused", name)
+	}
+	return b, nil
+}
+
+// drain pauses a backend and then waits for the work in flight on it (a
+// statement awaiting its `ReadyForQuery` or an open transaction) to finish,
+// for at most the maximum pause duration (if set). Returns the number of
+// server connections still in flight.
+func (ps *proxyServer) drain(name string) (int, error) {
+	b, err := ps.pause(name)
+	if err != nil {
+		return 0, err
+	}
+
+	maxPause := time.Duration(ps.config().Pause.MaxDuration)
+	for {
+		inFlight := ps.inFlight(name)
+		if inFlight == 0 {
+			return 0, nil
+		}
+		pausedFor := b.PausedFor()
+		if pausedFor == 0 || (maxPause > 0 && pausedFor > maxPause) {
+			return inFlight, nil
+		}
+		time.Sleep(pausePollInterval)
+	}
+}
+
+// resume releases the statements held for a paused backend.
+func (ps *proxyServer) resume(name string) error {
+	b := ps.backend(name)
+	if b == nil {
+		return fmt.Errorf("%w; backend %q", ErrAdminObjectNotFound, name)
+	}
+	if b.Resume() {
+		logf("Backend %q resumed", name)
+	}
+	return nil
+}
+
+// inFlight counts the server connections to a backend (across all sessions)
+// that are waiting for a response or are in a transaction.
+func (ps *proxyServer) inFlight(name string) int {
+	count := 0
+	for _, s := range ps.Sessions.List() {
+		for _, sc := range s.conns() {
+			if sc.Backend == name && (sc.Busy() || sc.Status() != 'I') {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// waitResumed holds a statement while its backend is paused. Statements in a
+// transaction that is already open are never held (see `pick()`), so
+// in-flight transactions can finish.
+func (s *session) waitResumed(name string) error {
+	b := s.Server.backend(name)
+	if b == nil {
+		return fmt.Errorf("%w; %s: the backend was removed", ErrBackendUnavailable, name)
+	}
+	if !b.IsPaused() {
+		return nil
+	}
+
+	s.setWaiting(name)
+	defer s.setWaiting("")
+	return b.WaitResumed(time.Duration(s.Server.config().Pause.MaxDuration))
+}
+
+func (s *session) setWaiting(name string) {
+	s.Mutex.Lock()
+	s.Waiting = name
+	s.Mutex.Unlock()
+}
@@ -1,178 +1,454 @@
 package server
 
 import (
+	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
-	"os"
+	"reflect"
 	"sync"
-	"time"
+	"sync/atomic"
 
-	"github.com/auxten/postgresql-parser/pkg/sql/parser"
 	"github.com/jackc/pgproto3/v2"
 
 	"github.com/dhermes/postgresql-schema-router/postgres"
+	"github.com/dhermes/postgresql-schema-router/router"
 )
 
-const (
-	readTimeout = 250 * time.Millisecond
-)
+// proxyServer is the state shared by every client connection.
+type proxyServer struct {
+	// Mutex guards `Config`, `Router`, `Backends` and `Lookups`, which are
+	// replaced by `apply()` (e.g. for `RELOAD`); sessions use the accessors
+	// (e.g. `router()`).
+	Mutex    sync.RWMutex
+	Config   Config
+	Router   *router.Router
+	Backends map[string]*backend
+	Lookups  map[string]*router.Table
+	// StopLookups is closed to stop refreshing the current lookup tables.
+	StopLookups chan struct{}
+	// Mirroring records the statements replayed on shadow backends.
+	Mirroring *mirrorStats
+	// Audit records every statement executed; `nil` if disabled.
+	Audit      *auditLog
+	Stats      *proxyStats
+	Latency    *latencyStats
+	Statements *statementStats
+	// ParseFailures records the SQL the parser failed on.
+	ParseFailures *parseFailures
+	// Allowlist holds the allowed statement fingerprints; `nil` if no file
+	// is configured. It is replaced by `apply()` if the file changes.
+	Allowlist *allowlist
+	// Tracer exports OpenTelemetry spans; `nil` if disabled.
+	Tracer *tracer
 
-type forwardState struct {
-	Mutex  sync.RWMutex
-	Errors []error
-	Done   bool
-}
+	// Cancels maps the key data issued to each client (by its startup
+	// connection) to the client's session.
+	CancelMutex sync.Mutex
+	Cancels     map[cancelKey]*session
 
-func (fs *forwardState) AddError(err error) {
-	fs.Mutex.Lock()
-	defer fs.Mutex.Unlock()
-	fs.Errors = append(fs.Errors, err)
-	fs.Done = true
+	// Sessions are the client sessions (other than admin console
+	// sessions).
+	Sessions *sessionRegistry
 }
 
-func (fs *forwardState) IsDone() bool {
-	fs.Mutex.RLock()
-	defer fs.Mutex.RUnlock()
-	return fs.Done
+// proxyStats are counters across every session.
+type proxyStats struct {
+	Sessions int64
+	Queries  int64
 }
 
-func (fs *forwardState) MarkDone() {
-	fs.Mutex.Lock()
-	defer fs.Mutex.Unlock()
-	fs.Done = true
+// cancelKey identifies a server process for a `CancelRequest`.
+type cancelKey struct {
+	ProcessID uint32
+	SecretKey uint32
 }
 
-type packetInspector func(data []byte)
+func newProxyServer(c Config) (*proxyServer, error) {
+	tables, err := loadLookups(c)
+	if err != nil {
+		return nil, err
+	}
 
-func forward(wg *sync.WaitGroup, r, w *net.TCPConn, fs *forwardState, pi packetInspector) {
-	defer wg.Done()
+	o := router.Options{
+		DefaultBackend: c.DefaultBackendName(),
+		Backends:       c.BackendNames(),
+		Lookups:        map[string]router.Lookup{},
+		Catalog:        c.Catalog,
+		Connections:    c.ConnectionRoutes,
+		Functions:      c.Functions,
+		DDL:            c.DDL,
+		Firewall:       c.Firewall,
+	}
+	for name, t := range tables {
+		o.Lookups[name] = t
+	}
+	r, err := router.New(c.Routes, o)
+	if err != nil {
+		return nil, err
+	}
 
-	data := make([]byte, 65536)
-	for {
-		if fs.IsDone() {
-			return
-		}
+	ps := &proxyServer{
+		Config:   c,
+		Router:   r,
+		Backends: map[string]*backend{},
+		Lookups:  tables,
+		Cancels:  map[cancelKey]*session{},
+		Sessions: newSessionRegistry(),
+
+		StopLookups: make(chan struct{}),
+		Mirroring:   &mirrorStats{},
+		Stats:       &proxyStats{},
+		Latency:     newLatencyStats(),
+		Statements:  newStatementStats(),
+
+		ParseFailures: newParseFailures(),
+	}
+	for _, bc := range c.BackendConfigs() {
+		ps.Backends[bc.Name] = newBackend(bc)
+	}
+	return ps, nil
+}
 
-		readDeadline := time.Now().Add(readTimeout)
-		err := r.SetReadDeadline(readDeadline)
+// reload reads the configuration file again and applies it (see `apply()`),
+// then reads the allowlist file again (unless `apply()` just opened it). The
+// proxy port cannot change.
+func (ps *proxyServer) reload() error {
+	current := ps.config()
+	if current.Path == "" {
+		return fmt.Errorf("%w; the configuration was not loaded from a file", ErrReload)
+	}
+	c, err := LoadConfig(current.Path)
+	if err != nil {
+		return err
+	}
+	c.ProxyPort = current.ProxyPort
+	previous := ps.allowlist()
+	err = ps.apply(c)
+	al := ps.allowlist()
+	if err != nil || al == nil || al != previous {
+		return err
+	}
+	return al.Load()
+}
+
+// replaceRoutes applies the current configuration with a new routing table.
+func (ps *proxyServer) replaceRoutes(routes []router.Rule) error {
+	c := ps.config()
+	c.Routes = routes
+	return ps.apply(c)
+}
+
+// apply validates a configuration and replaces the routes, backends and
+// lookup tables. Backends with an unchanged configuration keep their state
+// (e.g. paused or replica health), as do migrations that were cut over; open
+// server connections are kept.
+func (ps *proxyServer) apply(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	next, err := newProxyServer(c)
+	if err != nil {
+		return fmt.Errorf("%w; %v", ErrReload, err)
+	}
+	// NOTE: The allowlist is only opened again if its file changed; a new
+	//       `mode` is read from `Config` by each session.
+	al := ps.allowlist()
+	if al == nil || al.Path != c.Allowlist.File {
+		al, err = openAllowlist(c.Allowlist)
 		if err != nil {
-			fs.AddError(err)
-			return
+			return fmt.Errorf("%w; %v", ErrReload, err)
 		}
+	}
 
-		n, err := r.Read(data)
-		if err == io.EOF {
-			fs.MarkDone()
-			return
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+	for name, b := range next.Backends {
+		if existing, ok := ps.Backends[name]; ok && reflect.DeepEqual(existing.Config, b.Config) {
+			next.Backends[name] = existing
 		}
-		if err != nil {
-			if isTimeout(err) {
-				continue
+	}
+	for _, m := range ps.Router.Migrations() {
+		for _, candidate := range next.Router.Migrations() {
+			if candidate.Schema == m.Schema && candidate.From == m.From && candidate.To == m.To {
+				_ = next.Router.CutOver(m.Schema, m.CutOver())
 			}
-			fs.AddError(err)
-			return
-		}
-		// Ensure we have read a "complete" TCP packet, with a limit on the size.
-		if n >= 65536 {
-			fs.AddError(fmt.Errorf("%w, exceeds 65536 bytes", ErrPacketTooLarge))
-			return
 		}
+	}
 
-		if pi != nil {
-			pi(data[:n])
-		}
+	close(ps.StopLookups)
+	ps.Config = c
+	ps.Router = next.Router
+	ps.Backends = next.Backends
+	ps.Lookups = next.Lookups
+	ps.StopLookups = next.StopLookups
+	ps.Allowlist = al
+	refreshLookups(c, ps.Lookups, ps.StopLookups)
+	return nil
+}
 
-		_, err = w.Write(data[:n])
-		if err != nil {
-			fs.AddError(err)
-			return
+func (ps *proxyServer) config() Config {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Config
+}
+
+func (ps *proxyServer) router() *router.Router {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Router
+}
+
+// allowlist returns the current allowlist; `nil` if no file is configured.
+func (ps *proxyServer) allowlist() *allowlist {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Allowlist
+}
+
+// backend returns a backend by name; this is `nil` for a backend that was
+// removed by `RELOAD`.
+func (ps *proxyServer) backend(name string) *backend {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Backends[name]
+}
+
+// backends returns every backend; the map must not be modified.
+func (ps *proxyServer) backends() map[string]*backend {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Backends
+}
+
+// registerCancel records the session that was issued key data (by its
+// startup connection). Returns a function that removes the record.
+func (ps *proxyServer) registerCancel(kd *pgproto3.BackendKeyData, s *session) func() {
+	key := cancelKey{ProcessID: kd.ProcessID, SecretKey: kd.SecretKey}
+	ps.CancelMutex.Lock()
+	ps.Cancels[key] = s
+	ps.CancelMutex.Unlock()
+
+	return func() {
+		ps.CancelMutex.Lock()
+		delete(ps.Cancels, key)
+		ps.CancelMutex.Unlock()
+	}
+}
+
+// cancel handles a `CancelRequest` by cancelling the in-flight work on each
+// of the session's server connections (which may be on any backend or
+// replica). Requests with unknown key data are ignored, just as PostgreSQL
+// ignores them.
+func (ps *proxyServer) cancel(cr *pgproto3.CancelRequest) error {
+	ps.CancelMutex.Lock()
+	s, ok := ps.Cancels[cancelKey{ProcessID: cr.ProcessID, SecretKey: cr.SecretKey}]
+	ps.CancelMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var errs []error
+	for _, sc := range s.conns() {
+		if sc.KeyData == nil || !sc.Busy() {
+			continue
 		}
+		errs = append(errs, sc.Cancel())
 	}
+	return appendErrs(errs...)
 }
 
 // proxyInternal is the underlying implementation for `proxy()`, but
 // it does not have to do any extra resolution of errors.
-func proxyInternal(tc *net.TCPConn, c Config) (err error) {
-	var sc *net.TCPConn
+func proxyInternal(s *session) (err error) {
 	defer func() {
-		if sc == nil {
-			return
-		}
-		err = appendErrs(err, sc.Close())
+		err = appendErrs(err, s.Close())
 	}()
 
-	addr, err := net.ResolveTCPAddr("tcp", c.RemoteAddr)
-	if err != nil {
+	ps := s.Server
+	s.Span = ps.Tracer.Start("accept", spanKindServer, nil)
+	s.Span.Set("client.address", s.Client.RemoteAddr().String())
+	chunk, err := s.ReceiveStartup()
+	if err != nil || chunk == nil {
+		// NOTE: A `CancelRequest` (no error) is not traced.
+		if err != nil {
+			s.Span.End(err)
+		}
 		return
 	}
 
-	sc, err = net.DialTCP("tcp", nil, addr)
-	if err != nil {
+	admin := ps.config().Admin
+	if admin.Database != "" && s.Parameters["database"] == admin.Database {
+		err = s.RunAdmin()
 		return
 	}
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	fs := forwardState{}
-	go forward(&wg, tc, sc, &fs, inspectFrontendMessage) // Client->Proxy->Remote
-	go forward(&wg, sc, tc, &fs, inspectBackendMessage)  // Remote->Proxy->Client
-	wg.Wait()
+	s.Span.Adopt(applicationTraceparent(s.Parameters["application_name"]))
+	s.Span.Set("db.user", s.Parameters["user"])
+	s.Span.Set("db.name", s.Parameters["database"])
+	err = s.ConnectStartup(chunk)
+	if err != nil {
+		s.Span.End(err)
+		return
+	}
+	atomic.AddInt64(&ps.Stats.Sessions, 1)
+	unregister := ps.Sessions.Register(s)
+	defer unregister()
+	s.Span.Set("router.session", s.ID)
+	s.Span.End(nil)
 
-	err = appendErrs(fs.Errors...)
-	return nil
+	err = s.Run()
+	return
 }
 
 // proxy is the "pristine" function to be directly used in a `goroutine`.
 // It is fully responsible for cleaning up after itself.
-func proxy(tc *net.TCPConn, c Config) {
-	err := proxyInternal(tc, c)
+func proxy(tc *net.TCPConn, ps *proxyServer) {
+	s := newSession(ps, tc)
+	err := proxyInternal(s)
 	if err == nil {
 		return
 	}
-	// LOG-TODO: Do something with the error
+	if s.ID == 0 {
+		logf("Session from %s ended with an error; %v", tc.RemoteAddr(), err)
+		return
+	}
+	logf("Session %d from %s ended with an error; %v", s.ID, tc.RemoteAddr(), err)
+}
+
+// ReceiveStartup reads messages from the client until a `StartupMessage`
+// is received. Requests for encryption are declined and a `CancelRequest` is
+// forwarded (in which case the returned chunk is `nil`).
+func (s *session) ReceiveStartup() ([]byte, error) {
+	for {
+		chunk, err := postgres.ReadStartupMessage(s.Reader)
+		if err != nil {
+			return nil, err
+		}
+		s.Activity.Received(chunk)
+		fm, err := postgres.ParseChunk(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m := fm.(type) {
+		case *pgproto3.SSLRequest, *pgproto3.GSSEncRequest:
+			// NOTE: Encryption is not supported, the client is expected to
+			//       continue with an unencrypted `StartupMessage`.
+			_, err = s.Client.Write([]byte{'N'})
+			if err != nil {
+				return nil, err
+			}
+		case *pgproto3.CancelRequest:
+			return nil, s.Server.cancel(m)
+		case *pgproto3.StartupMessage:
+			s.Parameters = m.Parameters
+			s.Backend = s.Server.router().ConnectionBackend(m.Parameters)
+			if searchPath, ok := m.Parameters["search_path"]; ok {
+				s.SearchPath = router.ParseSearchPath(searchPath)
+			}
+			return chunk, nil
+		default:
+			return nil, fmt.Errorf("%w; %T during startup", ErrUnexpectedMessage, fm)
+		}
+	}
 }
 
-func inspectFrontendMessage(chunk []byte) {
-	fm, err := postgres.ParseChunk(chunk)
+// ConnectStartup opens the client's startup connection to the primary of the
+// session's backend (see `router.ConnectionRule`). Authentication is relayed
+// between the client and the server so the client authenticates exactly as
+// it would without the proxy.
+func (s *session) ConnectStartup(chunk []byte) error {
+	name := s.Backend
+	err := s.waitResumed(name)
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Failed to parse TCP chunk as PostgreSQL frontend message; %v",
-			err,
-		)
-		return
+		return appendErrs(err, s.sendFatal(err))
+	}
+	b := s.Server.backend(name)
+	sp := s.startSpan("dial", spanKindClient, name)
+	sp.Set("server.address", b.Config.Primary)
+	sc, err := dialServer(name, b.Config.Primary, false)
+	sp.End(err)
+	if err != nil {
+		err = fmt.Errorf("%w; %s: %v", ErrBackendUnavailable, name, err)
+		return appendErrs(err, s.sendFatal(err))
 	}
 
-	q, ok := fm.(*pgproto3.Query)
-	if !ok {
-		fmt.Printf("FrontendMessage: %T [%d]\n", fm, len(chunk))
-		return
+	sp = s.startSpan("authenticate", spanKindInternal, name)
+	err = s.relayStartup(b, sc, chunk)
+	sp.End(err)
+	if err != nil {
+		return appendErrs(err, sc.Conn.Close())
 	}
+	return nil
+}
 
-	statements, err := parser.Parse(q.String)
+// relayStartup sends the client's `StartupMessage` to the startup connection
+// and relays messages until the server is ready for queries.
+func (s *session) relayStartup(b *backend, sc *serverConn, chunk []byte) error {
+	_, err := sc.Conn.Write(chunk)
 	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Failed to parse SQL from PostgreSQL Query; %v",
-			err,
-		)
-		return
+		return err
 	}
 
-	fmt.Printf("Query Statements [%d]: %#v\n", len(chunk), statements)
+	for {
+		response, err := postgres.ReadMessage(sc.Reader)
+		if err != nil {
+			return err
+		}
+		err = s.writeClient(response)
+		if err != nil {
+			return err
+		}
+
+		switch response[0] {
+		case 'R':
+			err = relayAuthentication(s, sc, response)
+			if err != nil {
+				return err
+			}
+		case 'K':
+			bm, err := postgres.ParseBackendChunk(response)
+			if err != nil {
+				return err
+			}
+			sc.KeyData, _ = bm.(*pgproto3.BackendKeyData)
+			if sc.KeyData != nil {
+				s.Unregister = s.Server.registerCancel(sc.KeyData, s)
+			}
+		case 'E':
+			return fmt.Errorf("%w; startup failed", postgres.ErrAuthentication)
+		case 'Z':
+			sc.TxStatus = response[5]
+			sc.Release = b.Acquire()
+			s.Startup = sc
+			s.addConn(sc)
+			return nil
+		}
+	}
 }
 
-func inspectBackendMessage(chunk []byte) {
-	description, err := postgres.DescribeBackendMessage(chunk)
-	if err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"Failed to parse TCP chunk as PostgreSQL frontend message; %v",
-			err,
-		)
-		return
+// relayAuthentication forwards the client's response to an authentication
+// request (if the request requires one).
+func relayAuthentication(s *session, sc *serverConn, request []byte) error {
+	if len(request) < 9 {
+		return fmt.Errorf("%w; authentication request too short", postgres.ErrParsingServerMessage)
+	}
+
+	authType := binary.BigEndian.Uint32(request[5:9])
+	switch authType {
+	case pgproto3.AuthTypeCleartextPassword,
+		pgproto3.AuthTypeMD5Password,
+		pgproto3.AuthTypeSASL,
+		pgproto3.AuthTypeSASLContinue:
+		response, err := postgres.ReadMessage(s.Reader)
+		if err != nil {
+			return err
+		}
+		s.Activity.Received(response)
+		_, err = sc.Conn.Write(response)
+		return err
 	}
 
-	fmt.Printf("BackendMessage: %s [%d]\n", description, len(chunk))
+	return nil
 }
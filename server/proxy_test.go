@@ -0,0 +1,255 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// startProxy serves client connections for a configuration on a random port
+// until the test ends.
+func startProxy(t *testing.T, c Config) (*proxyServer, string) {
+	t.Helper()
+	ps, err := newProxyServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			tc, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go proxy(tc, ps)
+		}
+	}()
+	return ps, listener.Addr().String()
+}
+
+// fakeBackend is a PostgreSQL server with just enough of the protocol to
+// exercise the proxy: every query returns a single row with the name of the
+// backend and the SQL it received, or fails if it mentions `fail`.
+type fakeBackend struct {
+	Name string
+	Addr string
+}
+
+// startBackend serves connections for a fake backend on a random port until
+// the test ends.
+func startBackend(t *testing.T, name string) *fakeBackend {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	fb := &fakeBackend{Name: name, Addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fb.serve(conn)
+		}
+	}()
+	return fb
+}
+
+func (fb *fakeBackend) serve(conn net.Conn) {
+	defer conn.Close()
+	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	for {
+		m, err := be.ReceiveStartupMessage()
+		if err != nil {
+			return
+		}
+		if _, ok := m.(*pgproto3.StartupMessage); ok {
+			break
+		}
+		if _, ok := m.(*pgproto3.SSLRequest); !ok {
+			return
+		}
+		_, err = conn.Write([]byte{'N'})
+		if err != nil {
+			return
+		}
+	}
+
+	status := byte('I')
+	messages := []pgproto3.BackendMessage{
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2},
+		&pgproto3.ReadyForQuery{TxStatus: status},
+	}
+	for {
+		for _, m := range messages {
+			err := be.Send(m)
+			if err != nil {
+				return
+			}
+		}
+		m, err := be.Receive()
+		if err != nil {
+			return
+		}
+		q, ok := m.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+
+		upper := strings.ToUpper(strings.TrimSpace(q.String))
+		switch {
+		case strings.Contains(q.String, "fail"):
+			messages = []pgproto3.BackendMessage{&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: fb.Name + " failed"}}
+			if status == 'T' {
+				status = 'E'
+			}
+		case strings.HasPrefix(upper, "BEGIN"):
+			status = 'T'
+			messages = []pgproto3.BackendMessage{&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")}}
+		case strings.HasPrefix(upper, "COMMIT"), strings.HasPrefix(upper, "ROLLBACK"):
+			status = 'I'
+			messages = []pgproto3.BackendMessage{&pgproto3.CommandComplete{CommandTag: []byte("COMMIT")}}
+		default:
+			messages = []pgproto3.BackendMessage{
+				&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{
+					{Name: []byte("backend"), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+					{Name: []byte("sql"), DataTypeOID: 25, DataTypeSize: -1, TypeModifier: -1},
+				}},
+				&pgproto3.DataRow{Values: [][]byte{[]byte(fb.Name), []byte(q.String)}},
+				&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			}
+		}
+		messages = append(messages, &pgproto3.ReadyForQuery{TxStatus: status})
+	}
+}
+
+// testClient is a PostgreSQL client with just enough of the protocol to
+// exercise the proxy.
+type testClient struct {
+	T        *testing.T
+	Conn     net.Conn
+	Frontend *pgproto3.Frontend
+}
+
+// dialProxy connects to the proxy and sends a `StartupMessage`; every read
+// and write fails after a few seconds rather than hanging the test.
+func dialProxy(t *testing.T, addr string, parameters map[string]string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := &testClient{T: t, Conn: conn, Frontend: pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)}
+	tc.Send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: parameters})
+	return tc
+}
+
+// Send sends messages to the proxy.
+func (tc *testClient) Send(messages ...pgproto3.FrontendMessage) {
+	tc.T.Helper()
+	for _, m := range messages {
+		err := tc.Frontend.Send(m)
+		if err != nil {
+			tc.T.Fatal(err)
+		}
+	}
+}
+
+// Receive reads the next message from the proxy.
+func (tc *testClient) Receive() pgproto3.BackendMessage {
+	tc.T.Helper()
+	m, err := tc.Frontend.Receive()
+	if err != nil {
+		tc.T.Fatal(err)
+	}
+	return m
+}
+
+// ReceiveUntilReady reads messages from the proxy up to (and including) the
+// next `ReadyForQuery`.
+func (tc *testClient) ReceiveUntilReady() []pgproto3.BackendMessage {
+	tc.T.Helper()
+	var messages []pgproto3.BackendMessage
+	for {
+		m := tc.Receive()
+		messages = append(messages, m)
+		if _, ok := m.(*pgproto3.ReadyForQuery); ok {
+			return messages
+		}
+	}
+}
+
+// Query sends a simple query and returns the rows (each value as a string)
+// or the error response.
+func (tc *testClient) Query(sql string) ([][]string, *pgproto3.ErrorResponse) {
+	tc.T.Helper()
+	tc.Send(&pgproto3.Query{String: sql})
+	// NOTE: Messages are received one at a time since the frontend reuses
+	//       them.
+	var rows [][]string
+	var er *pgproto3.ErrorResponse
+	for {
+		switch m := tc.Receive().(type) {
+		case *pgproto3.DataRow:
+			row := make([]string, len(m.Values))
+			for i, value := range m.Values {
+				row[i] = string(value)
+			}
+			rows = append(rows, row)
+		case *pgproto3.ErrorResponse:
+			copied := *m
+			er = &copied
+		case *pgproto3.ReadyForQuery:
+			return rows, er
+		}
+	}
+}
+
+// login connects to the proxy and completes the startup.
+func login(t *testing.T, addr string, parameters map[string]string) *testClient {
+	t.Helper()
+	tc := dialProxy(t, addr, parameters)
+	for _, m := range tc.ReceiveUntilReady() {
+		if er, ok := m.(*pgproto3.ErrorResponse); ok {
+			t.Fatalf("startup failed; %s", er.Message)
+		}
+	}
+	return tc
+}
+
+// ExpectClosed fails the test unless the proxy closes the connection
+// (without sending anything else).
+func (tc *testClient) ExpectClosed() {
+	tc.T.Helper()
+	m, err := tc.Frontend.Receive()
+	if err == nil {
+		tc.T.Fatalf("received %#v, expected the connection to be closed", m)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		tc.T.Fatalf("connection is still open; %v", err)
+	}
+}
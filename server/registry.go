@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionRegistry tracks the client sessions (other than admin console
+// sessions) by ID, for the admin console, the HTTP API, logs and statistics.
+type sessionRegistry struct {
+	Mutex    sync.RWMutex
+	Sessions map[uint64]*session
+	NextID   uint64
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{Sessions: map[uint64]*session{}}
+}
+
+// Register assigns an ID to a session and tracks it until the returned
+// function is invoked.
+func (sr *sessionRegistry) Register(s *session) func() {
+	sr.Mutex.Lock()
+	sr.NextID++
+	s.ID = sr.NextID
+	sr.Sessions[s.ID] = s
+	sr.Mutex.Unlock()
+
+	return func() {
+		sr.Mutex.Lock()
+		delete(sr.Sessions, s.ID)
+		sr.Mutex.Unlock()
+	}
+}
+
+// Get returns a tracked session by ID.
+func (sr *sessionRegistry) Get(id uint64) (*session, error) {
+	sr.Mutex.RLock()
+	defer sr.Mutex.RUnlock()
+	s, ok := sr.Sessions[id]
+	if !ok {
+		return nil, fmt.Errorf("%w; session %d", ErrAdminObjectNotFound, id)
+	}
+	return s, nil
+}
+
+// List returns the tracked sessions, ordered by ID.
+func (sr *sessionRegistry) List() []*session {
+	sr.Mutex.RLock()
+	sessions := make([]*session, 0, len(sr.Sessions))
+	for _, s := range sr.Sessions {
+		sessions = append(sessions, s)
+	}
+	sr.Mutex.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Len returns the number of tracked sessions.
+func (sr *sessionRegistry) Len() int {
+	sr.Mutex.RLock()
+	defer sr.Mutex.RUnlock()
+	return len(sr.Sessions)
+}
+
+// sessionActivity counts the traffic between a client and the proxy. The
+// fields are updated atomically; `LastActivity` is a Unix time in
+// nanoseconds and `TxStatus` is the transaction status from the most recent
+// `ReadyForQuery` sent to the client.
+type sessionActivity struct {
+	BytesReceived    int64
+	BytesSent        int64
+	MessagesReceived int64
+	MessagesSent     int64
+	LastActivity     int64
+	TxStatus         int32
+}
+
+// Received records a message read from the client.
+func (sa *sessionActivity) Received(chunk []byte) {
+	atomic.AddInt64(&sa.BytesReceived, int64(len(chunk)))
+	atomic.AddInt64(&sa.MessagesReceived, 1)
+	atomic.StoreInt64(&sa.LastActivity, time.Now().UnixNano())
+}
+
+// Sent records messages written to the client; `chunk` may hold several
+// complete messages.
+func (sa *sessionActivity) Sent(chunk []byte) {
+	atomic.AddInt64(&sa.BytesSent, int64(len(chunk)))
+	atomic.StoreInt64(&sa.LastActivity, time.Now().UnixNano())
+	eachMessage(chunk, func(message []byte) {
+		atomic.AddInt64(&sa.MessagesSent, 1)
+		if message[0] == 'Z' && len(message) == 6 {
+			atomic.StoreInt32(&sa.TxStatus, int32(message[5]))
+		}
+	})
+}
+
+// Last returns the time of the most recent message to or from the client.
+func (sa *sessionActivity) Last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sa.LastActivity))
+}
+
+// Transaction describes the transaction status the client last saw.
+func (sa *sessionActivity) Transaction() string {
+	switch atomic.LoadInt32(&sa.TxStatus) {
+	case 'T':
+		return "in transaction"
+	case 'E':
+		return "in failed transaction"
+	}
+	return "idle"
+}
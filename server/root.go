@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net"
+	"os"
 
 	"github.com/spf13/cobra"
 )
@@ -14,6 +15,46 @@ func Run(c Config) error {
 		return err
 	}
 
+	ps, err := newProxyServer(c)
+	if err != nil {
+		return err
+	}
+	refreshLookups(c, ps.Lookups, ps.StopLookups)
+
+	if c.Mirroring.Log != "" {
+		f, err := os.OpenFile(c.Mirroring.Log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		ps.Mirroring.Log = f
+	}
+
+	ps.Audit, err = openAuditLog(c.Audit)
+	if err != nil {
+		return err
+	}
+	if ps.Audit != nil {
+		defer ps.Audit.Close()
+	}
+
+	ps.Allowlist, err = openAllowlist(c.Allowlist)
+	if err != nil {
+		return err
+	}
+
+	ps.Tracer = newTracer(c.Tracing)
+	if ps.Tracer != nil {
+		defer ps.Tracer.Close()
+	}
+
+	if c.API.Addr != "" {
+		err = serveAPI(ps, c.API.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
 	proxyAddr := fmt.Sprintf("localhost:%d", c.ProxyPort)
 	addr, err := net.ResolveTCPAddr("tcp", proxyAddr)
 	if err != nil {
@@ -33,7 +74,7 @@ func Run(c Config) error {
 		}
 
 		// TODO: Use a channel here and a fixed set of goroutines to handle it
-		go proxy(tc, c)
+		go proxy(tc, ps)
 	}
 }
 
@@ -41,14 +82,19 @@ func Run(c Config) error {
 // application.
 func Execute() error {
 	c := Config{}
+	configFile := ""
 	cmd := &cobra.Command{
 		Use:           "postgresql-schema-router",
 		Short:         "PostgreSQL Reverse Proxy",
 		Long:          "PostgreSQL Reverse Proxy\n\nForward Queries Based on Schema.",
 		SilenceErrors: true,
 		SilenceUsage:  true,
-		RunE: func(_ *cobra.Command, _ []string) error {
-			return Run(c)
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			loaded, err := resolveConfig(cmd, c, configFile)
+			if err != nil {
+				return err
+			}
+			return Run(loaded)
 		},
 	}
 
@@ -64,6 +110,36 @@ func Execute() error {
 		"",
 		"The remote address  where the proxy should forward traffic (e.g. localhost:22089)",
 	)
+	cmd.PersistentFlags().StringVar(
+		&configFile,
+		"config",
+		"",
+		"Path to a JSON configuration file describing backends and routes",
+	)
+
+	cmd.AddCommand(newExplainRouteCommand(&c, &configFile))
 
 	return cmd.Execute()
 }
+
+// resolveConfig combines the configuration file (if any) with the values
+// from command line flags.
+func resolveConfig(cmd *cobra.Command, c Config, configFile string) (Config, error) {
+	if configFile == "" {
+		return c, nil
+	}
+
+	loaded, err := LoadConfig(configFile)
+	if err != nil {
+		return loaded, err
+	}
+	// NOTE: Flags that were explicitly provided take precedence over the
+	//       configuration file.
+	if loaded.ProxyPort == 0 || cmd.Flags().Changed("port") {
+		loaded.ProxyPort = c.ProxyPort
+	}
+	if cmd.Flags().Changed("remote") {
+		loaded.RemoteAddr = c.RemoteAddr
+	}
+	return loaded, nil
+}
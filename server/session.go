@@ -0,0 +1,1025 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/jackc/pgproto3/v2"
+
+	"github.com/dhermes/postgresql-schema-router/postgres"
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// replicationLagQuery measures how far a replica is behind its primary.
+	// A replica that has replayed everything it has received is considered
+	// current, even if the primary has been idle.
+	replicationLagQuery = `
+SELECT CASE
+  WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+  ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+)
+
+// session is a single client connection and the server connections opened
+// on its behalf.
+type session struct {
+	// ID identifies the session (see `sessionRegistry`); it is zero until
+	// the session has connected to its backend.
+	ID         uint64
+	Started    time.Time
+	Server     *proxyServer
+	Client     net.Conn
+	Reader     *bufio.Reader
+	WriteMutex sync.Mutex
+	Parameters map[string]string
+	SearchPath []string
+	// Backend is the backend chosen for the session by its startup
+	// parameters; it receives the startup connection and relations in
+	// schemas without a route.
+	Backend string
+	// Unregister removes the session's cancellation key data from the
+	// server.
+	Unregister func()
+	// Activity counts the traffic between the client and the proxy.
+	Activity sessionActivity
+	// Span is the span of the session's startup (accepting the client,
+	// dialing its backend and authenticating); `nil` if tracing is
+	// disabled.
+	Span *span
+
+	Mutex  sync.Mutex
+	Conns  []*serverConn
+	Closed bool
+
+	// Startup is the connection that relayed authentication to the client.
+	Startup *serverConn
+	// Last is the connection that most recently received a statement.
+	Last *serverConn
+	// Batch is the connection receiving the current extended query protocol
+	// batch (i.e. the messages since the last `Sync`).
+	Batch       *serverConn
+	BatchFailed bool
+	Statements  map[string]*serverConn
+	Portals     map[string]*serverConn
+
+	// DeferredBegin is a `BEGIN` statement that has been acknowledged to the
+	// client but not yet sent to a server. It will be sent to whichever
+	// backend receives the first statement in the transaction.
+	DeferredBegin    string
+	DeferredReadOnly bool
+	// Waiting is the paused backend a statement is being held for (guarded
+	// by `Mutex`).
+	Waiting string
+	// Statement is the text of the current (or, once it has finished, the
+	// most recent) statement and StatementStarted is when it was received;
+	// both are guarded by `Mutex`.
+	Statement        string
+	StatementStarted time.Time
+	// StatementText and PortalText are the SQL of the prepared statements
+	// and portals by name, used to track the current `Statement` of the
+	// extended query protocol.
+	StatementText map[string]string
+	PortalText    map[string]string
+	// Execution is the most recently queued execution, BatchExecution is the
+	// execution for the current extended query protocol batch (until its
+	// `Sync`) and Executions are waiting for their `ReadyForQuery` (guarded
+	// by `Mutex`).
+	Execution      *execution
+	BatchExecution *execution
+	Executions     []*execution
+
+	// Mirrors replay statements on shadow backends (see `router.Rule`),
+	// by backend name.
+	Mirrors map[string]*mirror
+	// MirrorBatch is the mirroring of the current extended query protocol
+	// batch, if it is mirrored.
+	MirrorBatch *mirrorJob
+	// MirroredStatements are the prepared statements that were mirrored;
+	// batches that bind them are mirrored as well.
+	MirroredStatements map[string]*mirrorJob
+}
+
+func newSession(ps *proxyServer, client net.Conn) *session {
+	return &session{
+		Started:    time.Now(),
+		Server:     ps,
+		Client:     client,
+		Reader:     bufio.NewReader(client),
+		Statements: map[string]*serverConn{},
+		Portals:    map[string]*serverConn{},
+		Unregister: func() {},
+		Mirrors:    map[string]*mirror{},
+
+		StatementText:      map[string]string{},
+		PortalText:         map[string]string{},
+		MirroredStatements: map[string]*mirrorJob{},
+	}
+}
+
+// Run reads and routes messages from the client until the client terminates
+// the session.
+func (s *session) Run() error {
+	for {
+		chunk, err := postgres.ReadMessage(s.Reader)
+		if err == io.EOF || isClosed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.Activity.Received(chunk)
+
+		fm, err := postgres.ParseChunk(chunk)
+		if err != nil {
+			return err
+		}
+
+		switch m := fm.(type) {
+		case *pgproto3.Terminate:
+			return nil
+		case *pgproto3.Query:
+			err = s.handleQuery(chunk, m)
+		case *pgproto3.Parse:
+			err = s.handleParse(chunk, m)
+		case *pgproto3.Bind:
+			s.PortalText[m.DestinationPortal] = s.StatementText[m.PreparedStatement]
+			e := s.batchExecution()
+			e.Parameters += len(m.Parameters)
+			for _, parameter := range m.Parameters {
+				e.ParameterBytes += len(parameter)
+			}
+			if prepared, ok := s.MirroredStatements[m.PreparedStatement]; ok && s.MirrorBatch == nil {
+				s.MirrorBatch = s.rebindMirror(prepared)
+			}
+			var sc *serverConn
+			sc, err = s.extended(chunk, s.Statements[m.PreparedStatement])
+			if sc != nil {
+				s.Portals[m.DestinationPortal] = sc
+			}
+		case *pgproto3.Describe:
+			_, err = s.extended(chunk, s.lookup(m.ObjectType, m.Name))
+		case *pgproto3.Execute:
+			s.setStatement(s.PortalText[m.Portal])
+			e := s.batchExecution()
+			if len(e.Statements) == 0 {
+				// NOTE: The duration of a batch is measured from its first
+				//       `Execute`.
+				e.Outcome.Started = time.Now()
+			}
+			e.Statements = append(e.Statements, s.PortalText[m.Portal])
+			_, err = s.extended(chunk, s.Portals[m.Portal])
+		case *pgproto3.Close:
+			_, err = s.extended(chunk, s.lookup(m.ObjectType, m.Name))
+			if m.ObjectType == 'S' {
+				delete(s.Statements, m.Name)
+				delete(s.StatementText, m.Name)
+				delete(s.MirroredStatements, m.Name)
+			} else {
+				delete(s.Portals, m.Name)
+				delete(s.PortalText, m.Name)
+			}
+		case *pgproto3.Flush:
+			_, err = s.extended(chunk, nil)
+		case *pgproto3.Sync:
+			err = s.handleSync(chunk)
+		case *pgproto3.CopyData, *pgproto3.CopyDone, *pgproto3.CopyFail:
+			err = s.defaultConn().Send(chunk, nil)
+		default:
+			err = fmt.Errorf("%w; %T", ErrUnexpectedMessage, fm)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *session) handleQuery(chunk []byte, q *pgproto3.Query) error {
+	atomic.AddInt64(&s.Server.Stats.Queries, 1)
+	s.setStatement(q.String)
+	e := s.newExecution()
+	e.Statements = []string{q.String}
+	e.Span.Adopt(sqlTraceparent(q.String))
+	s.queueExecution(e)
+	s.waitIdle()
+	if schema, cutOver, ok := router.ParseCutOver(q.String); ok {
+		return s.cutOver(schema, cutOver)
+	}
+	statements, parseErr := s.parse(q.String, "Query")
+	err := s.checkFirewall(statements, parseErr)
+	if err == nil {
+		err = s.checkAllowlist(q.String, statements)
+	}
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+
+	handled, err := s.deferTransaction(statements)
+	if handled || err != nil {
+		return err
+	}
+
+	hints, err := s.hints(q.String)
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+	rewritten, err := s.rewrite(q.String, parseErr)
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+	if rewritten != q.String {
+		chunk = (&pgproto3.Query{String: rewritten}).Encode(nil)
+	}
+	o, fanOut, err := s.requestedFanOut(hints, statements)
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+	if fanOut {
+		return s.fanOut(chunk, o)
+	}
+
+	var d router.Decision
+	var sc *serverConn
+	if parseErr != nil {
+		d, sc, err = s.routeUnparsed(q.String, parseErr, hints)
+	} else {
+		d, sc, err = s.routeStatements(statements, hints, true)
+	}
+	if err != nil {
+		return s.rejectQuery(err)
+	}
+	if sc == nil {
+		return s.fanOut(chunk, fanOutOptions{Dedupe: true})
+	}
+
+	if len(statements) == 1 {
+		if tc, _ := router.Transaction(statements[0]); tc == router.TransactionEnd {
+			s.mirrorTransactionEnd(q.String, chunk)
+		}
+	}
+	return s.sendQuery(sc, chunk, s.mirrorJob(d, q.String, chunk))
+}
+
+// sendQuery sends a simple query to a server; `job` is the mirroring of the
+// query, if it is mirrored.
+func (s *session) sendQuery(sc *serverConn, chunk []byte, job *mirrorJob) error {
+	err := s.beginDeferred(sc)
+	if err != nil {
+		return err
+	}
+
+	s.Last = sc
+	s.attribute(sc.Backend)
+	err = sc.Send(chunk, s.observedCycle(job))
+	if err != nil {
+		return err
+	}
+	s.enqueueMirror(job)
+	return nil
+}
+
+func (s *session) handleParse(chunk []byte, p *pgproto3.Parse) error {
+	if s.BatchFailed {
+		return nil
+	}
+	s.StatementText[p.Name] = p.Query
+	e := s.batchExecution()
+	e.Prepared = append(e.Prepared, p.Query)
+	if len(e.Prepared) == 1 {
+		e.Span.Adopt(sqlTraceparent(p.Query))
+	}
+
+	if s.Batch == nil {
+		s.waitIdle()
+	}
+	statements, parseErr := s.parse(p.Query, "Parse")
+	err := s.checkFirewall(statements, parseErr)
+	if err == nil {
+		err = s.checkAllowlist(p.Query, statements)
+	}
+	if err != nil {
+		return s.failBatch(err)
+	}
+
+	hints, err := s.hints(p.Query)
+	if err == nil && hints.FanOut {
+		err = ErrFanOutNotSupported
+	}
+	if err != nil {
+		return s.failBatch(err)
+	}
+	rewritten, err := s.rewrite(p.Query, parseErr)
+	if err != nil {
+		return s.failBatch(err)
+	}
+	if rewritten != p.Query {
+		rp := &pgproto3.Parse{Name: p.Name, Query: rewritten, ParameterOIDs: p.ParameterOIDs}
+		chunk = rp.Encode(nil)
+	}
+
+	var sc *serverConn
+	var d router.Decision
+	switch {
+	case parseErr != nil:
+		d, sc, err = s.routeUnparsed(p.Query, parseErr, hints)
+	case statements != nil || hints.Backend != "" || hints.Schema != "":
+		d, sc, err = s.routeStatements(statements, hints, false)
+	}
+	if err != nil {
+		return s.failBatch(err)
+	}
+
+	delete(s.MirroredStatements, p.Name)
+	if job := s.mirrorJob(d, p.Query, nil); job != nil {
+		s.MirroredStatements[p.Name] = job
+		if s.MirrorBatch == nil {
+			s.MirrorBatch = job
+		}
+	}
+
+	sc, err = s.extended(chunk, sc)
+	if sc != nil {
+		s.Statements[p.Name] = sc
+	}
+	return err
+}
+
+// extended forwards an extended query protocol message. Every message
+// between two `Sync` messages must go to the same server; `sc` is the
+// server required by the message (or `nil` if the message has no
+// preference).
+func (s *session) extended(chunk []byte, sc *serverConn) (*serverConn, error) {
+	if s.BatchFailed {
+		return nil, nil
+	}
+
+	if s.Batch == nil {
+		if sc == nil {
+			sc = s.defaultConn()
+		}
+		if sc != s.Last {
+			s.waitIdle()
+		}
+		s.Batch = sc
+	}
+	if sc != nil && sc != s.Batch {
+		return nil, s.failBatch(ErrCrossBackendBatch)
+	}
+
+	err := s.beginDeferred(s.Batch)
+	if err != nil {
+		return nil, err
+	}
+	if s.MirrorBatch != nil {
+		s.MirrorBatch.Chunk = append(s.MirrorBatch.Chunk, chunk...)
+	}
+	return s.Batch, s.Batch.Send(chunk, nil)
+}
+
+func (s *session) handleSync(chunk []byte) error {
+	atomic.AddInt64(&s.Server.Stats.Queries, 1)
+	sc := s.Batch
+	failed := s.BatchFailed
+	job := s.MirrorBatch
+	s.Batch = nil
+	s.BatchFailed = false
+	s.MirrorBatch = nil
+	s.queueExecution(s.batchExecution())
+	s.BatchExecution = nil
+
+	if sc == nil {
+		if failed {
+			return s.send(&pgproto3.ReadyForQuery{TxStatus: s.clientStatus()})
+		}
+		sc = s.defaultConn()
+	}
+
+	s.Last = sc
+	s.attribute(sc.Backend)
+	if failed {
+		job = nil
+	}
+	if job != nil {
+		job.Chunk = append(job.Chunk, chunk...)
+	}
+	err := sc.Send(chunk, s.observedCycle(job))
+	if err != nil {
+		return err
+	}
+	s.enqueueMirror(job)
+	return nil
+}
+
+func (s *session) lookup(objectType byte, name string) *serverConn {
+	if objectType == 'S' {
+		return s.Statements[name]
+	}
+	return s.Portals[name]
+}
+
+// deferTransaction handles a `BEGIN` sent while no transaction is open by
+// acknowledging it without sending it to a server; the backend for the
+// transaction is not known until the first statement in the transaction.
+// Returns `true` if the statements were handled.
+func (s *session) deferTransaction(statements parser.Statements) (bool, error) {
+	if len(statements) != 1 {
+		return false, nil
+	}
+
+	tc, readOnly := router.Transaction(statements[0])
+	if tc == router.TransactionBegin && s.DeferredBegin == "" && s.clientStatus() == 'I' {
+		s.DeferredBegin = statements[0].SQL
+		s.DeferredReadOnly = readOnly
+		return true, s.send(
+			&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+			&pgproto3.ReadyForQuery{TxStatus: 'T'},
+		)
+	}
+	if tc == router.TransactionEnd && s.DeferredBegin != "" {
+		s.DeferredBegin = ""
+		tag := statements[0].AST.StatementTag()
+		return true, s.send(
+			&pgproto3.CommandComplete{CommandTag: []byte(tag)},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		)
+	}
+
+	return false, nil
+}
+
+// beginDeferred sends a deferred `BEGIN` (if there is one) to the server
+// that will handle the first statement of the transaction. The response
+// was already sent to the client, so the server response is discarded.
+func (s *session) beginDeferred(sc *serverConn) error {
+	if s.DeferredBegin == "" {
+		return nil
+	}
+
+	q := &pgproto3.Query{String: s.DeferredBegin}
+	s.DeferredBegin = ""
+	return sc.Send(q.Encode(nil), newCycle(discardResponse))
+}
+
+// checkFirewall applies the firewall rules (see `Config.Firewall`) to parsed
+// statements, or to SQL that could not be parsed (`parseErr` is set); every
+// denied statement is logged.
+func (s *session) checkFirewall(statements parser.Statements, parseErr error) error {
+	err := s.firewall(statements, parseErr)
+	if err != nil {
+		logf("Firewall rejected a statement in session %d; %v", s.ID, err)
+	}
+	return err
+}
+
+// firewall implements `checkFirewall()` without logging.
+func (s *session) firewall(statements parser.Statements, parseErr error) error {
+	r := s.Server.router()
+	if parseErr != nil {
+		return r.CheckFirewallUnparsed(s.routerSession(), time.Now())
+	}
+	return r.CheckFirewall(statements, s.routerSession(), time.Now())
+}
+
+// rewrite renames schemas in the SQL of a `Query` or `Parse` (see
+// `router.Rewrite()`). The rewrite is verified by parsing, so SQL that could
+// not be parsed (`parseErr` is set) is left to the `unparsed` policy and sent
+// unchanged.
+func (s *session) rewrite(sql string, parseErr error) (string, error) {
+	if parseErr != nil {
+		return sql, nil
+	}
+	return s.Server.router().Rewrite(sql)
+}
+
+// hints parses the routing hints in the comments of a statement. Hints are
+// ignored if they are disabled and rejected for users that may not use them;
+// every hint that is used is logged.
+func (s *session) hints(sql string) (router.Hints, error) {
+	hints, err := s.parseHints(sql)
+	user := s.Parameters["user"]
+	if errors.Is(err, ErrHintNotAllowed) {
+		logf("Rejected routing hint %q from user %q", hints, user)
+		return router.Hints{}, err
+	}
+	if err == nil && !hints.Empty() {
+		logf("Routing hint %q from user %q", hints, user)
+	}
+	return hints, err
+}
+
+// parseHints implements `hints()` without logging; hints the user may not
+// use are returned along with `ErrHintNotAllowed`.
+func (s *session) parseHints(sql string) (router.Hints, error) {
+	config := s.Server.config().Hints
+	if config.Disabled {
+		return router.Hints{}, nil
+	}
+
+	hints, err := router.ParseHints(sql)
+	if err != nil || hints.Empty() {
+		return hints, err
+	}
+
+	user := s.Parameters["user"]
+	allowed := len(config.Users) == 0
+	for _, candidate := range config.Users {
+		allowed = allowed || candidate == user
+	}
+	if !allowed {
+		return hints, fmt.Errorf("%w; user %q", ErrHintNotAllowed, user)
+	}
+	return hints, nil
+}
+
+// requestedFanOut determines if a query should be sent to every backend,
+// either because of a `/* route: fan_out */` hint or because the session
+// user is a dedicated fan-out user. A hint for statements that cannot be
+// sent to every backend is an error; for a fan-out user, such statements are
+// routed as usual.
+func (s *session) requestedFanOut(hints router.Hints, statements parser.Statements) (fanOutOptions, bool, error) {
+	config := s.Server.config().FanOut
+	o := fanOutOptions{BackendColumn: config.BackendColumn}
+	o.BackendColumn = o.BackendColumn || hints.BackendColumn
+
+	dedicated := false
+	for _, user := range config.Users {
+		dedicated = dedicated || user == s.Parameters["user"]
+	}
+	if !hints.FanOut && !dedicated {
+		return o, false, nil
+	}
+
+	supported := len(statements) == 1 && s.clientStatus() == 'I' && s.Server.router().ReadOnly(router.Analyze(statements[0]))
+	if !supported && hints.FanOut {
+		return o, false, ErrFanOutNotSupported
+	}
+	return o, supported, nil
+}
+
+// routeStatements determines the server connection for a set of parsed
+// statements, taking routing hints into account. If `allowFanOut` is set,
+// the connection will be `nil` when the statements should be sent to every
+// backend (see `fanOut()`); this is only possible outside of a transaction.
+func (s *session) routeStatements(statements parser.Statements, hints router.Hints, allowFanOut bool) (router.Decision, *serverConn, error) {
+	sp := s.startSpan("route", spanKindInternal, "")
+	d, sc, err := s.decide(statements, hints, allowFanOut)
+	sp.Set("router.backend", d.Backend)
+	sp.Set("router.read_only", d.ReadOnly)
+	sp.Set("router.fan_out", d.FanOut)
+	if sc != nil {
+		sp.Set("server.address", sc.Addr)
+		sp.Set("router.replica", sc.Replica)
+	}
+	sp.End(err)
+	return d, sc, err
+}
+
+// decide implements `routeStatements()`.
+func (s *session) decide(statements parser.Statements, hints router.Hints, allowFanOut bool) (router.Decision, *serverConn, error) {
+	d, err := s.decision(statements, hints, allowFanOut)
+	if err != nil {
+		return d, nil, err
+	}
+
+	var sc *serverConn
+	if !d.FanOut {
+		sc, err = s.pick(d)
+		if err != nil {
+			return d, nil, err
+		}
+	}
+	s.trackSearchPath(statements)
+	return d, sc, nil
+}
+
+// decision is the routing decision for parsed statements (see
+// `routeStatements()`), before a server connection is chosen.
+func (s *session) decision(statements parser.Statements, hints router.Hints, allowFanOut bool) (router.Decision, error) {
+	d, err := s.Server.router().RouteHinted(statements, s.routerSession(), hints)
+	if err != nil {
+		return d, err
+	}
+	d.FanOut = d.FanOut && allowFanOut && s.clientStatus() == 'I'
+	return d, nil
+}
+
+// trackSearchPath follows the `search_path` set by the statements, so later
+// unqualified names are resolved the way the backend resolves them.
+func (s *session) trackSearchPath(statements parser.Statements) {
+	for _, statement := range statements {
+		if searchPath, ok := router.SearchPath(statement); ok {
+			s.SearchPath = searchPath
+		}
+	}
+}
+
+// pick chooses (or opens) the server connection for a routing decision. An
+// open transaction pins the session to the connection it was started on;
+// otherwise read-only statements are sent to a replica when one is
+// available.
+func (s *session) pick(d router.Decision) (*serverConn, error) {
+	if s.Last != nil && s.Last.Status() != 'I' {
+		if d.Backend != "" && d.Backend != s.Last.Backend {
+			err := fmt.Errorf(
+				"%w; the transaction was started on backend %q but the statement requires backend %q",
+				ErrCrossBackendTransaction, s.Last.Backend, d.Backend,
+			)
+			return nil, err
+		}
+		return s.Last, nil
+	}
+
+	readOnly := d.ReadOnly && (s.DeferredBegin == "" || s.DeferredReadOnly)
+	name := d.Backend
+	if name == "" {
+		if s.Last != nil && (readOnly || !s.Last.Replica) {
+			return s.Last, nil
+		}
+		name = s.defaultConn().Backend
+	}
+
+	err := s.waitResumed(name)
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		sc := s.replicaConn(name)
+		if sc != nil {
+			return sc, nil
+		}
+	}
+	return s.primaryConn(name)
+}
+
+func (s *session) primaryConn(name string) (*serverConn, error) {
+	for _, sc := range s.conns() {
+		if sc.Backend == name && !sc.Replica && !sc.Broken() {
+			return sc, nil
+		}
+	}
+
+	b := s.Server.backend(name)
+	return s.connect(b, b.Config.Primary, false)
+}
+
+// replicaConn returns a connection to a replica for the backend, or `nil`
+// if no healthy replica is available. A session keeps using the same replica
+// while it stays healthy; otherwise the backend's balancing strategy chooses
+// a new one.
+func (s *session) replicaConn(name string) *serverConn {
+	b := s.Server.backend(name)
+	if len(b.Replicas) == 0 {
+		return nil
+	}
+
+	for _, sc := range s.conns() {
+		if sc.Backend == name && sc.Replica && !sc.Broken() {
+			if s.replicaCurrent(b, sc) {
+				return sc
+			}
+			s.dropConn(sc)
+		}
+	}
+
+	bc := balanceContext{Parameters: s.Parameters}
+	tried := map[*replica]bool{}
+	for {
+		r := b.pickReplica(bc, tried)
+		if r == nil {
+			return nil
+		}
+		tried[r] = true
+
+		sc, err := s.connect(b, r.Addr, true)
+		if err != nil {
+			r.MarkFailed()
+			logf("Failed to connect to replica %s of backend %q; %v", r.Addr, name, err)
+			continue
+		}
+		if s.replicaCurrent(b, sc) {
+			return sc
+		}
+		s.dropConn(sc)
+	}
+}
+
+// replicaCurrent checks that the replication lag for a replica is within the
+// configured limit. The lag is measured (on the session's own connection) at
+// most once per `lagCheckInterval` across all sessions.
+func (s *session) replicaCurrent(b *backend, sc *serverConn) bool {
+	maxLag := time.Duration(b.Config.MaxReplicationLag)
+	if maxLag == 0 {
+		return true
+	}
+
+	r := b.replica(sc.Addr)
+	lag, ok := r.LagKnown()
+	if !ok {
+		var err error
+		lag, err = measureLag(sc)
+		if err != nil {
+			logf("Failed to measure replication lag for replica %s of backend %q; %v", sc.Addr, b.Config.Name, err)
+			return false
+		}
+		r.SetLag(lag)
+	}
+
+	return lag <= maxLag
+}
+
+func measureLag(sc *serverConn) (time.Duration, error) {
+	r, err := sc.Query(replicationLagQuery)
+	if err != nil {
+		return 0, err
+	}
+	if len(r.Rows) != 1 || len(r.Rows[0]) != 1 {
+		return 0, fmt.Errorf("%w; expected a single value", ErrUnexpectedMessage)
+	}
+
+	seconds, err := strconv.ParseFloat(string(r.Rows[0][0]), 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// connect opens an additional server connection; these authenticate with the
+// credentials in the backend configuration rather than relaying to the
+// client.
+func (s *session) connect(b *backend, addr string, isReplica bool) (*serverConn, error) {
+	sp := s.startSpan("dial", spanKindClient, b.Config.Name)
+	sp.Set("server.address", addr)
+	sp.Set("router.replica", isReplica)
+	sc, err := dialServer(b.Config.Name, addr, isReplica)
+	sp.End(err)
+	if err != nil {
+		return nil, fmt.Errorf("%w; %s: %v", ErrBackendUnavailable, b.Config.Name, err)
+	}
+
+	sp = s.startSpan("authenticate", spanKindInternal, b.Config.Name)
+	err = sc.Startup(s.backendParameters(b), b.Config.Password)
+	sp.End(err)
+	if err != nil {
+		err = fmt.Errorf("%w; %s: %v", ErrBackendUnavailable, b.Config.Name, err)
+		return nil, appendErrs(err, sc.Conn.Close())
+	}
+	if r := b.replica(addr); isReplica && r != nil {
+		sc.Release = r.Acquire()
+	} else if !isReplica {
+		sc.Release = b.Acquire()
+	}
+
+	s.addConn(sc)
+	return sc, nil
+}
+
+// backendParameters are the startup parameters for an additional connection
+// to a backend: the client's parameters with the user and database from the
+// backend configuration.
+func (s *session) backendParameters(b *backend) map[string]string {
+	parameters := map[string]string{}
+	for key, value := range s.Parameters {
+		parameters[key] = value
+	}
+	if b.Config.User != "" {
+		parameters["user"] = b.Config.User
+	}
+	if b.Config.Database != "" {
+		parameters["database"] = b.Config.Database
+	}
+	return parameters
+}
+
+func (s *session) addConn(sc *serverConn) {
+	s.Mutex.Lock()
+	s.Conns = append(s.Conns, sc)
+	s.Mutex.Unlock()
+
+	sc.Start(s.writeClient, func(err error, pending bool) {
+		s.serverClosed(sc, err, pending)
+	})
+}
+
+// dropConn closes a server connection the session no longer wants (e.g. to
+// a replica that is lagging), unless a prepared statement, a portal or the
+// current batch still uses it.
+func (s *session) dropConn(sc *serverConn) {
+	if sc == s.Startup || sc == s.Batch {
+		return
+	}
+	for _, other := range s.Statements {
+		if other == sc {
+			return
+		}
+	}
+	for _, other := range s.Portals {
+		if other == sc {
+			return
+		}
+	}
+
+	s.Mutex.Lock()
+	for i, candidate := range s.Conns {
+		if candidate == sc {
+			s.Conns = append(s.Conns[:i], s.Conns[i+1:]...)
+			break
+		}
+	}
+	s.Mutex.Unlock()
+	if s.Last == sc {
+		s.Last = nil
+	}
+	err := sc.Close()
+	if err != nil && !isClosed(err) {
+		logf("Failed to close connection to %s (backend %q); %v", sc.Addr, sc.Backend, err)
+	}
+}
+
+// serverClosed is invoked when a server connection fails. Losing an idle
+// replica connection is recoverable, any other failure ends the session.
+// Connections dropped by the session (see `dropConn()`) are ignored.
+func (s *session) serverClosed(sc *serverConn, err error, pending bool) {
+	s.Mutex.Lock()
+	closed := s.Closed
+	owned := false
+	for _, candidate := range s.Conns {
+		owned = owned || candidate == sc
+	}
+	s.Mutex.Unlock()
+	if closed || !owned {
+		return
+	}
+
+	if sc.Replica && !pending {
+		if b := s.Server.backend(sc.Backend); b != nil && b.replica(sc.Addr) != nil {
+			b.replica(sc.Addr).MarkFailed()
+		}
+		sc.Release()
+		return
+	}
+
+	if err != io.EOF && !isClosed(err) {
+		logf("Connection to %s (backend %q) failed; %v", sc.Addr, sc.Backend, err)
+	}
+	s.Client.Close()
+}
+
+func (s *session) conns() []*serverConn {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return append([]*serverConn(nil), s.Conns...)
+}
+
+// setStatement records the statement the session is currently running.
+func (s *session) setStatement(sql string) {
+	s.Mutex.Lock()
+	s.Statement = sql
+	s.StatementStarted = time.Now()
+	s.Mutex.Unlock()
+}
+
+func (s *session) routerSession() router.Session {
+	return router.Session{
+		User:       s.Parameters["user"],
+		Database:   s.Parameters["database"],
+		SearchPath: s.SearchPath,
+		Backend:    s.Backend,
+	}
+}
+
+// defaultConn is the connection used for messages that do not determine a
+// backend on their own.
+func (s *session) defaultConn() *serverConn {
+	if s.Last != nil {
+		return s.Last
+	}
+	return s.Startup
+}
+
+// waitIdle waits for the responses to every message already sent. This
+// ensures responses reach the client in order when the next message is sent
+// to a different server and that the transaction status is current.
+func (s *session) waitIdle() {
+	if s.Last != nil {
+		s.Last.WaitIdle()
+	}
+}
+
+// clientStatus is the transaction status the client should currently see.
+func (s *session) clientStatus() byte {
+	if s.DeferredBegin != "" {
+		return 'T'
+	}
+	if s.Last != nil {
+		return s.Last.Status()
+	}
+	return 'I'
+}
+
+func (s *session) writeClient(chunk []byte) error {
+	s.WriteMutex.Lock()
+	defer s.WriteMutex.Unlock()
+	_, err := s.Client.Write(chunk)
+	s.Activity.Sent(chunk)
+	s.observeSent(chunk)
+	return err
+}
+
+func (s *session) send(messages ...pgproto3.BackendMessage) error {
+	var buf []byte
+	for _, message := range messages {
+		buf = message.Encode(buf)
+	}
+	return s.writeClient(buf)
+}
+
+func errorResponse(err error) *pgproto3.ErrorResponse {
+	message := err.Error()
+	detail := ""
+	if i := strings.Index(message, "; "); i != -1 {
+		message, detail = message[:i], message[i+2:]
+	}
+	er := &pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     sqlState(err),
+		Message:  message,
+		Detail:   detail,
+	}
+	var hinted interface{ Hint() string }
+	if errors.As(err, &hinted) {
+		er.Hint = hinted.Hint()
+	}
+	return er
+}
+
+// rejectQuery reports an error for a simple query that was not sent to any
+// server.
+func (s *session) rejectQuery(err error) error {
+	return s.send(errorResponse(err), &pgproto3.ReadyForQuery{TxStatus: s.clientStatus()})
+}
+
+// failBatch reports an error for an extended query protocol message; the
+// remaining messages up to the next `Sync` are discarded.
+func (s *session) failBatch(err error) error {
+	s.BatchFailed = true
+	return s.send(errorResponse(err))
+}
+
+// sendFatal reports an error that ends the session.
+func (s *session) sendFatal(err error) error {
+	er := errorResponse(err)
+	er.Severity = "FATAL"
+	return s.send(er)
+}
+
+// Close closes the client connection and every server connection.
+func (s *session) Close() error {
+	s.Mutex.Lock()
+	s.Closed = true
+	conns := s.Conns
+	s.Mutex.Unlock()
+	s.Unregister()
+	for _, m := range s.Mirrors {
+		close(m.Jobs)
+	}
+
+	var errs []error
+	for _, sc := range conns {
+		err := sc.Close()
+		if err != nil && !isClosed(err) {
+			errs = append(errs, err)
+		}
+	}
+	err := s.Client.Close()
+	if err != nil && !isClosed(err) {
+		errs = append(errs, err)
+	}
+	return appendErrs(errs...)
+}
+
+// discardResponse is a `messageHandler` for responses the client should not
+// see; errors are logged.
+func discardResponse(chunk []byte) error {
+	if chunk[0] != 'E' {
+		return nil
+	}
+
+	bm, err := postgres.ParseBackendChunk(chunk)
+	if err != nil {
+		return err
+	}
+	if er, ok := bm.(*pgproto3.ErrorResponse); ok {
+		logf("Discarded error from server; %s (SQLSTATE %s)", er.Message, er.Code)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+func TestHandleQueryFirewall(t *testing.T) {
+	t.Parallel()
+	billing := startBackend(t, "billing")
+	crm := startBackend(t, "crm")
+	c := fanOutConfig(billing.Addr, crm.Addr)
+	c.FanOut = FanOutConfig{}
+	c.Firewall = []router.FirewallRule{
+		{Name: "no-destructive", Users: []string{"app_*"}, StatementTypes: []string{"DROP", "TRUNCATE"}},
+		{Name: "crm-read-only", Users: []string{"reporting"}, Schemas: []string{"crm"}, StatementTypes: []string{"INSERT", "UPDATE", "DELETE"}},
+	}
+	_, addr := startProxy(t, c)
+
+	cases := []struct {
+		User    string
+		SQL     string
+		Backend string
+		Rule    string
+	}{
+		{User: "reporting", SQL: "SELECT * FROM crm.contacts", Backend: "crm"},
+		{User: "reporting", SQL: "UPDATE crm.contacts SET name = 'x'", Rule: "crm-read-only"},
+		{User: "reporting", SQL: "UPDATE billing.invoices SET paid = true", Backend: "billing"},
+		{User: "reporting", SQL: "SET search_path = crm"},
+		{User: "app_web", SQL: "TRUNCATE billing.invoices", Rule: "no-destructive"},
+		{User: "app_web", SQL: "DROP TABLE crm.contacts", Rule: "no-destructive"},
+		// NOTE: SQL the parser fails on cannot be checked, so it is denied.
+		{User: "app_web", SQL: "LOCK TABLE crm.contacts", Rule: "no-destructive"},
+		{User: "admin", SQL: "TRUNCATE billing.invoices", Backend: "billing"},
+	}
+	clients := map[string]*testClient{}
+	for _, tc := range cases {
+		client, ok := clients[tc.User]
+		if !ok {
+			client = login(t, addr, map[string]string{"user": tc.User, "database": "app"})
+			clients[tc.User] = client
+		}
+
+		rows, er := client.Query(tc.SQL)
+		if tc.Rule != "" {
+			if er == nil || er.Code != "42501" || !strings.Contains(er.Detail, tc.Rule) {
+				t.Fatalf("%q from %s was not denied by %q; rows %q, error %#v", tc.SQL, tc.User, tc.Rule, rows, er)
+			}
+			continue
+		}
+		if er != nil {
+			t.Fatalf("%q from %s failed; %s", tc.SQL, tc.User, er.Message)
+		}
+		if tc.Backend != "" && (len(rows) != 1 || rows[0][0] != tc.Backend) {
+			t.Fatalf("%q from %s was not sent to %s; rows %q", tc.SQL, tc.User, tc.Backend, rows)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxStatementEntries is the number of (fingerprint, backend) pairs
+	// statistics are kept for; when a new pair is seen and the limit is
+	// reached, the pair with the fewest calls is discarded (as with
+	// `pg_stat_statements.max`).
+	maxStatementEntries = 5000
+)
+
+// statementStats aggregates executions by fingerprint (see
+// `router.Fingerprint()`) and backend, like `pg_stat_statements` but across
+// every backend. An execution sent to several backends (a fan-out) counts
+// for each of them; an execution rejected by the proxy has no backend.
+type statementStats struct {
+	Mutex   sync.Mutex
+	Entries map[statementKey]*statementSummary
+}
+
+type statementKey struct {
+	Fingerprint string
+	Backend     string
+}
+
+// statementSummary describes the executions with a fingerprint on a backend.
+type statementSummary struct {
+	Fingerprint string   `json:"fingerprint"`
+	Backend     string   `json:"backend"`
+	Query       string   `json:"query"`
+	Calls       int64    `json:"calls"`
+	TotalTime   Duration `json:"total_time"`
+	MeanTime    Duration `json:"mean_time"`
+	MinTime     Duration `json:"min_time"`
+	MaxTime     Duration `json:"max_time"`
+	Rows        int64    `json:"rows"`
+	Errors      int64    `json:"errors"`
+}
+
+func newStatementStats() *statementStats {
+	return &statementStats{Entries: map[statementKey]*statementSummary{}}
+}
+
+// Record adds a completed execution.
+func (ss *statementStats) Record(e *execution) {
+	if strings.TrimSpace(e.SQL()) == "" {
+		return
+	}
+	query := e.Normalized(true)
+	fingerprint := e.Fingerprint()
+	backends := e.Backends
+	if len(backends) == 0 {
+		backends = []string{""}
+	}
+
+	ss.Mutex.Lock()
+	defer ss.Mutex.Unlock()
+	for _, backend := range backends {
+		key := statementKey{Fingerprint: fingerprint, Backend: backend}
+		summary, ok := ss.Entries[key]
+		if !ok {
+			if len(ss.Entries) >= maxStatementEntries {
+				ss.evict()
+			}
+			summary = &statementSummary{Fingerprint: fingerprint, Backend: backend, Query: query}
+			ss.Entries[key] = summary
+		}
+		summary.add(e.Outcome)
+	}
+}
+
+func (summary *statementSummary) add(o *outcome) {
+	summary.Calls++
+	summary.TotalTime += o.Latency
+	if summary.Calls == 1 || o.Latency < summary.MinTime {
+		summary.MinTime = o.Latency
+	}
+	if o.Latency > summary.MaxTime {
+		summary.MaxTime = o.Latency
+	}
+	summary.Rows += o.Rows
+	if o.Code != "" {
+		summary.Errors++
+	}
+}
+
+// evict discards the entry with the fewest calls. Must be called with
+// `Mutex` held.
+func (ss *statementStats) evict() {
+	var fewest *statementKey
+	var calls int64
+	for key, summary := range ss.Entries {
+		if fewest == nil || summary.Calls < calls {
+			k := key
+			fewest = &k
+			calls = summary.Calls
+		}
+	}
+	if fewest != nil {
+		delete(ss.Entries, *fewest)
+	}
+}
+
+// Summaries describes every (fingerprint, backend) pair, ordered by total
+// time (descending).
+func (ss *statementStats) Summaries() []statementSummary {
+	ss.Mutex.Lock()
+	summaries := make([]statementSummary, 0, len(ss.Entries))
+	for _, summary := range ss.Entries {
+		summaries = append(summaries, *summary)
+	}
+	ss.Mutex.Unlock()
+
+	for i := range summaries {
+		summaries[i].MeanTime = summaries[i].TotalTime / Duration(summaries[i].Calls)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].TotalTime != summaries[j].TotalTime {
+			return summaries[i].TotalTime > summaries[j].TotalTime
+		}
+		if summaries[i].Fingerprint != summaries[j].Fingerprint {
+			return summaries[i].Fingerprint < summaries[j].Fingerprint
+		}
+		return summaries[i].Backend < summaries[j].Backend
+	})
+	return summaries
+}
+
+// Reset discards every statistic (like `pg_stat_statements_reset()`).
+func (ss *statementStats) Reset() {
+	ss.Mutex.Lock()
+	defer ss.Mutex.Unlock()
+	ss.Entries = map[statementKey]*statementSummary{}
+}
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// defaultServiceName is the `service.name` of the proxy when
+	// `TracingConfig.ServiceName` is not set.
+	defaultServiceName = "postgresql-schema-router"
+	// defaultTraceFlushInterval is how often spans are exported when
+	// `TracingConfig.FlushInterval` is not set.
+	defaultTraceFlushInterval = 5 * time.Second
+	// traceQueue is the number of finished spans waiting to be exported;
+	// spans are dropped while it is full.
+	traceQueue = 4096
+	// traceBatch is the largest number of spans in one export request.
+	traceBatch = 512
+	// traceExportTimeout limits each export request.
+	traceExportTimeout = 10 * time.Second
+
+	// The OTLP span kinds used by the proxy.
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	// spanStatusError is the OTLP status code of a failed span.
+	spanStatusError = 2
+)
+
+var (
+	// traceparentPattern matches a W3C `traceparent` value anywhere in an
+	// `application_name`, e.g. `worker 00-<trace-id>-<span-id>-01`.
+	traceparentPattern = regexp.MustCompile(`[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}`)
+)
+
+// spanContext identifies a span (and its trace) as in a W3C `traceparent`.
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// Valid determines if neither the trace ID nor the span ID is zero.
+func (sc spanContext) Valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// parseTraceparent parses a W3C `traceparent` value, e.g.
+// `00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01`.
+func parseTraceparent(value string) (spanContext, bool) {
+	sc := spanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	_, err1 := hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	return sc, sc.Valid()
+}
+
+// sqlTraceparent finds a `traceparent` in the comments of a statement, as
+// added by sqlcommenter: comma separated `key='value'` pairs with URL encoded
+// values, e.g. `/*traceparent='00-...-01',route='/users'*/`.
+func sqlTraceparent(sql string) (spanContext, bool) {
+	for _, comment := range router.Comments(sql) {
+		for _, pair := range strings.Split(comment, ",") {
+			eq := strings.Index(pair, "=")
+			if eq == -1 || strings.TrimSpace(pair[:eq]) != "traceparent" {
+				continue
+			}
+			value, err := url.QueryUnescape(strings.Trim(strings.TrimSpace(pair[eq+1:]), "'"))
+			if err != nil {
+				continue
+			}
+			if sc, ok := parseTraceparent(value); ok {
+				return sc, true
+			}
+		}
+	}
+	return spanContext{}, false
+}
+
+// applicationTraceparent finds a `traceparent` in an `application_name`.
+func applicationTraceparent(applicationName string) (spanContext, bool) {
+	return parseTraceparent(traceparentPattern.FindString(applicationName))
+}
+
+// span is an OpenTelemetry span; a `nil` span (tracing is disabled) ignores
+// every method.
+type span struct {
+	Tracer     *tracer
+	Context    spanContext
+	ParentID   [8]byte
+	Name       string
+	Kind       int
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes []otlpAttribute
+	Error      string
+}
+
+// Adopt makes the span a child of a span from another process (e.g. from a
+// `traceparent`); it must be called before the span has children.
+func (sp *span) Adopt(parent spanContext, ok bool) {
+	if sp == nil || !ok {
+		return
+	}
+	sp.Context.TraceID = parent.TraceID
+	sp.Context.Flags = parent.Flags
+	sp.ParentID = parent.SpanID
+}
+
+// Set adds an attribute; the value is a string, an integer or a boolean.
+func (sp *span) Set(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.Attributes = append(sp.Attributes, newOTLPAttribute(key, value))
+}
+
+// End finishes the span (as failed if `err` is set) and queues it to be
+// exported.
+func (sp *span) End(err error) {
+	if sp == nil {
+		return
+	}
+	sp.EndTime = time.Now()
+	if err != nil {
+		sp.Error = err.Error()
+	}
+	sp.Tracer.export(sp)
+}
+
+// tracer exports finished spans in batches with OTLP over HTTP (JSON
+// encoding).
+type tracer struct {
+	Config TracingConfig
+	Client *http.Client
+	Queue  chan *span
+	Done   chan struct{}
+	// Dropped counts the spans dropped since the last export.
+	Dropped int64
+
+	Mutex  sync.Mutex
+	Closed bool
+}
+
+// newTracer starts exporting spans to the configured endpoint; returns
+// `nil` if tracing is disabled.
+func newTracer(tc TracingConfig) *tracer {
+	if tc.Endpoint == "" {
+		return nil
+	}
+	if tc.ServiceName == "" {
+		tc.ServiceName = defaultServiceName
+	}
+	interval := time.Duration(tc.FlushInterval)
+	if interval == 0 {
+		interval = defaultTraceFlushInterval
+	}
+
+	t := &tracer{
+		Config: tc,
+		Client: &http.Client{Timeout: traceExportTimeout},
+		Queue:  make(chan *span, traceQueue),
+		Done:   make(chan struct{}),
+	}
+	go t.run(interval)
+	return t
+}
+
+// Start starts a span; it is the child of `parent` if set and otherwise
+// starts a new trace. Returns `nil` if tracing is disabled.
+func (t *tracer) Start(name string, kind int, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	sp := &span{Tracer: t, Name: name, Kind: kind, StartTime: time.Now()}
+	if parent != nil {
+		sp.Context.TraceID = parent.Context.TraceID
+		sp.Context.Flags = parent.Context.Flags
+		sp.ParentID = parent.Context.SpanID
+	} else {
+		_, _ = rand.Read(sp.Context.TraceID[:])
+		sp.Context.Flags = 1
+	}
+	_, _ = rand.Read(sp.Context.SpanID[:])
+	return sp
+}
+
+func (t *tracer) export(sp *span) {
+	t.Mutex.Lock()
+	defer t.Mutex.Unlock()
+	if t.Closed {
+		return
+	}
+	select {
+	case t.Queue <- sp:
+	default:
+		atomic.AddInt64(&t.Dropped, 1)
+	}
+}
+
+func (t *tracer) run(interval time.Duration) {
+	defer close(t.Done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case sp, ok := <-t.Queue:
+			if !ok {
+				t.flush(batch)
+				return
+			}
+			batch = append(batch, sp)
+			if len(batch) >= traceBatch {
+				t.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush exports a batch of spans; failures are logged (the spans are not
+// retried).
+func (t *tracer) flush(batch []*span) {
+	if dropped := atomic.SwapInt64(&t.Dropped, 0); dropped > 0 {
+		logf("Dropped %d spans; the tracing export queue is full", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	err := t.post(batch)
+	if err != nil {
+		logf("Failed to export %d spans; %v", len(batch), err)
+	}
+}
+
+func (t *tracer) post(batch []*span) error {
+	body, err := json.Marshal(t.request(batch))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.Config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.Config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w; %s", ErrTraceExport, resp.Status)
+	}
+	return nil
+}
+
+// Close exports the spans that are still queued.
+func (t *tracer) Close() error {
+	t.Mutex.Lock()
+	if t.Closed {
+		t.Mutex.Unlock()
+		return nil
+	}
+	t.Closed = true
+	close(t.Queue)
+	t.Mutex.Unlock()
+	<-t.Done
+	return nil
+}
+
+// otlpRequest is an OTLP `ExportTraceServiceRequest` in the JSON encoding.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpAttribute is a key and a value; exactly one of the values is set
+// (integers are encoded as strings).
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	} `json:"value"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		a.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (t *tracer) request(batch []*span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, sp := range batch {
+		exported := otlpSpan{
+			TraceID:           hex.EncodeToString(sp.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(sp.Context.SpanID[:]),
+			Name:              sp.Name,
+			Kind:              sp.Kind,
+			StartTimeUnixNano: strconv.FormatInt(sp.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(sp.EndTime.UnixNano(), 10),
+			Attributes:        sp.Attributes,
+		}
+		if sp.ParentID != [8]byte{} {
+			exported.ParentSpanID = hex.EncodeToString(sp.ParentID[:])
+		}
+		if sp.Error != "" {
+			exported.Status = otlpStatus{Code: spanStatusError, Message: sp.Error}
+		}
+		spans = append(spans, exported)
+	}
+
+	resource := otlpResource{Attributes: []otlpAttribute{newOTLPAttribute("service.name", t.Config.ServiceName)}}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName}, Spans: spans}},
+	}}}
+}
+
+// currentSpan is the parent of the spans started on behalf of a session:
+// the span of the current execution or, before the first one, the span of
+// the session's startup.
+func (s *session) currentSpan() *span {
+	if s.BatchExecution != nil {
+		return s.BatchExecution.Span
+	}
+	if s.Execution != nil {
+		return s.Execution.Span
+	}
+	return s.Span
+}
+
+// startSpan starts a child of the session's current span for work on a
+// backend.
+func (s *session) startSpan(name string, kind int, backend string) *span {
+	sp := s.Server.Tracer.Start(name, kind, s.currentSpan())
+	if backend != "" {
+		sp.Set("router.backend", backend)
+	}
+	return sp
+}
+
+// endSpan finishes the span of a completed execution: the round trip from
+// the client's first message until its `ReadyForQuery`.
+func (e *execution) endSpan() {
+	sp := e.Span
+	if sp == nil {
+		return
+	}
+	sp.Set("db.system", "postgresql")
+	sp.Set("db.user", e.Session.User)
+	sp.Set("db.name", e.Session.Database)
+	sp.Set("db.statement", e.Normalized(true))
+	sp.Set("router.session", e.SessionID)
+	sp.Set("router.backends", strings.Join(e.Backends, ","))
+	sp.Set("router.rows", e.Outcome.Rows)
+	var err error
+	if e.Outcome.Code != "" {
+		sp.Set("db.response.status_code", e.Outcome.Code)
+		err = fmt.Errorf("%s (SQLSTATE %s)", e.Outcome.Message, e.Outcome.Code)
+	}
+	sp.End(err)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+
+	"github.com/dhermes/postgresql-schema-router/router"
+)
+
+const (
+	// unparsedForward sends SQL that could not be parsed to a backend.
+	unparsedForward = "forward"
+	// unparsedReject rejects SQL that could not be parsed.
+	unparsedReject = "reject"
+	// unparsedTokenize routes SQL that could not be parsed by the qualified
+	// names found in it (see `router.ScanRelations()`).
+	unparsedTokenize = "tokenize"
+	// maxParseFailures is the number of fingerprints parse failures are
+	// kept for; failures with later fingerprints are only counted (see
+	// `parseFailures.Overflow`).
+	maxParseFailures = 1000
+)
+
+// parseFailures records the SQL the parser failed on, by fingerprint (see
+// `router.Fingerprint()`), to track what the parser does not support.
+// Overflow counts the failures that were not kept since `maxParseFailures`
+// fingerprints already were.
+type parseFailures struct {
+	Mutex    sync.Mutex
+	Total    int64
+	Overflow int64
+	Entries  map[string]*parseFailure
+}
+
+// parseFailure describes the SQL with a fingerprint the parser failed on;
+// Query (with constants hidden) and Error are from the first failure.
+type parseFailure struct {
+	Fingerprint string    `json:"fingerprint"`
+	Query       string    `json:"query"`
+	Error       string    `json:"error"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+func newParseFailures() *parseFailures {
+	return &parseFailures{Entries: map[string]*parseFailure{}}
+}
+
+// Record adds a parse failure; returns `true` if it is the first with its
+// fingerprint (and it is kept).
+func (pf *parseFailures) Record(sql string, err error) (parseFailure, bool) {
+	query := router.HideLiterals(sql)
+	fingerprint := router.Fingerprint(query)
+	now := time.Now().UTC()
+
+	pf.Mutex.Lock()
+	defer pf.Mutex.Unlock()
+	pf.Total++
+	failure, ok := pf.Entries[fingerprint]
+	if ok {
+		failure.Count++
+		failure.LastSeen = now
+		return *failure, false
+	}
+	failure = &parseFailure{
+		Fingerprint: fingerprint,
+		Query:       query,
+		Error:       err.Error(),
+		Count:       1,
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+	if len(pf.Entries) >= maxParseFailures {
+		pf.Overflow++
+		return *failure, false
+	}
+	pf.Entries[fingerprint] = failure
+	return *failure, true
+}
+
+// Count returns the number of parse failures and how many of them were not
+// kept (see `Overflow`).
+func (pf *parseFailures) Count() (int64, int64) {
+	pf.Mutex.Lock()
+	defer pf.Mutex.Unlock()
+	return pf.Total, pf.Overflow
+}
+
+// List returns the parse failures, most frequent first.
+func (pf *parseFailures) List() []parseFailure {
+	pf.Mutex.Lock()
+	failures := make([]parseFailure, 0, len(pf.Entries))
+	for _, failure := range pf.Entries {
+		failures = append(failures, *failure)
+	}
+	pf.Mutex.Unlock()
+
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Count != failures[j].Count {
+			return failures[i].Count > failures[j].Count
+		}
+		return failures[i].Fingerprint < failures[j].Fingerprint
+	})
+	return failures
+}
+
+// parse parses the SQL of a `Query` or `Parse` (the `message`). A failure
+// is recorded (and logged the first time its fingerprint is seen) and
+// returned; the statements are then `nil`.
+func (s *session) parse(sql, message string) (parser.Statements, error) {
+	statements, err := router.Parse(sql)
+	if err == nil {
+		return statements, nil
+	}
+	failure, first := s.Server.ParseFailures.Record(sql, err)
+	if first {
+		logf(
+			"Failed to parse SQL from PostgreSQL %s (fingerprint %s, policy %s); %v; %s",
+			message, failure.Fingerprint, s.Server.config().Unparsed.PolicyName(), err, failure.Query,
+		)
+	}
+	return nil, err
+}
+
+// PolicyName returns the policy, defaulting to `forward`.
+func (uc UnparsedConfig) PolicyName() string {
+	if uc.Policy == "" {
+		return unparsedForward
+	}
+	return uc.Policy
+}
+
+// routeUnparsed determines the server connection for SQL that could not be
+// parsed (see `UnparsedConfig`), like `routeStatements()`.
+func (s *session) routeUnparsed(sql string, parseErr error, hints router.Hints) (router.Decision, *serverConn, error) {
+	sp := s.startSpan("route", spanKindInternal, "")
+	d, sc, err := s.decideUnparsed(sql, parseErr, hints)
+	sp.Set("router.backend", d.Backend)
+	sp.Set("router.unparsed", true)
+	if sc != nil {
+		sp.Set("server.address", sc.Addr)
+		sp.Set("router.replica", sc.Replica)
+	}
+	sp.End(err)
+	return d, sc, err
+}
+
+// decideUnparsed implements `routeUnparsed()`.
+func (s *session) decideUnparsed(sql string, parseErr error, hints router.Hints) (router.Decision, *serverConn, error) {
+	d, err := s.unparsedDecision(sql, parseErr, hints)
+	if err != nil {
+		return d, nil, err
+	}
+	sc, err := s.pick(d)
+	if err != nil {
+		return d, nil, err
+	}
+	return d, sc, nil
+}
+
+// unparsedDecision is the routing decision for SQL that could not be parsed
+// (see `routeUnparsed()`), before a server connection is chosen.
+func (s *session) unparsedDecision(sql string, parseErr error, hints router.Hints) (router.Decision, error) {
+	uc := s.Server.config().Unparsed
+	r := s.Server.router()
+	var d router.Decision
+	var err error
+	switch {
+	case uc.Policy == unparsedReject:
+		err = fmt.Errorf("%w; %v", ErrUnparsedSQL, parseErr)
+	case hints.Backend != "" || hints.Schema != "":
+		d, err = r.RouteHinted(nil, s.routerSession(), hints)
+	case uc.Policy == unparsedTokenize:
+		d, err = r.RouteScanned(sql, s.routerSession())
+	}
+	if err != nil {
+		return d, err
+	}
+
+	if d.Backend == "" {
+		d.Backend = uc.Backend
+	}
+	return d, nil
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestParseFailuresOverflow(t *testing.T) {
+	t.Parallel()
+	pf := newParseFailures()
+	parseErr := errors.New("syntax error")
+	_, first := pf.Record("LOCK TABLE crm.contacts", parseErr)
+	if !first {
+		t.Fatal("the first failure was not reported as first")
+	}
+	for i := len(pf.Entries); i < maxParseFailures; i++ {
+		pf.Entries[strconv.Itoa(i)] = &parseFailure{}
+	}
+
+	// NOTE: A failure that is not kept must not be reported as first, or it
+	//       would be logged every time.
+	for i := 0; i < 2; i++ {
+		_, first = pf.Record("LOCK TABLE billing.invoices", parseErr)
+		if first {
+			t.Fatal("a failure that was not kept was reported as first")
+		}
+	}
+	failure, first := pf.Record("LOCK TABLE crm.contacts", parseErr)
+	if first || failure.Count != 2 {
+		t.Fatalf("a kept failure was not counted; %#v", failure)
+	}
+	total, overflow := pf.Count()
+	if total != 4 || overflow != 2 || len(pf.Entries) != maxParseFailures {
+		t.Fatalf("Count() = %d, %d with %d entries, expected 4, 2 with %d", total, overflow, len(pf.Entries), maxParseFailures)
+	}
+}